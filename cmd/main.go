@@ -2,25 +2,59 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
 	"github.com/nagypeterjob/sock-vmnet/internal/stack"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"inet.af/netaddr"
 )
 
+var (
+	errInvalidHost    = errors.New("expected name=ipv4 host override")
+	errInvalidPeerVM  = errors.New("expected fd/mac[/name[/segment]] peer VM")
+	errInvalidSegment = errors.New("segment is out of the 0-65535 range")
+	errReadyTarget    = errors.New("only one of ready-fd and ready-file can be set")
+	errInvalidPort    = errors.New("expected a port in the 1-65535 range")
+	errInvalidServer  = errors.New("expected an ipv4 dhcp server address")
+)
+
+// Exit status of the process, so that the hypervisor can tell them apart
+// from a failure (1) and from unknown flags (2)
+const (
+	// The VM closed its socket
+	exitVMClosed = 3
+	// The VM wasn't acknowledged a lease within ready-timeout
+	exitNoLease = 4
+)
+
 func main() {
 	ctx := newCancelableContext()
 
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
 	if err := run(ctx); err != nil {
+		if errors.Is(err, stack.ErrVMClosed) {
+			log.Info().Err(err).Msg("network stack stopped")
+			os.Exit(exitVMClosed)
+		}
+
+		if errors.Is(err, stack.ErrNoLease) {
+			log.Error().Err(err).Msg("network stack stopped")
+			os.Exit(exitNoLease)
+		}
+
 		log.Error().Err(err).Msg("running network stack")
 		os.Exit(1)
 	}
@@ -34,6 +68,35 @@ func run(ctx context.Context) error {
 	var startAddr string
 	var endAddr string
 	var subnetMask string
+	var backend string
+	var mode string
+	var bridgeInterface string
+	var dhcpServer string
+	var mtu int
+	var disableIsolation bool
+	var networkID string
+	var nat66Prefix string
+	var hostPorts string
+	var dnsUpstreams string
+	var allowedDomains string
+	var dnsBlocklist string
+	var logDNS bool
+	var vmName string
+	var localDomain string
+	var hostDNS string
+	var dnsHosts string
+	var forwards string
+	var peerVMs string
+	var segment uint
+	var queues int
+	var queuePolicy string
+	var queueDepth int
+	var queueTimeout time.Duration
+	var drainTimeout time.Duration
+	var events string
+	var readyFd int
+	var readyFile string
+	var readyTimeout time.Duration
 	var debug bool
 
 	flag.StringVar(&fd, "fd", "", "")
@@ -41,14 +104,45 @@ func run(ctx context.Context) error {
 	flag.StringVar(&startAddr, "start-addr", "192.168.64.1", "")
 	flag.StringVar(&endAddr, "end-addr", "192.168.64.255", "")
 	flag.StringVar(&subnetMask, "subnet-mask", "255.255.255.0", "")
+	flag.StringVar(&backend, "backend", string(stack.BackendVMNet), "")
+	flag.StringVar(&mode, "mode", string(stack.ModeShared), "")
+	flag.StringVar(&bridgeInterface, "bridge-interface", "", "")
+	flag.StringVar(&dhcpServer, "dhcp-server", "", "")
+	flag.IntVar(&mtu, "mtu", 0, "")
+	flag.BoolVar(&disableIsolation, "disable-isolation", false, "")
+	flag.StringVar(&networkID, "network-id", "", "")
+	flag.StringVar(&nat66Prefix, "nat66-prefix", "", "")
+	flag.StringVar(&hostPorts, "host-port", "", "")
+	flag.StringVar(&dnsUpstreams, "dns-upstream", "", "")
+	flag.StringVar(&allowedDomains, "allow-domain", "", "")
+	flag.StringVar(&dnsBlocklist, "dns-blocklist", "", "")
+	flag.BoolVar(&logDNS, "log-dns", false, "")
+	flag.StringVar(&vmName, "vm-name", "", "")
+	flag.StringVar(&localDomain, "local-domain", stack.DefaultLocalDomain, "")
+	flag.StringVar(&hostDNS, "host-dns", "", "")
+	flag.StringVar(&dnsHosts, "dns-host", "", "")
+	flag.StringVar(&forwards, "forward", "", "")
+	flag.StringVar(&peerVMs, "peer-vm", "", "")
+	flag.UintVar(&segment, "segment", 0, "")
+	flag.IntVar(&queues, "queues", 1, "")
+	flag.StringVar(&queuePolicy, "queue-policy", string(backpressure.DropTail), "")
+	flag.IntVar(&queueDepth, "queue-depth", backpressure.DefaultDepth, "")
+	flag.DurationVar(&queueTimeout, "queue-timeout", backpressure.DefaultTimeout, "")
+	flag.DurationVar(&drainTimeout, "drain-timeout", stack.DefaultDrainTimeout, "")
+	flag.StringVar(&events, "events", "", "")
+	flag.IntVar(&readyFd, "ready-fd", -1, "")
+	flag.StringVar(&readyFile, "ready-file", "", "")
+	flag.DurationVar(&readyTimeout, "ready-timeout", 0, "")
 	flag.BoolVar(&debug, "debug", false, "")
 
-	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	flag.Parse()
+
+	// The DNS log of --log-dns has a level of its own
+	level := zerolog.ErrorLevel
 	if debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+		level = zerolog.DebugLevel
 	}
-
-	flag.Parse()
+	log.Logger = log.Logger.Level(level)
 
 	fdInt, err := strconv.Atoi(fd)
 	if err != nil {
@@ -62,15 +156,93 @@ func run(ctx context.Context) error {
 		return fmt.Errorf("parsing provided MAC address: %w", err)
 	}
 
+	hosts, err := parseHosts(splitList(dnsHosts))
+	if err != nil {
+		return fmt.Errorf("parsing host overrides: %w", err)
+	}
+
+	portForwards := make([]stack.PortForward, 0)
+	for _, spec := range splitList(forwards) {
+		forward, err := stack.ParsePortForward(spec)
+		if err != nil {
+			return fmt.Errorf("parsing port forward: %w", err)
+		}
+		portForwards = append(portForwards, forward)
+	}
+
+	if segment > math.MaxUint16 {
+		return fmt.Errorf("%w: %d", errInvalidSegment, segment)
+	}
+
+	var server netaddr.IP
+	if dhcpServer != "" {
+		if server, err = netaddr.ParseIP(dhcpServer); err != nil || !server.Is4() {
+			return fmt.Errorf("%w: %s", errInvalidServer, dhcpServer)
+		}
+	}
+
+	ports, err := parsePorts(splitList(hostPorts))
+	if err != nil {
+		return fmt.Errorf("parsing host ports: %w", err)
+	}
+
+	peers, err := parsePeerVMs(splitList(peerVMs))
+	if err != nil {
+		return fmt.Errorf("parsing peer VMs: %w", err)
+	}
+
+	observer, closeEvents, err := openEvents(events)
+	if err != nil {
+		return fmt.Errorf("opening event stream: %w", err)
+	}
+	defer closeEvents()
+
+	ready, err := openReady(readyFd, readyFile)
+	if err != nil {
+		return fmt.Errorf("opening readiness report: %w", err)
+	}
+
 	st, err := stack.NewNetwork(stack.NetworkParams{
-		Fd:           fdInt,
-		HardwareAddr: hardwareAddr,
-		StartAddr:    netaddr.MustParseIP(startAddr),
-		EndAddr:      netaddr.MustParseIP(endAddr),
-		SubnetMask:   netaddr.MustParseIP(subnetMask),
-		Debug:        debug,
+		Fd:               fdInt,
+		HardwareAddr:     hardwareAddr,
+		StartAddr:        netaddr.MustParseIP(startAddr),
+		EndAddr:          netaddr.MustParseIP(endAddr),
+		SubnetMask:       netaddr.MustParseIP(subnetMask),
+		Backend:          stack.BackendKind(backend),
+		Mode:             stack.NetworkMode(mode),
+		BridgeInterface:  bridgeInterface,
+		DHCPServer:       server,
+		MTU:              mtu,
+		DisableIsolation: disableIsolation,
+		NetworkID:        networkID,
+		NAT66Prefix:      nat66Prefix,
+		HostPorts:        ports,
+		DNSUpstreams:     splitList(dnsUpstreams),
+		AllowedDomains:   splitList(allowedDomains),
+		DNSBlocklist:     dnsBlocklist,
+		LogDNS:           logDNS,
+		VMName:           vmName,
+		LocalDomain:      localDomain,
+		HostDNSAddr:      hostDNS,
+		DNSHosts:         hosts,
+		PortForwards:     portForwards,
+		Segment:          uint16(segment),
+		PeerVMs:          peers,
+		Queues:           queues,
+		QueuePolicy:      backpressure.Policy(queuePolicy),
+		QueueDepth:       queueDepth,
+		QueueTimeout:     queueTimeout,
+		DrainTimeout:     drainTimeout,
+		Observer:         observer,
+		Ready:            ready,
+		ReadyTimeout:     readyTimeout,
+		Debug:            debug,
 	})
 	if err != nil {
+		// Run closes it, once it was created
+		if ready != nil {
+			ready.Close()
+		}
 		return fmt.Errorf("creating proxy: %w", err)
 	}
 
@@ -81,6 +253,159 @@ func run(ctx context.Context) error {
 	return nil
 }
 
+// open the JSON lines event stream, "-" is stdout. No events are written if path is empty.
+func openEvents(path string) (stack.Observer, func(), error) {
+	switch path {
+	case "":
+		return nil, func() {}, nil
+	case "-":
+		observer := stack.NewJSONObserver(os.Stdout)
+		return observer, func() { closeObserver(observer) }, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	observer := stack.NewJSONObserver(f)
+	return observer, func() {
+		closeObserver(observer)
+		f.Close()
+	}, nil
+}
+
+// Write the events left, once the stack stopped
+func closeObserver(observer *stack.JSONObserver) {
+	if err := observer.Close(); err != nil {
+		log.Error().Err(err).Msg("writing events")
+	}
+}
+
+// open the destination of the readiness report, either fd or path.
+// Returns nil if neither is set.
+func openReady(fd int, path string) (io.WriteCloser, error) {
+	switch {
+	case fd >= 0 && path != "":
+		return nil, errReadyTarget
+	case fd >= 0:
+		return os.NewFile(uintptr(fd), "ready"), nil
+	case path != "":
+		return newReadyFile(path)
+	default:
+		return nil, nil
+	}
+}
+
+// readyFile is written to a temporary file, which is renamed to path on Close,
+// so that the report shows up complete, or not at all
+type readyFile struct {
+	*os.File
+	path    string
+	written bool
+}
+
+func (f *readyFile) Write(p []byte) (int, error) {
+	f.written = true
+	return f.File.Write(p)
+}
+
+func newReadyFile(path string) (*readyFile, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &readyFile{File: f, path: path}, nil
+}
+
+func (f *readyFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+
+	// No lease, no report
+	if !f.written {
+		return os.Remove(f.Name())
+	}
+	return os.Rename(f.Name(), f.path)
+}
+
+// split comma separated flag values, ignoring empty items.
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parse name=ip host overrides, a name may be listed multiple times.
+func parseHosts(items []string) (map[string][]netaddr.IP, error) {
+	hosts := make(map[string][]netaddr.IP)
+	for _, item := range items {
+		name, addr, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errInvalidHost, item)
+		}
+
+		ip, err := netaddr.ParseIP(addr)
+		if err != nil || !ip.Is4() {
+			return nil, fmt.Errorf("%w: %s", errInvalidHost, item)
+		}
+		hosts[name] = append(hosts[name], ip)
+	}
+	return hosts, nil
+}
+
+// parse the ports of the host.
+func parsePorts(items []string) ([]uint16, error) {
+	ports := make([]uint16, 0, len(items))
+	for _, item := range items {
+		port, err := strconv.ParseUint(item, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("%w: %s", errInvalidPort, item)
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
+}
+
+// parse fd/mac[/name[/segment]] peer VMs.
+func parsePeerVMs(items []string) ([]stack.VM, error) {
+	vms := make([]stack.VM, 0)
+	for _, item := range items {
+		parts := strings.Split(item, "/")
+		if len(parts) < 2 || len(parts) > 4 {
+			return nil, fmt.Errorf("%w: %s", errInvalidPeerVM, item)
+		}
+
+		fd, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errInvalidPeerVM, item)
+		}
+
+		hardwareAddr, err := net.ParseMAC(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errInvalidPeerVM, item)
+		}
+
+		vm := stack.VM{Fd: fd, HardwareAddr: hardwareAddr}
+		if len(parts) > 2 {
+			vm.Name = parts[2]
+		}
+		if len(parts) > 3 {
+			segment, err := strconv.ParseUint(parts[3], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", errInvalidPeerVM, item)
+			}
+			vm.Segment = uint16(segment)
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
 // exit on signal.
 func newCancelableContext() context.Context {
 	doneCh := make(chan os.Signal, 1)
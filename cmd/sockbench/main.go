@@ -0,0 +1,301 @@
+// sockbench measures the throughput of the VM socket path over a unix datagram
+// socketpair, like the one Virtualization.Framework hands to sock-vmnet.
+// It compares reading and writing the frames one by one through net.Conn
+// against the batched reads and writes of the dgram package, decoding
+// the frames with gopacket.NewPacket against the reusable frame.Parser,
+// and the stack's datapath with a single queue against multiple queues.
+//
+//	go run ./cmd/sockbench -frames 1000000 -size 1514
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/dgram"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+)
+
+var errNotClassified = errors.New("frame not classified as udp")
+
+type result struct {
+	name    string
+	elapsed time.Duration
+	allocs  uint64
+}
+
+func main() {
+	var frames int
+	var size int
+	var rounds int
+	var queues int
+
+	flag.IntVar(&frames, "frames", 500000, "number of frames sent per round")
+	flag.IntVar(&size, "size", 1514, "size of the frames in bytes")
+	flag.IntVar(&rounds, "rounds", 3, "number of rounds per mode, the best one is reported")
+	flag.IntVar(&queues, "queues", runtime.NumCPU(), "number of queues of the multi-queue stack")
+	flag.Parse()
+
+	// The stack's logs would be mixed up with the results, e.g. the sockets
+	// being closed when a stack is stopped between the rounds
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	modes := []struct {
+		name string
+		run  func(frames, size int) error
+	}{
+		{name: "net.Conn", run: overSocketpair(runConn)},
+		{name: "dgram", run: overSocketpair(runBatch)},
+		{name: "NewPacket", run: decodePacket},
+		{name: "Parser", run: decodeParser},
+		{name: "stack/1", run: throughStack(1)},
+		{name: fmt.Sprintf("stack/%d", queues), run: throughStack(queues)},
+	}
+
+	for _, mode := range modes {
+		var best result
+		for i := 0; i < rounds; i++ {
+			res, err := measure(mode.name, mode.run, frames, size)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", mode.name, err)
+				os.Exit(1)
+			}
+
+			if best.elapsed == 0 || res.elapsed < best.elapsed {
+				best = res
+			}
+		}
+		report(best, frames, size)
+	}
+}
+
+func measure(name string, run func(frames, size int) error, frames, size int) (result, error) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	if err := run(frames, size); err != nil {
+		return result{}, err
+	}
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	return result{
+		name:    name,
+		elapsed: elapsed,
+		allocs:  after.Mallocs - before.Mallocs,
+	}, nil
+}
+
+func report(res result, frames, size int) {
+	seconds := res.elapsed.Seconds()
+	fmt.Printf("%-10s %10.0f frames/s %10.1f MB/s %8.3f allocs/frame %v\n",
+		res.name,
+		float64(frames)/seconds,
+		float64(frames*size)/seconds/1e6,
+		float64(res.allocs)/float64(frames),
+		res.elapsed.Round(time.Millisecond),
+	)
+}
+
+// Run the benchmark over a new socketpair
+func overSocketpair(run func(a, b net.Conn, frames, size int) error) func(frames, size int) error {
+	return func(frames, size int) error {
+		a, b, err := socketpair()
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+		defer b.Close()
+
+		return run(a, b, frames, size)
+	}
+}
+
+// Send the frames from a to b one by one
+func runConn(a, b net.Conn, frames, size int) error {
+	errs := make(chan error, 1)
+	go func() {
+		msg := make([]byte, size)
+		for i := 0; i < frames; i++ {
+			if _, err := a.Write(msg); err != nil {
+				errs <- fmt.Errorf("writing frame: %w", err)
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	buf := make([]byte, size)
+	for i := 0; i < frames; i++ {
+		if _, err := b.Read(buf); err != nil {
+			return fmt.Errorf("reading frame: %w", err)
+		}
+	}
+
+	return <-errs
+}
+
+// Send the frames from a to b in batches
+func runBatch(a, b net.Conn, frames, size int) error {
+	writer, err := dgram.New(a)
+	if err != nil {
+		return err
+	}
+
+	reader, err := dgram.New(b)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		batch := make([][]byte, dgram.MaxBatchSize)
+		for i := range batch {
+			batch[i] = make([]byte, size)
+		}
+
+		for sent := 0; sent < frames; {
+			n := min(frames-sent, len(batch))
+			if _, err := writer.WriteBatch(batch[:n]); err != nil {
+				errs <- fmt.Errorf("writing batch: %w", err)
+				return
+			}
+			sent += n
+		}
+		errs <- nil
+	}()
+
+	bufs := make([][]byte, dgram.MaxBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, size)
+	}
+	sizes := make([]int, dgram.MaxBatchSize)
+
+	for received := 0; received < frames; {
+		n, err := reader.ReadBatch(bufs, sizes)
+		if err != nil {
+			return fmt.Errorf("reading batch: %w", err)
+		}
+		received += n
+	}
+
+	return <-errs
+}
+
+func socketpair() (net.Conn, net.Conn, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating socketpair: %w", err)
+	}
+
+	a, err := fileConn(fds[0])
+	if err != nil {
+		unix.Close(fds[1])
+		return nil, nil, err
+	}
+
+	b, err := fileConn(fds[1])
+	if err != nil {
+		a.Close()
+		return nil, nil, err
+	}
+
+	return a, b, nil
+}
+
+func fileConn(fd int) (net.Conn, error) {
+	file := os.NewFile(uintptr(fd), "socket")
+	defer file.Close()
+
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening socket: %w", err)
+	}
+	return conn, nil
+}
+
+// Classify the frames the way the stack did before frame.Parser
+func decodePacket(frames, size int) error {
+	raw, err := udpFrame(senderMAC, receiverMAC, net.IPv4(192, 168, 64, 2), net.IPv4(1, 1, 1, 1), 50000, size)
+	if err != nil {
+		return err
+	}
+
+	opts := gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	for i := 0; i < frames; i++ {
+		packet := gopacket.NewPacket(raw, layers.LayerTypeEthernet, opts)
+		if _, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); !ok {
+			return errNotClassified
+		}
+		if _, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ok {
+			return errNotClassified
+		}
+		if _, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok {
+			return errNotClassified
+		}
+	}
+
+	return nil
+}
+
+// Classify the frames with a reusable frame.Parser, like the stack's workers
+func decodeParser(frames, size int) error {
+	raw, err := udpFrame(senderMAC, receiverMAC, net.IPv4(192, 168, 64, 2), net.IPv4(1, 1, 1, 1), 50000, size)
+	if err != nil {
+		return err
+	}
+
+	packet := frame.NewParser()
+	for i := 0; i < frames; i++ {
+		if !packet.Decode(raw) || !packet.HasUDP() {
+			return errNotClassified
+		}
+	}
+
+	return nil
+}
+
+// Builds an ethernet frame of the given size, carrying an UDP datagram
+func udpFrame(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, srcPort layers.UDPPort, size int) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC,
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    srcIP.To4(),
+		DstIP:    dstIP.To4(),
+	}
+	udp := &layers.UDP{
+		SrcPort: srcPort,
+		DstPort: 5201,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, fmt.Errorf("setting checksum layer: %w", err)
+	}
+
+	// Ethernet, ipv4 and udp headers
+	payload := make([]byte, max(size-42, 0))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		return nil, fmt.Errorf("serializing frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
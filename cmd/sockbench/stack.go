@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/dgram"
+	"github.com/nagypeterjob/sock-vmnet/internal/stack"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// Number of UDP flows sent between the VMs, hashed to the workers of the multi-queue datapath
+const flows = 64
+
+var errNoLease = errors.New("no dhcp lease")
+
+var (
+	senderMAC   = net.HardwareAddr{0x5e, 0x8b, 0x78, 0x73, 0x78, 0x14}
+	receiverMAC = net.HardwareAddr{0x5e, 0x8b, 0x78, 0x73, 0x78, 0x15}
+)
+
+// Run the benchmark through a stack with the given number of queues.
+//
+// Two VMs are attached to the stack, their leases are served by the in-process
+// userspace backend. The frames sent by one VM to the other go through
+// the whole datapath of the stack (decoding, anti-spoofing, switching),
+// without leaving the process.
+func throughStack(queues int) func(frames, size int) error {
+	return func(frames, size int) error {
+		sender, senderFd, err := vmSocket()
+		if err != nil {
+			return err
+		}
+		defer sender.Close()
+
+		receiver, receiverFd, err := vmSocket()
+		if err != nil {
+			return err
+		}
+		defer receiver.Close()
+
+		st, err := stack.NewNetwork(stack.NetworkParams{
+			Fd:           senderFd,
+			HardwareAddr: senderMAC,
+			Backend:      stack.BackendUserspace,
+			StartAddr:    netaddr.MustParseIP("192.168.64.1"),
+			EndAddr:      netaddr.MustParseIP("192.168.64.255"),
+			SubnetMask:   netaddr.MustParseIP("255.255.255.0"),
+			PeerVMs:      []stack.VM{{Fd: receiverFd, HardwareAddr: receiverMAC}},
+			Queues:       queues,
+		})
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// The sockets handed over to the stack are closed by Run
+		go st.Run(ctx)
+
+		senderIP, err := lease(sender, senderMAC)
+		if err != nil {
+			return err
+		}
+
+		receiverIP, err := lease(receiver, receiverMAC)
+		if err != nil {
+			return err
+		}
+
+		return sendFrames(sender, receiver, senderIP, receiverIP, frames, size)
+	}
+}
+
+// Send the frames of the UDP flows from sender to receiver through the stack
+func sendFrames(sender, receiver net.Conn, senderIP, receiverIP net.IP, frames, size int) error {
+	writer, err := dgram.New(sender)
+	if err != nil {
+		return err
+	}
+
+	reader, err := dgram.New(receiver)
+	if err != nil {
+		return err
+	}
+
+	batch := make([][]byte, dgram.MaxBatchSize)
+	for i := range batch {
+		flow := layers.UDPPort(50000 + i%flows)
+		if batch[i], err = udpFrame(senderMAC, receiverMAC, senderIP, receiverIP, flow, size); err != nil {
+			return err
+		}
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		for sent := 0; sent < frames; {
+			n := min(frames-sent, len(batch))
+			if _, err := writer.WriteBatch(batch[:n]); err != nil {
+				errs <- fmt.Errorf("writing batch: %w", err)
+				return
+			}
+			sent += n
+		}
+		errs <- nil
+	}()
+
+	bufs := make([][]byte, dgram.MaxBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, size)
+	}
+	sizes := make([]int, dgram.MaxBatchSize)
+
+	for received := 0; received < frames; {
+		n, err := reader.ReadBatch(bufs, sizes)
+		if err != nil {
+			return fmt.Errorf("reading batch: %w", err)
+		}
+		received += n
+	}
+
+	return <-errs
+}
+
+// Request a lease from the stack's dhcp server, and return the acknowledged address
+func lease(conn net.Conn, mac net.HardwareAddr) (net.IP, error) {
+	offer, err := exchangeDHCP(conn, mac, layers.DHCPMsgTypeDiscover, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ack, err := exchangeDHCP(conn, mac, layers.DHCPMsgTypeRequest, offer.YourClientIP)
+	if err != nil {
+		return nil, err
+	}
+
+	return ack.YourClientIP.To4(), nil
+}
+
+// Send a dhcp request, and wait for the reply
+func exchangeDHCP(conn net.Conn, mac net.HardwareAddr, msgType layers.DHCPMsgType, addr net.IP) (*layers.DHCPv4, error) {
+	request, err := dhcpRequest(mac, msgType, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("sending dhcp request: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errNoLease, err)
+		}
+
+		packet := gopacket.NewPacket(buf[:n], layers.LayerTypeEthernet, gopacket.Default)
+		if reply, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4); ok &&
+			reply.Operation == layers.DHCPOpReply && string(reply.ClientHWAddr) == string(mac) {
+			return reply, nil
+		}
+	}
+}
+
+func dhcpRequest(mac net.HardwareAddr, msgType layers.DHCPMsgType, addr net.IP) ([]byte, error) {
+	options := layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}),
+	}
+	if addr != nil {
+		options = append(options, layers.NewDHCPOption(layers.DHCPOptRequestIP, addr.To4()))
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4zero.To4(),
+		DstIP:    net.IPv4bcast.To4(),
+	}
+	udp := &layers.UDP{
+		SrcPort: 68,
+		DstPort: 67,
+	}
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          1,
+		ClientHWAddr: mac,
+		Options:      options,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, fmt.Errorf("setting checksum layer: %w", err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, dhcp); err != nil {
+		return nil, fmt.Errorf("serializing dhcp request: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the VM's end of a new socketpair, and the file descriptor of the stack's end
+func vmSocket() (net.Conn, int, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating socketpair: %w", err)
+	}
+
+	conn, err := fileConn(fds[0])
+	if err != nil {
+		unix.Close(fds[1])
+		return nil, 0, err
+	}
+
+	return conn, fds[1], nil
+}
@@ -1,17 +1,20 @@
 module github.com/nagypeterjob/sock-vmnet
 
-go 1.20
+go 1.22.0
 
 require (
 	github.com/google/gopacket v1.1.19
 	github.com/rs/zerolog v1.29.1
-	golang.org/x/sys v0.10.0
+	golang.org/x/sys v0.17.0
+	gvisor.dev/gvisor v0.0.0-20240916094835-a174eb65023f
 	inet.af/netaddr v0.0.0-20230525184311-b8eac61e914a
 )
 
 require (
+	github.com/google/btree v1.1.2 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	go4.org/intern v0.0.0-20211027215823-ae77deb06f29 // indirect
 	go4.org/unsafe/assume-no-moving-gc v0.0.0-20230525183740-e7c30c78aeb2 // indirect
+	golang.org/x/time v0.5.0 // indirect
 )
@@ -0,0 +1,300 @@
+// nolint:godot
+package backpressure
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errUnknownPolicy = errors.New("unknown queue policy")
+	errInvalidDepth  = errors.New("queue depth must be positive")
+)
+
+// Policy decides what happens to the frames pushed to a full queue
+type Policy string
+
+const (
+	// Drop the frame being pushed
+	DropTail Policy = "drop-tail"
+	// Drop the oldest frame of the queue, to make room for the one being pushed
+	DropHead Policy = "drop-head"
+	// Wait for room until Timeout, then drop the frame being pushed
+	Block Policy = "block"
+	// Drop the frame being pushed, unless it's ARP, dhcp or a TCP ACK without payload.
+	// These frames drop the oldest frame of the queue instead.
+	Priority Policy = "priority"
+)
+
+const (
+	// Depth of the queue, if not configured otherwise
+	DefaultDepth = 100
+	// How long Block waits for room, if not configured otherwise
+	DefaultTimeout = 10 * time.Millisecond
+)
+
+type Params struct {
+	// Default Policy is DropTail
+	Policy Policy
+	// Default Depth is DefaultDepth
+	Depth int
+	// Only used by Block. Default Timeout is DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Validate the params, and fill in the defaults
+func (p Params) withDefaults() (Params, error) {
+	switch p.Policy {
+	case "":
+		p.Policy = DropTail
+	case DropTail, DropHead, Block, Priority:
+	default:
+		return Params{}, fmt.Errorf("%w: %s", errUnknownPolicy, p.Policy)
+	}
+
+	if p.Depth == 0 {
+		p.Depth = DefaultDepth
+	}
+	if p.Depth < 0 {
+		return Params{}, fmt.Errorf("%w: %d", errInvalidDepth, p.Depth)
+	}
+
+	if p.Timeout <= 0 {
+		p.Timeout = DefaultTimeout
+	}
+
+	return p, nil
+}
+
+// Stats counts the outcomes of the frames pushed to a queue
+type Stats struct {
+	// Frames queued without waiting
+	Queued uint64
+	// Frames queued after waiting for room (Block)
+	Waited uint64
+	// Frames dropped, because the queue was full
+	DroppedTail uint64
+	// Queued frames dropped, to make room for a newer one (DropHead, Priority)
+	DroppedHead uint64
+	// Frames dropped after waiting for room for Timeout (Block)
+	TimedOut uint64
+	// ARP, dhcp and TCP ACK frames which dropped an older frame to make room (Priority)
+	Prioritized uint64
+}
+
+// Dropped returns the number of frames dropped for any reason
+func (s Stats) Dropped() uint64 {
+	return s.DroppedTail + s.DroppedHead + s.TimedOut
+}
+
+// Queue buffers the frames read from a backend, until they are sent to the VM.
+// It's safe for concurrent use.
+type Queue struct {
+	Params
+
+	frames chan []byte
+
+	queued      atomic.Uint64
+	waited      atomic.Uint64
+	droppedTail atomic.Uint64
+	droppedHead atomic.Uint64
+	timedOut    atomic.Uint64
+	prioritized atomic.Uint64
+
+	// Guards frames against sending on it after it has been closed
+	closed bool
+	m      sync.RWMutex
+}
+
+func New(p Params) (*Queue, error) {
+	p, err := p.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Queue{
+		Params: p,
+		frames: make(chan []byte, p.Depth),
+	}, nil
+}
+
+// Frames returns the queued frames. The channel is closed by Close.
+func (q *Queue) Frames() <-chan []byte {
+	return q.frames
+}
+
+// Push queues the frame according to the policy. Returns the frame dropped
+// to make room (or the pushed frame itself), nil if nothing was dropped,
+// so that the caller can reuse its buffer.
+func (q *Queue) Push(frame []byte) []byte {
+	q.m.RLock()
+	defer q.m.RUnlock()
+	if q.closed {
+		return frame
+	}
+
+	select {
+	case q.frames <- frame:
+		q.queued.Add(1)
+		return nil
+	default:
+	}
+
+	switch q.Policy {
+	case DropHead:
+		return q.replaceHead(frame)
+	case Priority:
+		if important(frame) {
+			q.prioritized.Add(1)
+			return q.replaceHead(frame)
+		}
+	case Block:
+		return q.wait(frame)
+	}
+
+	q.droppedTail.Add(1)
+	return frame
+}
+
+// Drop the oldest frame, and queue the frame in its place
+func (q *Queue) replaceHead(frame []byte) []byte {
+	var dropped []byte
+	select {
+	case dropped = <-q.frames:
+		q.droppedHead.Add(1)
+	default:
+	}
+
+	// The room made might be taken by a concurrent push
+	select {
+	case q.frames <- frame:
+		q.queued.Add(1)
+		return dropped
+	default:
+		q.droppedTail.Add(1)
+		if dropped != nil {
+			// Only one buffer can be handed back, the other one is left to the garbage collector
+			return dropped
+		}
+		return frame
+	}
+}
+
+// Wait for room until the timeout
+func (q *Queue) wait(frame []byte) []byte {
+	timer := time.NewTimer(q.Timeout)
+	defer timer.Stop()
+
+	select {
+	case q.frames <- frame:
+		q.waited.Add(1)
+		return nil
+	case <-timer.C:
+		q.timedOut.Add(1)
+		return frame
+	}
+}
+
+// Close closes the channel of Frames, the frames pushed afterwards are dropped
+func (q *Queue) Close() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.frames)
+}
+
+// Stats returns the counters of the queue
+func (q *Queue) Stats() Stats {
+	return Stats{
+		Queued:      q.queued.Load(),
+		Waited:      q.waited.Load(),
+		DroppedTail: q.droppedTail.Load(),
+		DroppedHead: q.droppedHead.Load(),
+		TimedOut:    q.timedOut.Load(),
+		Prioritized: q.prioritized.Load(),
+	}
+}
+
+const (
+	ethHeaderLen  = 14
+	ipv4HeaderLen = 20
+	tcpHeaderLen  = 20
+
+	arpEtherType  = 0x0806
+	ipv4EtherType = 0x0800
+
+	ipProtocolTCP = 6
+	ipProtocolUDP = 17
+
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	ipv4FlagMF     = 0x2000
+	ipv4FragOffset = 0x1fff
+
+	tcpFlagACK = 0x10
+	tcpFlagSYN = 0x02
+	tcpFlagFIN = 0x01
+	tcpFlagRST = 0x04
+)
+
+// Determine if the frame is ARP, dhcp, or a TCP ACK without payload.
+// Losing these stalls the VM's network (address resolution, leases) or its TCP flows.
+func important(frame []byte) bool {
+	if len(frame) < ethHeaderLen {
+		return false
+	}
+
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case arpEtherType:
+		return true
+	case ipv4EtherType:
+	default:
+		return false
+	}
+
+	ip := frame[ethHeaderLen:]
+	if len(ip) < ipv4HeaderLen {
+		return false
+	}
+
+	headerLen := int(ip[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(ip[2:4]))
+	if headerLen < ipv4HeaderLen || len(ip) < headerLen+8 {
+		return false
+	}
+	// Only the first fragment carries the transport header,
+	// and an ACK without payload is never fragmented
+	fragment := binary.BigEndian.Uint16(ip[6:8])
+	if fragment&ipv4FragOffset != 0 || (fragment&ipv4FlagMF != 0 && ip[9] == ipProtocolTCP) {
+		return false
+	}
+	transport := ip[headerLen:]
+
+	switch ip[9] {
+	case ipProtocolUDP:
+		srcPort := binary.BigEndian.Uint16(transport[0:2])
+		dstPort := binary.BigEndian.Uint16(transport[2:4])
+		return srcPort == dhcpServerPort || srcPort == dhcpClientPort ||
+			dstPort == dhcpServerPort || dstPort == dhcpClientPort
+	case ipProtocolTCP:
+		if len(transport) < tcpHeaderLen {
+			return false
+		}
+		offset := int(transport[12]>>4) * 4
+		if offset < tcpHeaderLen || totalLen < headerLen+offset {
+			return false
+		}
+		flags := transport[13]
+		return flags&tcpFlagACK != 0 && flags&(tcpFlagSYN|tcpFlagFIN|tcpFlagRST) == 0 && totalLen == headerLen+offset
+	default:
+		return false
+	}
+}
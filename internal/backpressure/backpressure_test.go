@@ -0,0 +1,279 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package backpressure
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serialize(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func ethernet(etherType layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: etherType,
+	}
+}
+
+func ipv4(protocol layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+}
+
+func tcpFrame(t *testing.T, ip *layers.IPv4, tcp *layers.TCP, payload int) []byte {
+	t.Helper()
+
+	tcp.SrcPort, tcp.DstPort = 40000, 443
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	return serialize(t, ethernet(layers.EthernetTypeIPv4), ip, tcp, gopacket.Payload(make([]byte, payload)))
+}
+
+func udpFrame(t *testing.T, ip *layers.IPv4, srcPort, dstPort layers.UDPPort) []byte {
+	t.Helper()
+
+	udp := &layers.UDP{SrcPort: srcPort, DstPort: dstPort}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	return serialize(t, ethernet(layers.EthernetTypeIPv4), ip, udp, gopacket.Payload(make([]byte, 300)))
+}
+
+// A fragment carrying the bytes of a UDP header of the given ports
+func fragmentFrame(t *testing.T, protocol layers.IPProtocol, flags layers.IPv4Flag, offset uint16, srcPort, dstPort byte) []byte {
+	t.Helper()
+
+	ip := ipv4(protocol)
+	ip.Flags, ip.FragOffset = flags, offset
+	data := []byte{0, srcPort, 0, dstPort, 0, 16, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	return serialize(t, ethernet(layers.EthernetTypeIPv4), ip, gopacket.Payload(data))
+}
+
+func arpFrame(t *testing.T) []byte {
+	t.Helper()
+
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		SourceProtAddress: net.IPv4(10, 0, 0, 1).To4(),
+		DstHwAddress:      net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		DstProtAddress:    net.IPv4(10, 0, 0, 2).To4(),
+	}
+	return serialize(t, ethernet(layers.EthernetTypeARP), arp)
+}
+
+func TestImportant(t *testing.T) {
+	ack := tcpFrame(t, ipv4(layers.IPProtocolTCP), &layers.TCP{ACK: true}, 0)
+	ipOptions := ipv4(layers.IPProtocolTCP)
+	ipOptions.Options = []layers.IPv4Option{{OptionType: 0x94, OptionLength: 4, OptionData: []byte{0, 0}}}
+	tcpOptions := &layers.TCP{ACK: true, Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: make([]byte, 8)},
+	}}
+	ipv6 := serialize(t, ethernet(layers.EthernetTypeIPv6),
+		&layers.IPv6{Version: 6, NextHeader: layers.IPProtocolNoNextHeader, HopLimit: 64, SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")})
+	badOffset := append([]byte(nil), ack...)
+	badOffset[ethHeaderLen+ipv4HeaderLen+12] = 4 << 4
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  bool
+	}{
+		{name: "arp", frame: arpFrame(t), want: true},
+		{name: "dhcp request", frame: udpFrame(t, ipv4(layers.IPProtocolUDP), 68, 67), want: true},
+		{name: "dhcp reply", frame: udpFrame(t, ipv4(layers.IPProtocolUDP), 67, 68), want: true},
+		{name: "udp", frame: udpFrame(t, ipv4(layers.IPProtocolUDP), 40000, 53)},
+		{name: "tcp ack", frame: ack, want: true},
+		{name: "tcp ack padded to the minimum frame size", frame: append(append([]byte(nil), ack...), make([]byte, 6)...), want: true},
+		{name: "tcp ack with payload", frame: tcpFrame(t, ipv4(layers.IPProtocolTCP), &layers.TCP{ACK: true}, 1)},
+		{name: "tcp ack with tcp options", frame: tcpFrame(t, ipv4(layers.IPProtocolTCP), tcpOptions, 0), want: true},
+		{name: "tcp ack with ip options", frame: tcpFrame(t, ipOptions, &layers.TCP{ACK: true}, 0), want: true},
+		{name: "tcp syn ack", frame: tcpFrame(t, ipv4(layers.IPProtocolTCP), &layers.TCP{ACK: true, SYN: true}, 0)},
+		{name: "tcp fin", frame: tcpFrame(t, ipv4(layers.IPProtocolTCP), &layers.TCP{ACK: true, FIN: true}, 0)},
+		{name: "tcp rst", frame: tcpFrame(t, ipv4(layers.IPProtocolTCP), &layers.TCP{ACK: true, RST: true}, 0)},
+		{name: "tcp without ack", frame: tcpFrame(t, ipv4(layers.IPProtocolTCP), &layers.TCP{}, 0)},
+		{name: "tcp data offset too small", frame: badOffset},
+		{name: "tcp header truncated", frame: ack[:ethHeaderLen+ipv4HeaderLen+12]},
+		{name: "ip header truncated", frame: ack[:ethHeaderLen+10]},
+		{name: "ethernet header truncated", frame: ack[:10]},
+		{name: "first fragment of dhcp", frame: fragmentFrame(t, layers.IPProtocolUDP, layers.IPv4MoreFragments, 0, 68, 67), want: true},
+		{name: "non-first fragment looking like dhcp", frame: fragmentFrame(t, layers.IPProtocolUDP, 0, 185, 68, 67)},
+		{name: "first fragment of tcp", frame: fragmentFrame(t, layers.IPProtocolTCP, layers.IPv4MoreFragments, 0, 1, 2)},
+		{name: "ipv6", frame: ipv6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := important(tt.frame); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	a, b, c := []byte{1}, []byte{2}, []byte{3}
+	arp := arpFrame(t)
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		push    [][]byte
+		dropped [][]byte
+		queued  [][]byte
+		stats   Stats
+	}{
+		{
+			name:    "drop-tail",
+			policy:  DropTail,
+			push:    [][]byte{a, b, c},
+			dropped: [][]byte{nil, nil, c},
+			queued:  [][]byte{a, b},
+			stats:   Stats{Queued: 2, DroppedTail: 1},
+		},
+		{
+			name:    "drop-head",
+			policy:  DropHead,
+			push:    [][]byte{a, b, c},
+			dropped: [][]byte{nil, nil, a},
+			queued:  [][]byte{b, c},
+			stats:   Stats{Queued: 3, DroppedHead: 1},
+		},
+		{
+			name:    "block times out",
+			policy:  Block,
+			push:    [][]byte{a, b, c},
+			dropped: [][]byte{nil, nil, c},
+			queued:  [][]byte{a, b},
+			stats:   Stats{Queued: 2, TimedOut: 1},
+		},
+		{
+			name:    "priority drops the tail",
+			policy:  Priority,
+			push:    [][]byte{a, b, c},
+			dropped: [][]byte{nil, nil, c},
+			queued:  [][]byte{a, b},
+			stats:   Stats{Queued: 2, DroppedTail: 1},
+		},
+		{
+			name:    "priority drops the head for arp",
+			policy:  Priority,
+			push:    [][]byte{a, b, arp},
+			dropped: [][]byte{nil, nil, a},
+			queued:  [][]byte{b, arp},
+			stats:   Stats{Queued: 3, DroppedHead: 1, Prioritized: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := New(Params{Policy: tt.policy, Depth: 2, Timeout: time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, frame := range tt.push {
+				if got := q.Push(frame); !reflect.DeepEqual(got, tt.dropped[i]) {
+					t.Errorf("push %d: got %v dropped, want %v", i, got, tt.dropped[i])
+				}
+			}
+
+			q.Close()
+			var queued [][]byte
+			for frame := range q.Frames() {
+				queued = append(queued, frame)
+			}
+			if !reflect.DeepEqual(queued, tt.queued) {
+				t.Errorf("got %v queued, want %v", queued, tt.queued)
+			}
+
+			if got := q.Stats(); got != tt.stats {
+				t.Errorf("got %+v, want %+v", got, tt.stats)
+			}
+			if got, want := q.Stats().Dropped(), tt.stats.DroppedTail+tt.stats.DroppedHead+tt.stats.TimedOut; got != want {
+				t.Errorf("got %d dropped, want %d", got, want)
+			}
+		})
+	}
+}
+
+// Block queues the frame once the VM's worker makes room
+func TestBlockWaits(t *testing.T) {
+	q, err := New(Params{Policy: Block, Depth: 1, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Push([]byte{1})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-q.Frames()
+	}()
+	if dropped := q.Push([]byte{2}); dropped != nil {
+		t.Fatalf("got %v dropped", dropped)
+	}
+
+	if got, want := q.Stats(), (Stats{Queued: 1, Waited: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// The frames pushed after Close are handed back without counting them
+func TestPushClosed(t *testing.T) {
+	q, err := New(Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	q.Close()
+
+	frame := []byte{1}
+	if dropped := q.Push(frame); !reflect.DeepEqual(dropped, frame) {
+		t.Errorf("got %v dropped, want %v", dropped, frame)
+	}
+	if got := q.Stats(); got != (Stats{}) {
+		t.Errorf("got %+v, want no outcome", got)
+	}
+}
+
+func TestParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		params Params
+		want   Params
+		err    error
+	}{
+		{name: "defaults", want: Params{Policy: DropTail, Depth: DefaultDepth, Timeout: DefaultTimeout}},
+		{name: "configured", params: Params{Policy: Block, Depth: 10, Timeout: time.Second}, want: Params{Policy: Block, Depth: 10, Timeout: time.Second}},
+		{name: "unknown policy", params: Params{Policy: "random"}, err: errUnknownPolicy},
+		{name: "negative depth", params: Params{Depth: -1}, err: errInvalidDepth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := New(tt.params)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && q.Params != tt.want {
+				t.Errorf("got %+v, want %+v", q.Params, tt.want)
+			}
+		})
+	}
+}
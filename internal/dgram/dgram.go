@@ -0,0 +1,90 @@
+// nolint:godot
+package dgram
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Maximum number of datagrams passed to a single syscall
+const MaxBatchSize = 64
+
+var errSyscallConn = errors.New("dgram: the connection doesn't expose its file descriptor")
+
+// Conn reads and writes the datagrams of a socket in batches, with a single syscall
+// where the platform supports it (recvmmsg/sendmmsg on Linux), one by one otherwise.
+//
+// ReadBatch and WriteBatch can be called concurrently, but a Conn
+// mustn't be read, or written from multiple goroutines at the same time.
+type Conn interface {
+	// ReadBatch blocks until at least one datagram is available, then reads up to
+	// len(bufs) of them. The size of the i-th datagram is stored in sizes[i].
+	// A datagram larger than its buffer is truncated to it, its size is len(bufs[i]) then,
+	// so buffers a byte larger than the largest datagram expected tell the truncated ones apart.
+	// Returns the number of datagrams read.
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+	// WriteBatch writes the datagrams in order. The datagrams the kernel has no buffer
+	// for (ENOBUFS) are skipped, the ones after them are still written. Any other error
+	// stops the batch. Returns the number of datagrams written, which is less than
+	// len(msgs) only on error, and the first error.
+	WriteBatch(msgs [][]byte) (int, error)
+}
+
+// New returns a batched Conn of the datagram socket
+func New(conn net.Conn) (Conn, error) {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errSyscallConn
+	}
+
+	raw, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, raw), nil
+}
+
+// singleConn passes the datagrams one by one to the underlying conn
+type singleConn struct {
+	conn net.Conn
+}
+
+func (c *singleConn) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+
+	n, err := c.conn.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+func (c *singleConn) WriteBatch(msgs [][]byte) (int, error) {
+	written := 0
+	var firstErr error
+	for _, msg := range msgs {
+		_, err := c.conn.Write(msg)
+		if err == nil {
+			written++
+			continue
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+		if !skippable(err) {
+			break
+		}
+	}
+	return written, firstErr
+}
+
+// Determine if the datagram failed to be written on its own, and the next ones might succeed
+func skippable(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS)
+}
@@ -0,0 +1,149 @@
+//go:build linux
+
+// nolint:godot
+package dgram
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// struct mmsghdr, the padding follows the alignment of Msghdr
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// batch holds the headers of a recvmmsg/sendmmsg call
+type batch struct {
+	hdrs []mmsghdr
+	iovs []unix.Iovec
+}
+
+func newBatch() batch {
+	return batch{
+		hdrs: make([]mmsghdr, MaxBatchSize),
+		iovs: make([]unix.Iovec, MaxBatchSize),
+	}
+}
+
+// Point the headers to the buffers, returns the number of headers set
+func (b *batch) set(bufs [][]byte) int {
+	n := 0
+	for _, buf := range bufs {
+		if n == len(b.hdrs) {
+			break
+		}
+
+		b.iovs[n] = unix.Iovec{}
+		if len(buf) > 0 {
+			b.iovs[n].Base = &buf[0]
+			b.iovs[n].SetLen(len(buf))
+		}
+		b.hdrs[n] = mmsghdr{}
+		b.hdrs[n].hdr.Iov = &b.iovs[n]
+		b.hdrs[n].hdr.SetIovlen(1)
+		n++
+	}
+	return n
+}
+
+// mmsgConn uses recvmmsg/sendmmsg through the runtime's network poller
+type mmsgConn struct {
+	raw syscall.RawConn
+
+	read  batch
+	write batch
+}
+
+func newConn(_ net.Conn, raw syscall.RawConn) Conn {
+	return &mmsgConn{
+		raw:   raw,
+		read:  newBatch(),
+		write: newBatch(),
+	}
+}
+
+func (c *mmsgConn) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n := c.read.set(bufs)
+	if n == 0 {
+		return 0, nil
+	}
+
+	var received int
+	var errno syscall.Errno
+	err := c.raw.Read(func(fd uintptr) bool {
+		// Without MSG_TRUNC in the flags of the call, the length of a truncated datagram
+		// is the size of its buffer, and MSG_TRUNC is set in the flags of its header
+		r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&c.read.hdrs[0])), uintptr(n),
+			unix.MSG_DONTWAIT, 0, 0)
+		// Wait for the poller to report the socket readable
+		if e == unix.EAGAIN {
+			return false
+		}
+		received, errno = int(r), e
+		return true
+	})
+	runtime.KeepAlive(bufs)
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("recvmmsg", errno)
+	}
+
+	for i := 0; i < received; i++ {
+		sizes[i] = int(c.read.hdrs[i].len)
+		if c.read.hdrs[i].hdr.Flags&unix.MSG_TRUNC != 0 {
+			sizes[i] = len(bufs[i])
+		}
+	}
+	return received, nil
+}
+
+func (c *mmsgConn) WriteBatch(msgs [][]byte) (int, error) {
+	written, next := 0, 0
+	var firstErr error
+	for next < len(msgs) {
+		n := c.write.set(msgs[next:])
+
+		var sent int
+		var errno syscall.Errno
+		err := c.raw.Write(func(fd uintptr) bool {
+			r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&c.write.hdrs[0])), uintptr(n),
+				unix.MSG_DONTWAIT, 0, 0)
+			// Wait for the poller to report the socket writable
+			if e == unix.EAGAIN {
+				return false
+			}
+			sent, errno = int(r), e
+			return true
+		})
+		runtime.KeepAlive(msgs)
+		if err != nil {
+			return written, err
+		}
+
+		// sendmmsg only fails if the first datagram failed, the error of a later one
+		// is returned by the next call, which starts with it
+		if errno != 0 {
+			err := os.NewSyscallError("sendmmsg", errno)
+			if firstErr == nil {
+				firstErr = err
+			}
+			if !skippable(err) {
+				return written, firstErr
+			}
+			sent = 1
+		} else {
+			written += sent
+		}
+		next += sent
+	}
+	return written, firstErr
+}
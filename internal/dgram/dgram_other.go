@@ -0,0 +1,13 @@
+//go:build !linux
+
+package dgram
+
+import (
+	"net"
+	"syscall"
+)
+
+// There's no public batch API for sockets, e.g. on macOS
+func newConn(conn net.Conn, _ syscall.RawConn) Conn {
+	return &singleConn{conn: conn}
+}
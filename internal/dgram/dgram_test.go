@@ -0,0 +1,280 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package dgram
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// A unix datagram socketpair, like the one Virtualization.Framework hands over
+func socketpair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { conn.Close() })
+		conns[i] = conn
+	}
+	return conns[0], conns[1]
+}
+
+// The batched Conn of the platform, and the fallback
+var impls = []struct {
+	name string
+	new  func(tb testing.TB, conn net.Conn) Conn
+}{
+	{name: "platform", new: func(tb testing.TB, conn net.Conn) Conn {
+		tb.Helper()
+		c, err := New(conn)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return c
+	}},
+	{name: "single", new: func(_ testing.TB, conn net.Conn) Conn { return &singleConn{conn: conn} }},
+}
+
+func datagrams(n int) [][]byte {
+	msgs := make([][]byte, n)
+	for i := range msgs {
+		msgs[i] = bytes.Repeat([]byte{byte(i)}, 1+i%100)
+	}
+	return msgs
+}
+
+func readAll(t *testing.T, c Conn, n int, size int) [][]byte {
+	t.Helper()
+
+	bufs := make([][]byte, MaxBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, size)
+	}
+	sizes := make([]int, MaxBatchSize)
+
+	got := make([][]byte, 0, n)
+	for len(got) < n {
+		read, err := c.ReadBatch(bufs, sizes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < read; i++ {
+			got = append(got, append([]byte(nil), bufs[i][:sizes[i]]...))
+		}
+	}
+	return got
+}
+
+// More datagrams than MaxBatchSize keep their order and boundaries
+func TestBatchRoundTrip(t *testing.T) {
+	for _, impl := range impls {
+		t.Run(impl.name, func(t *testing.T) {
+			a, b := socketpair(t)
+			writer, reader := impl.new(t, a), impl.new(t, b)
+
+			msgs := datagrams(3*MaxBatchSize + 5)
+			done := make(chan error, 1)
+			go func() {
+				n, err := writer.WriteBatch(msgs)
+				if err == nil && n != len(msgs) {
+					err = errors.New("short write")
+				}
+				done <- err
+			}()
+
+			got := readAll(t, reader, len(msgs), 200)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			for i := range msgs {
+				if !bytes.Equal(got[i], msgs[i]) {
+					t.Fatalf("datagram %d: got %v, want %v", i, got[i], msgs[i])
+				}
+			}
+		})
+	}
+}
+
+// The socket buffer fills up while the batch is written, sendmmsg sends
+// part of the batch, and the rest is sent once the reader catches up
+func TestWriteBatchPartial(t *testing.T) {
+	for _, impl := range impls {
+		t.Run(impl.name, func(t *testing.T) {
+			a, b := socketpair(t)
+			raw, _ := a.(syscall.Conn).SyscallConn()
+			_ = raw.Control(func(fd uintptr) {
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, 4096)
+			})
+			writer, reader := impl.new(t, a), impl.new(t, b)
+
+			msgs := make([][]byte, MaxBatchSize)
+			for i := range msgs {
+				msgs[i] = bytes.Repeat([]byte{byte(i)}, 1500)
+			}
+			done := make(chan int, 1)
+			go func() {
+				n, _ := writer.WriteBatch(msgs)
+				done <- n
+			}()
+
+			got := readAll(t, reader, len(msgs), 1501)
+			if n := <-done; n != len(msgs) {
+				t.Fatalf("wrote %d datagrams, want %d", n, len(msgs))
+			}
+			for i := range msgs {
+				if !bytes.Equal(got[i], msgs[i]) {
+					t.Fatalf("datagram %d differs", i)
+				}
+			}
+		})
+	}
+}
+
+// A datagram larger than its buffer is reported with the size of the buffer,
+// and doesn't affect the next one
+func TestReadBatchTruncated(t *testing.T) {
+	for _, impl := range impls {
+		t.Run(impl.name, func(t *testing.T) {
+			a, b := socketpair(t)
+			writer, reader := impl.new(t, a), impl.new(t, b)
+
+			msgs := [][]byte{bytes.Repeat([]byte{1}, 100), {2, 2}}
+			if n, err := writer.WriteBatch(msgs); err != nil || n != 2 {
+				t.Fatalf("wrote %d, %v", n, err)
+			}
+
+			got := readAll(t, reader, 2, 10)
+			if !bytes.Equal(got[0], msgs[0][:10]) {
+				t.Errorf("got %v, want the first 10 bytes", got[0])
+			}
+			if !bytes.Equal(got[1], msgs[1]) {
+				t.Errorf("got %v, want %v", got[1], msgs[1])
+			}
+		})
+	}
+}
+
+// Writing to a closed peer fails the batch
+func TestWriteBatchPeerClosed(t *testing.T) {
+	for _, impl := range impls {
+		t.Run(impl.name, func(t *testing.T) {
+			a, b := socketpair(t)
+			writer := impl.new(t, a)
+			b.Close()
+
+			n, err := writer.WriteBatch(datagrams(10))
+			if n != 0 || err == nil {
+				t.Errorf("got %d, %v, want 0 and an error", n, err)
+			}
+		})
+	}
+}
+
+// failingConn fails the writes of the datagrams starting with an errno
+type failingConn struct {
+	net.Conn
+	written [][]byte
+}
+
+func (c *failingConn) Write(p []byte) (int, error) {
+	if len(p) > 0 && p[0] != 0 {
+		return 0, syscall.Errno(p[0])
+	}
+	c.written = append(c.written, p)
+	return len(p), nil
+}
+
+func TestSingleConnWriteErrors(t *testing.T) {
+	ok := []byte{0, 1}
+	noBufs := []byte{byte(syscall.ENOBUFS)}
+	refused := []byte{byte(syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		name    string
+		msgs    [][]byte
+		written int
+		err     error
+	}{
+		{name: "no error", msgs: [][]byte{ok, ok}, written: 2},
+		{name: "no buffer skipped", msgs: [][]byte{ok, noBufs, ok, noBufs, ok}, written: 3, err: syscall.ENOBUFS},
+		{name: "stopped by other errors", msgs: [][]byte{ok, refused, ok}, written: 1, err: syscall.ECONNREFUSED},
+		{name: "first error returned", msgs: [][]byte{noBufs, refused, ok}, written: 0, err: syscall.ENOBUFS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &failingConn{}
+			n, err := (&singleConn{conn: conn}).WriteBatch(tt.msgs)
+			if n != tt.written || len(conn.written) != tt.written {
+				t.Errorf("got %d written, want %d", n, tt.written)
+			}
+			if !errors.Is(err, tt.err) && !(err == nil && tt.err == nil) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func BenchmarkSocketpair(b *testing.B) {
+	for _, size := range []int{64, 1514} {
+		for _, impl := range impls {
+			b.Run(fmt.Sprintf("%s/%dB", impl.name, size), func(b *testing.B) {
+				a, c := socketpair(b)
+				writer, reader := impl.new(b, a), impl.new(b, c)
+
+				batch := make([][]byte, MaxBatchSize)
+				for i := range batch {
+					batch[i] = make([]byte, size)
+				}
+				bufs := make([][]byte, MaxBatchSize)
+				for i := range bufs {
+					bufs[i] = make([]byte, size+1)
+				}
+				sizes := make([]int, MaxBatchSize)
+
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for sent := 0; sent < b.N; {
+						n := min(MaxBatchSize, b.N-sent)
+						written, err := writer.WriteBatch(batch[:n])
+						if err != nil {
+							return
+						}
+						sent += written
+					}
+				}()
+
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for received := 0; received < b.N; {
+					n, err := reader.ReadBatch(bufs, sizes)
+					if err != nil {
+						b.Fatal(err)
+					}
+					received += n
+				}
+				b.StopTimer()
+				<-done
+			})
+		}
+	}
+}
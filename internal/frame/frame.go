@@ -0,0 +1,79 @@
+// nolint:godot
+package frame
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Parser decodes the layers of ethernet frames the stack classifies the traffic by,
+// without allocating. The decoded layers point into the frame, they are only valid
+// until the next Decode, and as long as the frame isn't modified.
+//
+// A Parser is reused for every frame of a worker, it's not safe for concurrent use.
+type Parser struct {
+	Ethernet layers.Ethernet
+	Dot1Q    layers.Dot1Q
+	ARP      layers.ARP
+	IPv4     layers.IPv4
+	UDP      layers.UDP
+	// Decoded on demand from the UDP payload
+	DNS    layers.DNS
+	DHCPv4 layers.DHCPv4
+
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+}
+
+func NewParser() *Parser {
+	p := &Parser{
+		decoded: make([]gopacket.LayerType, 0, 8),
+	}
+
+	p.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet,
+		&p.Ethernet, &p.Dot1Q, &p.ARP, &p.IPv4, &p.UDP)
+	// The payloads (TCP, DNS, dhcp, ...) are decoded on demand
+	p.parser.IgnoreUnsupported = true
+
+	return p
+}
+
+// Decode the frame. Returns false if it's not an ethernet frame.
+// The layers decoded before a malformed one are still available.
+func (p *Parser) Decode(raw []byte) bool {
+	// The error is either a truncated or malformed layer, which is left out of the decoded ones
+	_ = p.parser.DecodeLayers(raw, &p.decoded)
+	return p.Has(layers.LayerTypeEthernet)
+}
+
+// Determine if the layer was decoded from the last frame
+func (p *Parser) Has(layerType gopacket.LayerType) bool {
+	for _, decoded := range p.decoded {
+		if decoded == layerType {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine if the last frame is an ipv4 datagram carrying UDP
+func (p *Parser) HasUDP() bool {
+	return p.Has(layers.LayerTypeIPv4) && p.IPv4.Protocol == layers.IPProtocolUDP && p.Has(layers.LayerTypeUDP)
+}
+
+// Decode the UDP payload of the last frame as a DNS message into DNS
+func (p *Parser) DecodeDNS() (ok bool) {
+	// gopacket panics on some records cut short, instead of returning an error
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	return p.HasUDP() && p.DNS.DecodeFromBytes(p.UDP.Payload, gopacket.NilDecodeFeedback) == nil
+}
+
+// Decode the UDP payload of the last frame as a dhcp message into DHCPv4
+func (p *Parser) DecodeDHCPv4() bool {
+	return p.HasUDP() && p.DHCPv4.DecodeFromBytes(p.UDP.Payload, gopacket.NilDecodeFeedback) == nil
+}
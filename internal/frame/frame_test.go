@@ -0,0 +1,66 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package frame
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func udpFrame(t *testing.T, proto layers.IPProtocol, payload gopacket.SerializableLayer) []byte {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: net.IPv4(10, 0, 0, 1).To4(), DstIP: net.IPv4(10, 0, 0, 2).To4()}
+	udp := &layers.UDP{SrcPort: 53, DstPort: 40000}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, payload); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeDNS(t *testing.T) {
+	msg := &layers.DNS{
+		ID: 7, QR: true,
+		Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	dns := buf.Bytes()
+
+	tests := []struct {
+		name  string
+		frame []byte
+		ok    bool
+	}{
+		{name: "dns", frame: udpFrame(t, layers.IPProtocolUDP, gopacket.Payload(dns)), ok: true},
+		{name: "undecodable", frame: udpFrame(t, layers.IPProtocolUDP, gopacket.Payload(bytes.Repeat([]byte{0xff}, 200)))},
+		{name: "cut short", frame: udpFrame(t, layers.IPProtocolUDP, gopacket.Payload(dns[:len(dns)-2]))},
+		{name: "not udp", frame: udpFrame(t, layers.IPProtocolTCP, gopacket.Payload(dns))},
+	}
+
+	// The parser is reused, like a worker's
+	p := NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !p.Decode(tt.frame) {
+				t.Fatal("not an ethernet frame")
+			}
+			if ok := p.DecodeDNS(); ok != tt.ok {
+				t.Fatalf("got %v, want %v", ok, tt.ok)
+			}
+			if tt.ok && (p.DNS.ID != 7 || string(p.DNS.Questions[0].Name) != "example.com") {
+				t.Errorf("got %+v", p.DNS)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+// nolint:godot
+package netif
+
+import (
+	"net"
+
+	"inet.af/netaddr"
+)
+
+// Interface describes the network the backend actually created on the host,
+// which might differ from the one requested. Unknown values are left zero.
+type Interface struct {
+	// MAC address the backend assigned to the VM's interface. The VM keeps
+	// its own MAC address, this one is only informational.
+	HardwareAddr net.HardwareAddr
+	// Range of the backend's dhcp server, StartAddr being the gateway.
+	// Not set in bridged mode, the LAN's dhcp server hands out the addresses.
+	StartAddr  netaddr.IP
+	EndAddr    netaddr.IP
+	SubnetMask netaddr.IP
+	// ULA prefix of the VMs' IPv6 addresses, not set unless NAT66 is enabled
+	NAT66Prefix netaddr.IPPrefix
+	// UUID of the interface
+	ID string
+	// MTU of the VM's interface
+	MTU int
+	// The maximum size of the frames that can be written to the backend
+	MaxPacketSize int
+}
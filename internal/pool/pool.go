@@ -0,0 +1,42 @@
+// nolint:godot
+package pool
+
+// Pool is a free list of frame buffers, so that the datapath doesn't allocate
+// a new buffer for every frame. It's bounded: buffers returned to a full pool
+// are left to the garbage collector, and a new buffer is allocated when the pool is empty.
+//
+// A Pool is safe for concurrent use.
+type Pool struct {
+	free chan []byte
+	size int
+}
+
+// New returns a pool of at most capacity buffers of the given size
+func New(capacity int, size int) *Pool {
+	return &Pool{
+		free: make(chan []byte, capacity),
+		size: size,
+	}
+}
+
+// Get returns a buffer of the pool's size
+func (p *Pool) Get() []byte {
+	select {
+	case buf := <-p.free:
+		return buf
+	default:
+		return make([]byte, p.size)
+	}
+}
+
+// Put returns the buffer to the pool. Buffers of other sizes are ignored.
+func (p *Pool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+
+	select {
+	case p.free <- buf[:p.size]:
+	default:
+	}
+}
@@ -0,0 +1,82 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package pool
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	p := New(2, 1514)
+
+	buf := p.Get()
+	if len(buf) != 1514 {
+		t.Fatalf("got a buffer of %d bytes, want 1514", len(buf))
+	}
+
+	// A buffer resliced to the frame it held is returned in full
+	buf[0] = 1
+	p.Put(buf[:60])
+	if got := p.Get(); len(got) != 1514 || got[0] != 1 {
+		t.Fatalf("got a buffer of %d bytes, not the one put back", len(got))
+	}
+}
+
+func TestPoolPut(t *testing.T) {
+	tests := []struct {
+		name string
+		bufs [][]byte
+		kept int
+	}{
+		{name: "pool's size", bufs: [][]byte{make([]byte, 1514), make([]byte, 1514)}, kept: 2},
+		{name: "other size", bufs: [][]byte{make([]byte, 9000), make([]byte, 1514)[:0:1000]}},
+		{name: "beyond the capacity", bufs: [][]byte{make([]byte, 1514), make([]byte, 1514), make([]byte, 1514)}, kept: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(2, 1514)
+			for _, buf := range tt.bufs {
+				p.Put(buf)
+			}
+			if got := len(p.free); got != tt.kept {
+				t.Errorf("got %d buffers kept, want %d", got, tt.kept)
+			}
+		})
+	}
+}
+
+// The buffers put back are reused instead of allocating new ones
+func TestPoolReuse(t *testing.T) {
+	p := New(1, 1514)
+	p.Put(p.Get())
+
+	if allocs := testing.AllocsPerRun(100, func() { p.Put(p.Get()) }); allocs != 0 {
+		t.Errorf("got %v allocations", allocs)
+	}
+}
+
+// The race detector catches a buffer handed to two goroutines
+func TestPoolConcurrent(t *testing.T) {
+	p := New(8, 64)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				buf := p.Get()
+				buf[0] = b
+				runtime.Gosched()
+				if buf[0] != b {
+					t.Error("buffer shared by goroutines")
+					return
+				}
+				p.Put(buf)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+}
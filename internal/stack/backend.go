@@ -0,0 +1,91 @@
+// nolint:godot
+package stack
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"github.com/nagypeterjob/sock-vmnet/internal/netif"
+	"github.com/nagypeterjob/sock-vmnet/internal/usernet"
+)
+
+var (
+	errUnknownBackend     = errors.New("unknown backend")
+	errBridgedUnsupported = errors.New("the userspace backend can't bridge the VM to a host interface")
+)
+
+// Backend is the host side of the stack. The frames sent by the VM are written
+// to the backend, and the frames read from the backend are sent to the VM.
+type Backend interface {
+	// Start the backend
+	Start() error
+	// Stop the backend, and close the channel returned by Frames
+	Stop() error
+	// Write a single ethernet frame to the backend
+	Write(p []byte) (int, error)
+	// Frames to be sent to the VM
+	Frames() <-chan []byte
+	// Release hands a frame read from Frames back to the backend, once it was sent to the VM
+	Release(frame []byte)
+	// The maximum size of the frames that can be written to the backend
+	FrameSize() int
+	// The network the backend created, known once it's started
+	Interface() netif.Interface
+	// Counters of the queue of Frames
+	QueueStats() backpressure.Stats
+	// Failures of the running backend, e.g. a failed read or write of the interface
+	Failures() <-chan error
+	// Determine if restarting the backend might recover from the failure
+	Transient(err error) bool
+	// Restart the backend after a failure, the channel of Frames stays open
+	Restart() error
+}
+
+// Policy and depth of the backend's queue
+func (p NetworkParams) queueParams() backpressure.Params {
+	return backpressure.Params{
+		Policy:  backpressure.Policy(p.QueuePolicy),
+		Depth:   p.QueueDepth,
+		Timeout: p.QueueTimeout,
+	}
+}
+
+// BackendKind selects the backend of the stack
+type BackendKind string
+
+const (
+	// macOS's vmnet framework, provides NAT through the bridge100 interface.
+	// Needs root, or the vmnet entitlement.
+	BackendVMNet BackendKind = "vmnet"
+	// Userspace TCP/IP stack, re-originates the VM's connections from host sockets.
+	// Runs unprivileged on every platform.
+	BackendUserspace BackendKind = "userspace"
+)
+
+func newBackend(p NetworkParams) (Backend, error) {
+	if p.CustomBackend != nil {
+		return p.CustomBackend, nil
+	}
+
+	switch p.Backend {
+	case BackendVMNet, "":
+		return newVMNetBackend(p)
+	case BackendUserspace:
+		if p.Mode == ModeBridged {
+			return nil, errBridgedUnsupported
+		}
+		return usernet.New(usernet.Params{
+			StartAddr:  p.StartAddr,
+			EndAddr:    p.EndAddr,
+			SubnetMask: p.SubnetMask,
+			MTU:        p.MTU,
+			HostOnly:   p.Mode == ModeHost,
+			HostPorts:  p.HostPorts,
+			Queue:      p.queueParams(),
+			Debug:      p.Debug,
+		})
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownBackend, p.Backend)
+	}
+}
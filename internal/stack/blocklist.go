@@ -0,0 +1,103 @@
+// nolint:godot
+package stack
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Names commonly found in hosts files, which are never blocked
+var hostsFileReservedNames = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+}
+
+// dnsBlocklist holds the domain names the VM isn't allowed to resolve.
+// Queries for these names are answered with NXDOMAIN.
+type dnsBlocklist struct {
+	// Exactly matching names
+	names map[string]struct{}
+	// Patterns prefixed with "*.", matching every subdomain of the pattern
+	wildcards []string
+}
+
+// Loads the blocklist from a file. Both hosts files and plain lists are accepted:
+//
+//	# hosts file format, the address is ignored
+//	0.0.0.0 telemetry.example.com metrics.example.com
+//	# one name per line
+//	ads.example.com
+//	*.tracking.example.com
+func loadDNSBlocklist(path string) (*dnsBlocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening blocklist: %w", err)
+	}
+	defer f.Close()
+
+	list := &dnsBlocklist{
+		names:     make(map[string]struct{}),
+		wildcards: make([]string, 0),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// hosts file entry, skip the address
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+
+		for _, field := range fields {
+			list.add(field)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading blocklist: %w", err)
+	}
+
+	return list, nil
+}
+
+func (b *dnsBlocklist) add(name string) {
+	name = normalizeDomain(name)
+	if _, ok := hostsFileReservedNames[name]; ok {
+		return
+	}
+
+	if strings.HasPrefix(name, "*.") {
+		b.wildcards = append(b.wildcards, name)
+		return
+	}
+	b.names[name] = struct{}{}
+}
+
+func (b *dnsBlocklist) blocked(name string) bool {
+	name = normalizeDomain(name)
+	if _, ok := b.names[name]; ok {
+		return true
+	}
+
+	for _, pattern := range b.wildcards {
+		if matchDomain(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
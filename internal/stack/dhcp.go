@@ -2,11 +2,12 @@
 package stack
 
 import (
+	"net"
 	"sync"
 	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
 	"github.com/rs/zerolog/log"
 	"inet.af/netaddr"
 )
@@ -26,6 +27,10 @@ type lease struct {
 	addr netaddr.IP
 	// List of DNS servers offered by dhcp
 	dnsServers []netaddr.IP
+	// Default gateway offered by dhcp
+	router netaddr.IP
+	// The dhcp server which acknowledged the lease
+	server netaddr.IP
 
 	// The time of dhcp accept + lease time
 	validUntil time.Time
@@ -34,92 +39,162 @@ type lease struct {
 type dhcpManager struct {
 	// dhcp lease information
 	lease lease
+	// The VM's MAC address, replies sent to other clients are ignored
+	hardwareAddr net.HardwareAddr
+	// The dhcp server trusted to hand out the lease. Unless it's configured, it's unknown in
+	// bridged mode, and the lease is pinned to the LAN's dhcp server which acknowledged it first.
+	server netaddr.IP
+	// The expiry of the lease was emitted, reset by the next ack
+	expiryReported bool
 
 	m sync.Mutex
 }
 
-// Determine if packet is dhcp packet
-func (d *dhcpManager) inspect(packet *gopacket.Packet, gateway netaddr.IP) {
-	var layer gopacket.Layer
+// Determine if packet is dhcp packet.
+// Returns the leases before and after the packet, if the packet acknowledged a lease.
+func (d *dhcpManager) inspect(packet *frame.Parser) (Lease, Lease, bool) {
+	// is it an UDP packet?
+	if !packet.HasUDP() {
+		return Lease{}, Lease{}, false
+	}
 
-	// is it an ipv4 packet?
-	if layer = (*packet).Layer(layers.LayerTypeIPv4); layer == nil {
-		return
+	if !(validDHCPReply(&packet.UDP)) {
+		return Lease{}, Lease{}, false
 	}
 
-	pkt, ok := layer.(*layers.IPv4)
-	if !ok {
-		return
+	// is the packet coming from the dhcp server?
+	src := netaddr.IPFrom4([4]byte(packet.IPv4.SrcIP))
+	if !d.trustedServer(src) {
+		return Lease{}, Lease{}, false
 	}
 
-	// is the packet coming from the gateway?
-	if pkt.SrcIP.String() != gateway.String() {
-		return
+	if !packet.DecodeDHCPv4() {
+		return Lease{}, Lease{}, false
 	}
 
-	// is it an UDP packet?
-	if pkt.Protocol != layers.IPProtocolUDP {
-		return
+	before := d.current()
+	if !d.parseDhcpLease(&packet.DHCPv4, src) {
+		return Lease{}, Lease{}, false
 	}
+	return before, d.current(), true
+}
 
-	layer = (*packet).Layer(layers.LayerTypeUDP)
-	if layer == nil {
-		return
+// Returns the lease once it expired, only once per lease
+func (d *dhcpManager) expired(now time.Time) (Lease, bool) {
+	d.m.Lock()
+	expired := !d.lease.addr.IsZero() && !d.expiryReported && now.After(d.lease.validUntil)
+	if expired {
+		d.expiryReported = true
 	}
+	d.m.Unlock()
 
-	pktUDP, ok := layer.(*layers.UDP)
-	if !ok {
-		return
+	if !expired {
+		return Lease{}, false
 	}
+	return d.current(), true
+}
 
-	if !(validDHCPReply(pktUDP)) {
-		return
+// Returns a copy of the lease
+func (d *dhcpManager) current() Lease {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return Lease{
+		Addr:       d.lease.addr,
+		Router:     d.lease.router,
+		DNSServers: append([]netaddr.IP(nil), d.lease.dnsServers...),
+		Server:     d.lease.server,
+		ValidUntil: d.lease.validUntil,
 	}
+}
 
-	d.parseDhcpLease(packet)
+// Determine if the dhcp reply comes from the server handing out the VM's lease
+func (d *dhcpManager) trustedServer(src netaddr.IP) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if !d.server.IsZero() {
+		return src == d.server
+	}
+	// Any server can hand out a new lease, once the previous one expired
+	if d.lease.server.IsZero() || time.Now().After(d.lease.validUntil) {
+		return true
+	}
+	return src == d.lease.server
 }
 
-// Try to parse the following information from the packet:
+// Try to parse the following information from the dhcp ACK:
 //
 // - VM ip addr
 //
 // - Lease time
 //
 // - DNS servers
-func (d *dhcpManager) parseDhcpLease(packet *gopacket.Packet) {
-	pkt := (*packet).Layer(layers.LayerTypeDHCPv4)
-	dhcp, ok := pkt.(*layers.DHCPv4)
-	if !ok {
-		return
+//
+// Returns true if the packet acknowledged the lease.
+func (d *dhcpManager) parseDhcpLease(dhcp *layers.DHCPv4, server netaddr.IP) bool {
+	// Broadcast replies might be sent to other clients of the LAN
+	if string(dhcp.ClientHWAddr) != string(d.hardwareAddr) {
+		return false
+	}
+
+	msgType := dhcpMessageType(dhcp)
+	if msgType == layers.DHCPMsgTypeOffer {
+		log.Debug().Msgf("dhcp: offered IP address is: %s", dhcp.YourClientIP.String())
+	}
+	// The lease is only taken from the ACK
+	if msgType != layers.DHCPMsgTypeAck {
+		return false
+	}
+
+	// A reply cut short, or of a broken server, doesn't carry the VM's address
+	addr := dhcp.YourClientIP.To4()
+	if addr == nil {
+		return false
 	}
 
 	d.m.Lock()
+	defer d.m.Unlock()
 	for _, opt := range dhcp.Options {
 		if opt.Type == layers.DHCPOptDNS {
 			d.lease.dnsServers = parseDNSAddresses(opt.Data)
 		}
 
+		if opt.Type == layers.DHCPOptRouter && len(opt.Data) >= 4 {
+			d.lease.router = netaddr.IPv4(opt.Data[0], opt.Data[1], opt.Data[2], opt.Data[3])
+		}
+
 		if opt.Type == layers.DHCPOptLeaseTime {
-			leaseTime := parseLeaseTimeBytes(opt.Data)
-			d.lease.validUntil = time.Now().Add(time.Second * time.Duration(leaseTime))
+			if leaseTime, ok := parseLeaseTimeBytes(opt.Data); ok {
+				d.lease.validUntil = time.Now().Add(time.Second * time.Duration(leaseTime))
+			}
 		}
+	}
+
+	// parse the VM IP addr from the dchp ACK message
+	d.lease.addr = netaddr.IPFrom4([4]byte(addr))
+	d.lease.server = server
+	d.expiryReported = false
+	return true
+}
 
-		switch layers.DHCPMsgType(opt.Data[0]) {
-		case layers.DHCPMsgTypeOffer:
-			log.Debug().Msgf("dhcp: offered IP address is: %s", dhcp.YourClientIP.String())
-		case layers.DHCPMsgTypeAck:
-			// parse the VM IP addr from the dchp ACK message
-			d.lease.addr = netaddr.IPFrom4([4]byte(dhcp.YourClientIP.To4()))
+// Returns the type of the dhcp message, which is carried by the message type option
+func dhcpMessageType(dhcp *layers.DHCPv4) layers.DHCPMsgType {
+	for _, opt := range dhcp.Options {
+		if opt.Type == layers.DHCPOptMessageType && len(opt.Data) == 1 {
+			return layers.DHCPMsgType(opt.Data[0])
 		}
 	}
-	d.m.Unlock()
+	return layers.DHCPMsgTypeUnspecified
 }
 
 func (d *dhcpManager) validIPAddress(addr netaddr.IP) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
 	return d.lease.addr == addr && time.Now().Before(d.lease.validUntil)
 }
 
 func (d *dhcpManager) validDNSTarget(destination netaddr.IP) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
 	for _, ip := range d.lease.dnsServers {
 		if destination == ip {
 			return true
@@ -128,6 +203,37 @@ func (d *dhcpManager) validDNSTarget(destination netaddr.IP) bool {
 	return false
 }
 
+// Returns the VM's address, if it has a valid lease
+func (d *dhcpManager) leasedAddr() (netaddr.IP, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.lease.addr.IsZero() || time.Now().After(d.lease.validUntil) {
+		return netaddr.IP{}, false
+	}
+	return d.lease.addr, true
+}
+
+// Returns the default gateway offered by dhcp
+func (d *dhcpManager) router() netaddr.IP {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.lease.router
+}
+
+// Returns the dhcp server which acknowledged the lease
+func (d *dhcpManager) leaseServer() netaddr.IP {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.lease.server
+}
+
+// Forget the lease, e.g. when the VM is gone
+func (d *dhcpManager) release() {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.lease = lease{}
+}
+
 func (d *dhcpManager) hasLeases() bool {
 	d.m.Lock()
 	defer d.m.Unlock()
@@ -136,8 +242,11 @@ func (d *dhcpManager) hasLeases() bool {
 
 // taken from:
 // https://github.com/google/gopacket/blob/32ee38206866f44a74a6033ec26aeeb474506804/layers/dhcpv4.go#L516C2-L517
-func parseLeaseTimeBytes(data []byte) int {
-	return int(uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3]))
+func parseLeaseTimeBytes(data []byte) (int, bool) {
+	if len(data) != 4 {
+		return 0, false
+	}
+	return int(uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])), true
 }
 
 func validDNSRequest(pkt *layers.UDP) bool {
@@ -0,0 +1,121 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"inet.af/netaddr"
+)
+
+func TestTrustedServer(t *testing.T) {
+	lan := netaddr.MustParseIP("10.0.0.1")
+	rogue := netaddr.MustParseIP("10.0.0.66")
+
+	tests := []struct {
+		name   string
+		pinned netaddr.IP
+		lease  lease
+		src    netaddr.IP
+		want   bool
+	}{
+		{name: "pinned server", pinned: lan, src: lan, want: true},
+		{name: "other than the pinned server", pinned: lan, src: rogue},
+		{name: "other than the pinned server, lease expired", pinned: lan, lease: lease{server: lan, validUntil: time.Now().Add(-time.Minute)}, src: rogue},
+		{name: "first server", src: rogue, want: true},
+		{name: "server of the lease", lease: lease{server: lan, validUntil: time.Now().Add(time.Hour)}, src: lan, want: true},
+		{name: "other than the server of the lease", lease: lease{server: lan, validUntil: time.Now().Add(time.Hour)}, src: rogue},
+		{name: "other server, lease expired", lease: lease{server: lan, validUntil: time.Now().Add(-time.Minute)}, src: rogue, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dhcpManager{server: tt.pinned, lease: tt.lease}
+			if got := d.trustedServer(tt.src); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDHCPServerParam(t *testing.T) {
+	lan := netaddr.MustParseIP("10.0.0.1")
+
+	tests := []struct {
+		name   string
+		params NetworkParams
+		want   netaddr.IP
+	}{
+		{name: "gateway", want: netaddr.MustParseIP("192.168.64.1")},
+		{name: "configured", params: NetworkParams{DHCPServer: lan}, want: lan},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := runTestStack(t, tt.params)
+			if got := s.sw.primary().dm.server; got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDHCPLease(t *testing.T) {
+	server := netaddr.MustParseIP("192.168.64.1")
+	msgType := func(data ...byte) layers.DHCPOption { return layers.NewDHCPOption(layers.DHCPOptMessageType, data) }
+	ack := msgType(byte(layers.DHCPMsgTypeAck))
+	leaseTime := func(data ...byte) layers.DHCPOption { return layers.NewDHCPOption(layers.DHCPOptLeaseTime, data) }
+	hour := leaseTime(0, 0, 0x0e, 0x10)
+
+	tests := []struct {
+		name    string
+		options layers.DHCPOptions
+		yiaddr  net.IP
+		acked   bool
+		// Lease time, if acked
+		valid time.Duration
+	}{
+		{name: "ack", options: layers.DHCPOptions{ack, hour}, acked: true, valid: time.Hour},
+		{name: "offer", options: layers.DHCPOptions{msgType(byte(layers.DHCPMsgTypeOffer)), hour}},
+		{name: "without message type", options: layers.DHCPOptions{hour}},
+		{name: "empty message type", options: layers.DHCPOptions{msgType(), hour}},
+		{name: "message type too long", options: layers.DHCPOptions{msgType(byte(layers.DHCPMsgTypeAck), 0), hour}},
+		// The ack type in the first byte of another option
+		{name: "message type in another option", options: layers.DHCPOptions{leaseTime(byte(layers.DHCPMsgTypeAck), 0, 0x0e, 0x10)}},
+		{name: "empty option", options: layers.DHCPOptions{layers.NewDHCPOption(layers.DHCPOptHostname, nil), ack, hour}, acked: true, valid: time.Hour},
+		{name: "lease time cut short", options: layers.DHCPOptions{ack, leaseTime(0, 0, 0x0e)}, acked: true},
+		{name: "lease time too long", options: layers.DHCPOptions{ack, leaseTime(0, 0, 0x0e, 0x10, 0)}, acked: true},
+		{name: "empty lease time", options: layers.DHCPOptions{ack, leaseTime()}, acked: true},
+		{name: "ack without address", options: layers.DHCPOptions{ack, hour}, yiaddr: net.IP{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yiaddr := net.IPv4(192, 168, 64, 2)
+			if tt.yiaddr != nil {
+				yiaddr = tt.yiaddr
+			}
+			d := &dhcpManager{hardwareAddr: testVMMAC}
+			reply := &layers.DHCPv4{Operation: layers.DHCPOpReply, ClientHWAddr: testVMMAC, YourClientIP: yiaddr, Options: tt.options}
+
+			if got := d.parseDhcpLease(reply, server); got != tt.acked {
+				t.Fatalf("got acked %v, want %v", got, tt.acked)
+			}
+			if !tt.acked {
+				if d.hasLeases() {
+					t.Errorf("got lease %+v, want none", d.lease)
+				}
+				return
+			}
+			if want := netaddr.MustParseIP("192.168.64.2"); d.lease.addr != want {
+				t.Errorf("got %s, want %s", d.lease.addr, want)
+			}
+			// A lease without a valid lease time isn't valid
+			if got := time.Until(d.lease.validUntil); tt.valid == 0 && !d.lease.validUntil.IsZero() || tt.valid != 0 && (got > tt.valid || got < tt.valid-time.Minute) {
+				t.Errorf("got lease valid until %s, want %s from now", d.lease.validUntil, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,487 @@
+// nolint:exhaustivestruct,exhaustruct,godot
+package stack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+)
+
+const (
+	// Time to wait for an answer from a single upstream resolver
+	defaultDNSTimeout = 5 * time.Second
+	// Maximum size of a DNS message over UDP with EDNS0
+	maxDNSMessageSize = 4096
+	// Queries forwarded to the upstreams at the same time, the ones beyond are dropped
+	maxDNSInFlight = 64
+
+	udpIPv4HeadersLen = ipv4HeaderLen + udpHeaderLen
+
+	// Offsets in the TCP header
+	tcpPortsLen    = 4
+	tcpFlagsOffset = 13
+	tcpFlagSYN     = 0x02
+)
+
+var (
+	errNoDNSUpstream   = errors.New("dns: no upstream resolver answered")
+	errInvalidDNSReply = errors.New("dns: the reply can't be truncated")
+)
+
+// dnsProxy answers the DNS queries the VM sends to the gateway
+// by forwarding them to the configured upstream resolvers.
+type dnsProxy struct {
+	// Upstream resolvers in host:port format, tried in order
+	upstreams []string
+	// Time to wait for an answer from a single upstream
+	timeout time.Duration
+	// Slots of the queries being forwarded
+	inFlight chan struct{}
+}
+
+func newDNSProxy(upstreams []string) *dnsProxy {
+	addrs := make([]string, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		addrs = append(addrs, dnsUpstreamAddr(upstream))
+	}
+
+	return &dnsProxy{
+		upstreams: addrs,
+		timeout:   defaultDNSTimeout,
+		inFlight:  make(chan struct{}, maxDNSInFlight),
+	}
+}
+
+// Take a slot for a query. Returns false if maxDNSInFlight queries are being forwarded already.
+func (d *dnsProxy) acquire() bool {
+	select {
+	case d.inFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *dnsProxy) release() {
+	<-d.inFlight
+}
+
+// exchange sends the raw DNS query to the upstreams one after another,
+// and returns the first answer received, until ctx is done.
+func (d *dnsProxy) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var lastErr error = errNoDNSUpstream
+	for _, upstream := range d.upstreams {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		reply, err := d.exchangeWith(ctx, upstream, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return reply, nil
+	}
+	return nil, lastErr
+}
+
+func (d *dnsProxy) exchangeWith(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: d.timeout}
+	conn, err := dialer.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", upstream, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(d.timeout)); err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	// Unblocks the read once ctx is done
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("writing query to %s: %w", upstream, err)
+	}
+
+	reply := make([]byte, maxDNSMessageSize)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return nil, fmt.Errorf("reading reply from %s: %w", upstream, err)
+	}
+	return reply[:n], nil
+}
+
+// Append the well known DNS port, if the upstream doesn't specify one
+func dnsUpstreamAddr(upstream string) string {
+	if _, _, err := net.SplitHostPort(upstream); err == nil {
+		return upstream
+	}
+	return net.JoinHostPort(upstream, fmt.Sprint(dnsPort))
+}
+
+func decodeDNS(payload []byte) (msg *layers.DNS, ok bool) {
+	// gopacket panics on some records cut short, instead of returning an error
+	defer func() {
+		if recover() != nil {
+			msg, ok = nil, false
+		}
+	}()
+
+	msg = &layers.DNS{}
+	if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil, false
+	}
+	return msg, true
+}
+
+// Returns the first question's name of a DNS message, or an empty string
+func questionName(msg *layers.DNS) string {
+	if len(msg.Questions) == 0 {
+		return ""
+	}
+	return string(msg.Questions[0].Name)
+}
+
+// Builds an empty reply to the query with the given response code
+func newDNSReply(query *layers.DNS, code layers.DNSResponseCode) *layers.DNS {
+	return &layers.DNS{
+		ID:           query.ID,
+		QR:           true,
+		OpCode:       query.OpCode,
+		RD:           query.RD,
+		RA:           true,
+		ResponseCode: code,
+		Questions:    query.Questions,
+	}
+}
+
+// Truncates the reply to the header and the questions with TC set, if it exceeds size,
+// so that the VM retries the query over TCP (RFC 1035 4.2.1)
+func truncateDNS(reply []byte, size int) ([]byte, error) {
+	if len(reply) <= size {
+		return reply, nil
+	}
+
+	msg, ok := decodeDNS(reply)
+	if !ok {
+		return nil, errInvalidDNSReply
+	}
+	msg.TC = true
+	msg.Answers, msg.Authorities, msg.Additionals = nil, nil, nil
+
+	truncated, err := serializeDNS(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(truncated) > size {
+		return nil, errInvalidDNSReply
+	}
+	return truncated, nil
+}
+
+func serializeDNS(msg *layers.DNS) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, fmt.Errorf("serializing dns message: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// dnsFlow holds the addressing of a DNS query sent by the VM.
+// It's copied out of the frame, so that it outlives the read buffer.
+type dnsFlow struct {
+	vmMAC     net.HardwareAddr
+	serverMAC net.HardwareAddr
+	vmIP      net.IP
+	serverIP  net.IP
+	vmPort    layers.UDPPort
+	// The DNS server's port, it's not necessarily the well known one
+	serverPort layers.UDPPort
+}
+
+func newDNSFlow(eth *layers.Ethernet, ip *layers.IPv4, udp *layers.UDP) dnsFlow {
+	return dnsFlow{
+		vmMAC:      append(net.HardwareAddr(nil), eth.SrcMAC...),
+		serverMAC:  append(net.HardwareAddr(nil), eth.DstMAC...),
+		vmIP:       append(net.IP(nil), ip.SrcIP...),
+		serverIP:   append(net.IP(nil), ip.DstIP...),
+		vmPort:     udp.SrcPort,
+		serverPort: udp.DstPort,
+	}
+}
+
+// Builds an ethernet frame carrying the DNS reply payload back to the VM,
+// by mirroring the addresses and ports of the query.
+func (f dnsFlow) replyFrame(payload []byte) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       f.serverMAC,
+		DstMAC:       f.vmMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Flags:    layers.IPv4DontFragment,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    f.serverIP,
+		DstIP:    f.vmIP,
+	}
+	udp := &layers.UDP{
+		SrcPort: f.serverPort,
+		DstPort: f.vmPort,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, fmt.Errorf("setting checksum layer: %w", err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		return nil, fmt.Errorf("serializing dns reply: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Hands the VM's DNS query over to the embedded proxy.
+// Returns true if the frame was consumed by the proxy.
+func (s *Stack) proxyDNS(port *vmPort, packet *frame.Parser) bool {
+	if !packet.HasUDP() || !validDNSRequest(&packet.UDP) {
+		return false
+	}
+	eth, ip, udp := &packet.Ethernet, &packet.IPv4, &packet.UDP
+
+	// Only answer queries coming from the leased address, so that
+	// the proxy can't be used to bypass the anti-spoofing rules.
+	if !port.dm.validIPAddress(netaddr.IPFrom4([4]byte(ip.SrcIP))) {
+		return false
+	}
+
+	destinationAddr := netaddr.IPFrom4([4]byte(ip.DstIP))
+	if destinationAddr != s.gatewayAddr() && !port.dm.validDNSTarget(destinationAddr) {
+		return false
+	}
+
+	// The VM retries the dropped query
+	if !s.dns.acquire() {
+		log.Debug().Msg("dns: too many queries in flight, dropped")
+		return true
+	}
+
+	flow := newDNSFlow(eth, ip, udp)
+	query := append([]byte(nil), udp.Payload...)
+	s.workers.run(&s.workers.tasks, func() {
+		defer s.dns.release()
+		s.answerDNS(s.workers.drain, port, flow, query)
+	})
+
+	return true
+}
+
+// Forward the query to the upstreams, and send the reply to the VM.
+// The query is given up once ctx is done.
+func (s *Stack) answerDNS(ctx context.Context, port *vmPort, flow dnsFlow, query []byte) {
+	reply, err := s.dns.exchange(ctx, query)
+	if err != nil {
+		log.Error().Err(err).Msg("dns: forwarding query")
+		return
+	}
+
+	s.inspectProxiedReply(query, reply)
+
+	// The upstream's reply might not fit the VM's MTU
+	reply, err = truncateDNS(reply, s.mtu()-udpIPv4HeadersLen)
+	if err != nil {
+		log.Error().Err(err).Msg("dns: truncating reply")
+		return
+	}
+
+	frame, err := flow.replyFrame(reply)
+	if err != nil {
+		log.Error().Err(err).Msg("dns: building reply")
+		return
+	}
+
+	s.sendToVM(port, frame)
+}
+
+// Logs the VM's DNS queries, and answers the local names and the blocked ones.
+// Returns true if the frame was consumed.
+func (s *Stack) inspectDNSQuery(port *vmPort, packet *frame.Parser) bool {
+	if !s.LogDNS && s.blocklist == nil && s.resolver == nil {
+		return false
+	}
+
+	if !packet.HasUDP() || !validDNSRequest(&packet.UDP) {
+		return false
+	}
+	eth, ip, udp := &packet.Ethernet, &packet.IPv4, &packet.UDP
+
+	query := &packet.DNS
+	if !packet.DecodeDNS() || query.QR || len(query.Questions) == 0 {
+		return false
+	}
+
+	if s.LogDNS {
+		s.dnsLog.Info().Str("name", questionName(query)).Str("type", query.Questions[0].Type.String()).
+			Str("server", ip.DstIP.String()).Msg("dns: query")
+	}
+
+	reply := s.answerLocally(port, query)
+	if reply == nil {
+		return false
+	}
+
+	// Let the firewall drop the spoofed queries
+	if !port.dm.validIPAddress(netaddr.IPFrom4([4]byte(ip.SrcIP))) {
+		return false
+	}
+
+	// The static host overrides might be allowed domains as well
+	if s.egress != nil {
+		s.egress.record(questionName(query), reply)
+	}
+
+	payload, err := serializeDNS(reply)
+	if err != nil {
+		log.Error().Err(err).Msg("dns: building local reply")
+		return true
+	}
+
+	frame, err := newDNSFlow(eth, ip, udp).replyFrame(payload)
+	if err != nil {
+		log.Error().Err(err).Msg("dns: building reply")
+		return true
+	}
+
+	s.sendToVM(port, frame)
+	return true
+}
+
+// Determine if the frame is a DNS query over TCP, which has to be dropped, because its names
+// aren't inspected, but the blocklist or the local names are configured.
+// The VMs fall back to TCP after a truncated reply, or if they are configured to.
+func (s *Stack) rejectDNSOverTCP(packet *frame.Parser) bool {
+	ip := &packet.IPv4
+	if !packet.Has(layers.LayerTypeIPv4) || ip.Protocol != layers.IPProtocolTCP ||
+		ip.FragOffset != 0 || len(ip.Payload) < tcpPortsLen {
+		return false
+	}
+	if layers.TCPPort(binary.BigEndian.Uint16(ip.Payload[2:4])) != dnsPort {
+		return false
+	}
+
+	// The header might be cut short, the frame isn't checked by the firewall yet
+	if s.LogDNS && len(ip.Payload) >= tcpHeaderLen && ip.Payload[tcpFlagsOffset]&tcpFlagSYN != 0 {
+		s.dnsLog.Info().Str("server", ip.DstIP.String()).Msg("dns: query over TCP, not inspected")
+	}
+
+	if s.blocklist == nil && s.resolver == nil {
+		return false
+	}
+	log.Debug().Str("server", ip.DstIP.String()).Msg("dns: query over TCP dropped")
+	return true
+}
+
+// Returns the reply to the query if it doesn't need to leave the stack, nil otherwise.
+// Local names take precedence over the blocklist.
+func (s *Stack) answerLocally(port *vmPort, query *layers.DNS) *layers.DNS {
+	name := questionName(query)
+	if s.resolver != nil {
+		if reply, ok := s.resolver.answer(query, port.Segment); ok {
+			log.Debug().Str("name", name).Str("rcode", reply.ResponseCode.String()).Msg("dns: answered local name")
+			return reply
+		}
+	}
+
+	if s.blocklist != nil && s.blocklist.blocked(name) {
+		s.dnsLog.Info().Str("name", name).Msg("dns: blocked query")
+		return newDNSReply(query, layers.DNSResponseCodeNXDomain)
+	}
+
+	return nil
+}
+
+// Remembers the VM's query sent through the backend to the gateway or to a DNS server of its lease,
+// so that the egress policy only learns from the reply of the server the query is sent to
+func (s *Stack) expectDNSReply(port *vmPort, packet *frame.Parser) {
+	if s.egress == nil || !packet.HasUDP() || !validDNSRequest(&packet.UDP) {
+		return
+	}
+
+	server := netaddr.IPFrom4([4]byte(packet.IPv4.DstIP))
+	if server != s.gatewayAddr() && !port.dm.validDNSTarget(server) {
+		return
+	}
+
+	query := &packet.DNS
+	if !packet.DecodeDNS() || query.QR || len(query.Questions) == 0 {
+		return
+	}
+
+	vm := netaddr.IPPortFrom(netaddr.IPFrom4([4]byte(packet.IPv4.SrcIP)), uint16(packet.UDP.SrcPort))
+	s.egress.expect(dnsQueryKey{vm: vm, server: server, id: query.ID}, questionName(query))
+}
+
+// Inspect the DNS replies sent to the VM through the backend
+func (s *Stack) inspectDNSReply(packet *frame.Parser) {
+	if !packet.HasUDP() || packet.UDP.SrcPort != dnsPort {
+		return
+	}
+
+	if !s.LogDNS && s.egress == nil {
+		return
+	}
+
+	msg := &packet.DNS
+	if !packet.DecodeDNS() || !s.observeDNSReply(msg) || s.egress == nil {
+		return
+	}
+
+	// Only the replies to the VM's own queries are learned from,
+	// the rest could be forged by anyone reaching the VM from port 53
+	vm := netaddr.IPPortFrom(netaddr.IPFrom4([4]byte(packet.IPv4.DstIP)), uint16(packet.UDP.DstPort))
+	server := netaddr.IPFrom4([4]byte(packet.IPv4.SrcIP))
+	if name, ok := s.egress.answered(dnsQueryKey{vm: vm, server: server, id: msg.ID}); ok {
+		s.egress.record(name, msg)
+	}
+}
+
+// Inspect the reply of the upstreams to the query forwarded by the DNS proxy
+func (s *Stack) inspectProxiedReply(query []byte, reply []byte) {
+	if !s.LogDNS && s.egress == nil {
+		return
+	}
+
+	msg, ok := decodeDNS(reply)
+	if !ok || !s.observeDNSReply(msg) || s.egress == nil {
+		return
+	}
+
+	if q, ok := decodeDNS(query); ok && q.ID == msg.ID {
+		s.egress.record(questionName(q), msg)
+	}
+}
+
+// Logs the DNS reply. Returns false if the message isn't a reply.
+func (s *Stack) observeDNSReply(msg *layers.DNS) bool {
+	if !msg.QR {
+		return false
+	}
+
+	if s.LogDNS {
+		s.dnsLog.Info().Str("name", questionName(msg)).Str("rcode", msg.ResponseCode.String()).
+			Int("answers", len(msg.Answers)).Msg("dns: reply")
+	}
+
+	return true
+}
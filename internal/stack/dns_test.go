@@ -0,0 +1,233 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
+)
+
+// Answers every query with the given number of A records, until the test ends
+func runTestUpstream(t *testing.T, answers int) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxDNSMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, ok := decodeDNS(buf[:n])
+			if !ok {
+				continue
+			}
+			reply := newDNSReply(query, layers.DNSResponseCodeNoErr)
+			for i := 0; i < answers; i++ {
+				reply.Answers = append(reply.Answers, layers.DNSResourceRecord{
+					Name:  query.Questions[0].Name,
+					Type:  layers.DNSTypeA,
+					Class: layers.DNSClassIN,
+					TTL:   60,
+					IP:    net.IPv4(203, 0, 113, byte(i)).To4(),
+				})
+			}
+			payload, err := serializeDNS(reply)
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(payload, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func dnsQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+
+	payload, err := serializeDNS(&layers.DNS{
+		ID:        id,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func readDNSReply(t *testing.T, vm net.Conn) (gopacket.Packet, *layers.DNS) {
+	t.Helper()
+
+	packet := readFrame(t, vm, func(p gopacket.Packet) bool { return p.Layer(layers.LayerTypeDNS) != nil })
+	return packet, packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+}
+
+func TestDNSProxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		answers   int
+		truncated bool
+	}{
+		{name: "fits the MTU", answers: 2},
+		{name: "exceeds the MTU", answers: 100, truncated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := runTestUpstream(t, tt.answers)
+			s, vm := runTestStack(t, NetworkParams{DNSUpstreams: []string{upstream}})
+			addr := leaseTestVM(t, vm)
+
+			_, _ = vm.Write(udpFrame(t, addr, testGateway, 5353, 53, dnsQuery(t, 42, "example.com")))
+			packet, reply := readDNSReply(t, vm)
+
+			if reply.ID != 42 || !reply.QR {
+				t.Fatalf("got reply %d (QR %v), want a reply to 42", reply.ID, reply.QR)
+			}
+			if reply.TC != tt.truncated {
+				t.Errorf("got TC %v, want %v", reply.TC, tt.truncated)
+			}
+			if tt.truncated && len(reply.Answers) != 0 {
+				t.Errorf("got %d answers in the truncated reply", len(reply.Answers))
+			}
+			if !tt.truncated && len(reply.Answers) != tt.answers {
+				t.Errorf("got %d answers, want %d", len(reply.Answers), tt.answers)
+			}
+			if size := len(packet.Data()) - ethHeaderLen; size > s.mtu() {
+				t.Errorf("got a %d bytes datagram, exceeding the MTU %d", size, s.mtu())
+			}
+		})
+	}
+}
+
+func TestTruncateDNS(t *testing.T) {
+	query, _ := decodeDNS(dnsQuery(t, 1, "example.com"))
+	reply := newDNSReply(query, layers.DNSResponseCodeNoErr)
+	for i := 0; i < 10; i++ {
+		reply.Answers = append(reply.Answers, layers.DNSResourceRecord{
+			Name: query.Questions[0].Name, Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: net.IPv4(10, 0, 0, byte(i)).To4(),
+		})
+	}
+	payload, err := serializeDNS(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		reply   []byte
+		size    int
+		tc      bool
+		invalid bool
+	}{
+		{name: "fits", reply: payload, size: len(payload)},
+		{name: "truncated", reply: payload, size: 100, tc: true},
+		{name: "questions exceed the size", reply: payload, size: 20, invalid: true},
+		{name: "undecodable", reply: bytes.Repeat([]byte{0xff}, 200), size: 100, invalid: true},
+		{name: "cut short", reply: payload[:len(payload)-2], size: 100, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := truncateDNS(tt.reply, tt.size)
+			if tt.invalid {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) > tt.size {
+				t.Fatalf("got %d bytes, exceeding %d", len(got), tt.size)
+			}
+			msg, ok := decodeDNS(got)
+			if !ok {
+				t.Fatal("undecodable reply")
+			}
+			if msg.TC != tt.tc || questionName(msg) != "example.com" {
+				t.Errorf("got TC %v for %q, want TC %v for example.com", msg.TC, questionName(msg), tt.tc)
+			}
+		})
+	}
+}
+
+func TestDNSProxyInFlight(t *testing.T) {
+	d := newDNSProxy([]string{"127.0.0.1"})
+	for i := 0; i < maxDNSInFlight; i++ {
+		if !d.acquire() {
+			t.Fatalf("query %d refused", i)
+		}
+	}
+	if d.acquire() {
+		t.Fatal("query beyond the limit accepted")
+	}
+	d.release()
+	if !d.acquire() {
+		t.Fatal("query refused after a release")
+	}
+}
+
+func TestRejectDNSOverTCP(t *testing.T) {
+	tcpFrame := func(t *testing.T, dstPort uint16) []byte {
+		t.Helper()
+
+		eth := &layers.Ethernet{SrcMAC: testVMMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(192, 168, 64, 2), DstIP: testGateway}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(dstPort), SYN: true, Window: 1024}
+		_ = tcp.SetNetworkLayerForChecksum(ip)
+		return serializeFrame(t, eth, ip, tcp)
+	}
+	// Only the ports of a TCP header, e.g. a tiny first fragment
+	shortFrame := func(t *testing.T) []byte {
+		t.Helper()
+
+		eth := &layers.Ethernet{SrcMAC: testVMMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(192, 168, 64, 2), DstIP: testGateway}
+		return serializeFrame(t, eth, ip, gopacket.Payload{0x9c, 0x40, 0, 53, 0, 0})
+	}
+
+	tests := []struct {
+		name      string
+		frame     []byte
+		blocklist bool
+		want      bool
+	}{
+		{name: "tcp/53 with a blocklist", frame: tcpFrame(t, 53), blocklist: true, want: true},
+		{name: "tcp/53 without a blocklist", frame: tcpFrame(t, 53)},
+		{name: "tcp/80 with a blocklist", frame: tcpFrame(t, 80), blocklist: true},
+		{name: "tcp/53 header cut short with a blocklist", frame: shortFrame(t), blocklist: true, want: true},
+		{name: "tcp/53 header cut short without a blocklist", frame: shortFrame(t)},
+		{name: "udp/53 with a blocklist", frame: udpFrame(t, net.IPv4(192, 168, 64, 2), testGateway, 5353, 53, nil), blocklist: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Stack{NetworkParams: NetworkParams{LogDNS: true}}
+			if tt.blocklist {
+				s.blocklist = &dnsBlocklist{}
+			}
+
+			packet := frame.NewParser()
+			if !packet.Decode(tt.frame) {
+				t.Fatal("undecodable frame")
+			}
+			if got := s.rejectDNSOverTCP(packet); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+// nolint:exhaustivestruct,exhaustruct,godot
+package stack
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+)
+
+// Resolved addresses are kept for at least this long, even if the DNS answer
+// had a shorter TTL. Without the grace period, connections to names with
+// 0 TTL would be dropped before the VM even had a chance to open them.
+const minEgressTTL = 30 * time.Second
+
+const (
+	// Replies arriving later than this after the query aren't learned from
+	dnsReplyTimeout = 2 * defaultDNSTimeout
+	// Queries awaiting a reply. The replies to the queries beyond aren't learned from.
+	maxPendingDNSQueries = 1024
+)
+
+// A query of a VM sent through the backend, identified the way its reply is
+type dnsQueryKey struct {
+	// Address and source port of the VM
+	vm netaddr.IPPort
+	// DNS server the query is sent to
+	server netaddr.IP
+	id     uint16
+}
+
+type pendingDNSQuery struct {
+	// Normalized name of the question
+	name   string
+	expiry time.Time
+}
+
+// egressPolicy restricts the VM's egress traffic to the addresses
+// resolved from allowed domain names.
+//
+// The policy learns the addresses from the DNS answers the VM receives to its own
+// queries, either from the embedded DNS proxy or from the DNS servers of its lease,
+// and forgets them once the TTL of the answer expires.
+type egressPolicy struct {
+	// Allowed domain names, in lower case without the trailing dot.
+	// A name prefixed with "*." allows every subdomain of the name, e.g:
+	// *.github.com allows api.github.com, but not github.com itself.
+	domains []string
+
+	// Resolved addresses of the allowed domains and their expiry
+	resolved map[netaddr.IP]time.Time
+
+	// Queries of the VMs sent through the backend, awaiting a reply
+	pending map[dnsQueryKey]pendingDNSQuery
+
+	// When the expired addresses and queries are removed next
+	nextPrune time.Time
+
+	m sync.Mutex
+}
+
+func newEgressPolicy(domains []string) *egressPolicy {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		normalized = append(normalized, normalizeDomain(domain))
+	}
+
+	return &egressPolicy{
+		domains:  normalized,
+		resolved: make(map[netaddr.IP]time.Time),
+		pending:  make(map[dnsQueryKey]pendingDNSQuery),
+	}
+}
+
+func (e *egressPolicy) allowedDomain(name string) bool {
+	name = normalizeDomain(name)
+	for _, domain := range e.domains {
+		if matchDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remembers the query, so that its reply can be learned from.
+// Only the queries for the allowed domains are remembered.
+func (e *egressPolicy) expect(key dnsQueryKey, name string) {
+	name = normalizeDomain(name)
+	if !e.allowedDomain(name) {
+		return
+	}
+
+	now := time.Now()
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	e.prune(now)
+	if len(e.pending) >= maxPendingDNSQueries {
+		log.Debug().Str("name", name).Msg("egress: too many pending queries")
+		return
+	}
+	e.pending[key] = pendingDNSQuery{name: name, expiry: now.Add(dnsReplyTimeout)}
+}
+
+// Returns the name of the pending query the key identifies, and forgets the query
+func (e *egressPolicy) answered(key dnsQueryKey) (string, bool) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	query, ok := e.pending[key]
+	if !ok {
+		return "", false
+	}
+	delete(e.pending, key)
+
+	if time.Now().After(query.expiry) {
+		return "", false
+	}
+	return query.name, true
+}
+
+// Records the A answers of a decoded DNS reply to the query of name, if it's an allowed domain.
+// Only the answers owned by the name itself, or by the names of its CNAME chain are accepted,
+// since it's the name which has been allowed.
+func (e *egressPolicy) record(name string, msg *layers.DNS) {
+	if !msg.QR || msg.ResponseCode != layers.DNSResponseCodeNoErr || len(msg.Questions) == 0 {
+		return
+	}
+
+	name = normalizeDomain(name)
+	if question := normalizeDomain(questionName(msg)); question != name {
+		log.Debug().Str("name", name).Str("question", question).Msg("egress: reply to another question")
+		return
+	}
+	if !e.allowedDomain(name) {
+		log.Debug().Str("name", name).Msg("egress: domain not allowed")
+		return
+	}
+
+	owners := cnameChain(name, msg.Answers)
+	now := time.Now()
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	e.prune(now)
+
+	for _, answer := range msg.Answers {
+		if answer.Type != layers.DNSTypeA || !owners[normalizeDomain(string(answer.Name))] {
+			continue
+		}
+
+		addr, ok := netaddr.FromStdIP(answer.IP)
+		if !ok {
+			continue
+		}
+
+		ttl := time.Duration(answer.TTL) * time.Second
+		if ttl < minEgressTTL {
+			ttl = minEgressTTL
+		}
+
+		// never shorten the expiry of an address which is resolved by multiple names
+		if expiry := now.Add(ttl); expiry.After(e.resolved[addr]) {
+			e.resolved[addr] = expiry
+		}
+		log.Debug().Str("name", name).Msgf("egress: allowing %s for %s", addr, ttl)
+	}
+}
+
+// Removes the expired addresses and queries, at most once per minEgressTTL.
+// Must be called with the lock held.
+func (e *egressPolicy) prune(now time.Time) {
+	if now.Before(e.nextPrune) {
+		return
+	}
+	e.nextPrune = now.Add(minEgressTTL)
+
+	for addr, expiry := range e.resolved {
+		if now.After(expiry) {
+			delete(e.resolved, addr)
+		}
+	}
+	for key, query := range e.pending {
+		if now.After(query.expiry) {
+			delete(e.pending, key)
+		}
+	}
+}
+
+// Returns the normalized name and the names it's an alias of through the CNAME answers
+func cnameChain(name string, answers []layers.DNSResourceRecord) map[string]bool {
+	owners := map[string]bool{name: true}
+
+	// The CNAMEs usually precede their targets, but don't rely on it
+	for found := true; found; {
+		found = false
+		for _, answer := range answers {
+			if answer.Type != layers.DNSTypeCNAME || !owners[normalizeDomain(string(answer.Name))] {
+				continue
+			}
+			if target := normalizeDomain(string(answer.CNAME)); !owners[target] {
+				owners[target] = true
+				found = true
+			}
+		}
+	}
+	return owners
+}
+
+func (e *egressPolicy) allowedIP(addr netaddr.IP) bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	expiry, ok := e.resolved[addr]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(expiry) {
+		delete(e.resolved, addr)
+		return false
+	}
+	return true
+}
+
+// Determine if the VM is allowed to send traffic to the destination
+func (s *Stack) allowEgress(destination netaddr.IP) bool {
+	if s.egress == nil {
+		return true
+	}
+	return s.egress.allowedIP(destination)
+}
+
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// Determine if the normalized name matches the normalized domain pattern.
+// A pattern prefixed with "*." matches every subdomain of the pattern.
+func matchDomain(pattern string, name string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(name, "."+suffix)
+	}
+	return name == pattern
+}
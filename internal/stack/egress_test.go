@@ -0,0 +1,222 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
+	"inet.af/netaddr"
+)
+
+func answerA(name string, ip string) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: net.ParseIP(ip).To4()}
+}
+
+func answerCNAME(name string, target string) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeCNAME, Class: layers.DNSClassIN, TTL: 60, CNAME: []byte(target)}
+}
+
+func dnsReply(id uint16, question string, answers ...layers.DNSResourceRecord) *layers.DNS {
+	return &layers.DNS{
+		ID:        id,
+		QR:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte(question), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		Answers:   answers,
+	}
+}
+
+func TestEgressAllowedDomain(t *testing.T) {
+	e := newEgressPolicy([]string{"*.github.com", "PyPI.org."})
+
+	tests := map[string]bool{
+		"api.github.com": true,
+		"github.com":     false,
+		"evilgithub.com": false,
+		"pypi.org":       true,
+		"PYPI.ORG.":      true,
+		"x.pypi.org":     false,
+	}
+	for name, want := range tests {
+		if got := e.allowedDomain(name); got != want {
+			t.Errorf("allowedDomain(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestEgressRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		reply   *layers.DNS
+		allowed []string
+		denied  []string
+	}{
+		{
+			name:    "answer of the question",
+			query:   "pypi.org",
+			reply:   dnsReply(1, "pypi.org", answerA("pypi.org", "192.0.2.1")),
+			allowed: []string{"192.0.2.1"},
+		},
+		{
+			name:   "domain not allowed",
+			query:  "evil.com",
+			reply:  dnsReply(1, "evil.com", answerA("evil.com", "192.0.2.1")),
+			denied: []string{"192.0.2.1"},
+		},
+		{
+			name:    "cname chain out of order",
+			query:   "pypi.org",
+			reply:   dnsReply(1, "pypi.org", answerA("b.cdn.net", "192.0.2.2"), answerCNAME("a.cdn.net", "b.cdn.net"), answerCNAME("pypi.org", "a.cdn.net")),
+			allowed: []string{"192.0.2.2"},
+		},
+		{
+			name:    "answer owned by another name",
+			query:   "pypi.org",
+			reply:   dnsReply(1, "pypi.org", answerA("pypi.org", "192.0.2.1"), answerA("evil.com", "192.0.2.66")),
+			allowed: []string{"192.0.2.1"},
+			denied:  []string{"192.0.2.66"},
+		},
+		{
+			name:   "cname of another name",
+			query:  "pypi.org",
+			reply:  dnsReply(1, "pypi.org", answerCNAME("evil.com", "cdn.net"), answerA("cdn.net", "192.0.2.66")),
+			denied: []string{"192.0.2.66"},
+		},
+		{
+			name:   "reply to another question",
+			query:  "pypi.org",
+			reply:  dnsReply(1, "evil.com", answerA("evil.com", "192.0.2.66")),
+			denied: []string{"192.0.2.66"},
+		},
+		{
+			name:  "error response",
+			query: "pypi.org",
+			reply: func() *layers.DNS {
+				msg := dnsReply(1, "pypi.org", answerA("pypi.org", "192.0.2.1"))
+				msg.ResponseCode = layers.DNSResponseCodeServFail
+				return msg
+			}(),
+			denied: []string{"192.0.2.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEgressPolicy([]string{"pypi.org"})
+			e.record(tt.query, tt.reply)
+
+			for _, addr := range tt.allowed {
+				if !e.allowedIP(netaddr.MustParseIP(addr)) {
+					t.Errorf("%s not allowed", addr)
+				}
+			}
+			for _, addr := range tt.denied {
+				if e.allowedIP(netaddr.MustParseIP(addr)) {
+					t.Errorf("%s allowed", addr)
+				}
+			}
+		})
+	}
+}
+
+func TestEgressPendingQueries(t *testing.T) {
+	e := newEgressPolicy([]string{"pypi.org"})
+	key := dnsQueryKey{vm: netaddr.MustParseIPPort("192.168.64.2:5353"), server: netaddr.MustParseIP("192.168.64.1"), id: 7}
+
+	e.expect(key, "evil.com")
+	if _, ok := e.answered(key); ok {
+		t.Fatal("query of a domain not allowed is pending")
+	}
+
+	e.expect(key, "PyPI.org.")
+	other := key
+	other.server = netaddr.MustParseIP("10.0.0.53")
+	if _, ok := e.answered(other); ok {
+		t.Fatal("reply of another server accepted")
+	}
+	if name, ok := e.answered(key); !ok || name != "pypi.org" {
+		t.Fatalf("got %q, %v, want pypi.org", name, ok)
+	}
+	if _, ok := e.answered(key); ok {
+		t.Fatal("query answered twice")
+	}
+
+	e.expect(key, "pypi.org")
+	e.pending[key] = pendingDNSQuery{name: "pypi.org", expiry: time.Now().Add(-time.Second)}
+	if _, ok := e.answered(key); ok {
+		t.Fatal("expired query answered")
+	}
+}
+
+func TestEgressPrune(t *testing.T) {
+	e := newEgressPolicy([]string{"pypi.org"})
+	past := time.Now().Add(-time.Second)
+	for i := 0; i < 10; i++ {
+		e.resolved[netaddr.IPv4(192, 0, 2, byte(i))] = past
+		e.pending[dnsQueryKey{id: uint16(i)}] = pendingDNSQuery{name: "pypi.org", expiry: past}
+	}
+
+	e.record("pypi.org", dnsReply(1, "pypi.org", answerA("pypi.org", "198.51.100.1")))
+
+	if len(e.resolved) != 1 || len(e.pending) != 0 {
+		t.Fatalf("got %d addresses and %d queries after pruning, want 1 and 0", len(e.resolved), len(e.pending))
+	}
+}
+
+// The stack learns from the replies to the VM's queries only
+func TestEgressLearnsOwnQueries(t *testing.T) {
+	gatewayMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	forger := net.IPv4(10, 0, 0, 53).To4()
+
+	replyFrame := func(t *testing.T, server, vm net.IP, vmPort uint16, msg *layers.DNS) []byte {
+		t.Helper()
+
+		payload, err := serializeDNS(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eth := &layers.Ethernet{SrcMAC: gatewayMAC, DstMAC: testVMMAC, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: server, DstIP: vm}
+		udp := &layers.UDP{SrcPort: 53, DstPort: layers.UDPPort(vmPort)}
+		_ = udp.SetNetworkLayerForChecksum(ip)
+		return serializeFrame(t, eth, ip, udp, gopacket.Payload(payload))
+	}
+
+	tests := []struct {
+		name   string
+		server net.IP
+		port   uint16
+		id     uint16
+		want   bool
+	}{
+		{name: "reply of the server", server: testGateway, port: 5353, id: 7, want: true},
+		{name: "forged by another host", server: forger, port: 5353, id: 7},
+		{name: "unknown query id", server: testGateway, port: 5353, id: 8},
+		{name: "another port of the VM", server: testGateway, port: 5354, id: 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, vm := runTestStack(t, NetworkParams{AllowedDomains: []string{"pypi.org"}})
+			addr := leaseTestVM(t, vm)
+			port := s.sw.primary()
+
+			packet := frame.NewParser()
+			if !packet.Decode(udpFrame(t, addr, testGateway, 5353, 53, dnsQuery(t, 7, "pypi.org"))) {
+				t.Fatal("undecodable query")
+			}
+			s.expectDNSReply(port, packet)
+
+			reply := dnsReply(tt.id, "pypi.org", answerA("pypi.org", "192.0.2.1"))
+			s.writeConn(outbox{}, packet, replyFrame(t, tt.server, addr, tt.port, reply))
+
+			if got := s.allowEgress(netaddr.MustParseIP("192.0.2.1")); got != tt.want {
+				t.Errorf("got allowed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
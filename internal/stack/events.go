@@ -0,0 +1,380 @@
+// nolint:godot
+package stack
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+)
+
+const (
+	// How often the leases are checked for expiry
+	leaseCheckInterval = time.Second
+	// A VM's spoofed frames are reported at most this often, the frames in between are counted
+	spoofEventInterval = time.Second
+	// A VM's dropped frames are reported at most this often, the frames in between are counted
+	dropEventInterval = time.Second
+	// How often the drops of the backend's queue are reported
+	queueDropInterval = time.Second
+)
+
+// The reasons of the frames dropped by the backend's queue, see queue-policy
+var (
+	errQueueDroppedTail = errors.New("backend queue full, the new frame was dropped")
+	errQueueDroppedHead = errors.New("backend queue full, the oldest frame was dropped")
+	errQueueTimedOut    = errors.New("backend queue full, timed out waiting for room")
+)
+
+// EventKind tells what happened to a VM
+type EventKind string
+
+const (
+	// The VM's first dhcp request was acknowledged, or the previous lease had expired
+	EventLeaseAcquired EventKind = "lease-acquired"
+	// The VM renewed its lease, its address is the same
+	EventLeaseRenewed EventKind = "lease-renewed"
+	// The VM didn't renew its lease in time
+	EventLeaseExpired EventKind = "lease-expired"
+	// The VM was acknowledged a different address, while its previous lease was still valid
+	EventAddrChanged EventKind = "addr-changed"
+	// The VM sent frames from an address which isn't its own
+	EventSpoofBlocked EventKind = "spoof-blocked"
+	// Frames sent to the VM were dropped, by its socket or by the backend's queue
+	EventDrop EventKind = "drop"
+	// The backend failed, it's restarted if the failure is transient
+	EventBackendError EventKind = "backend-error"
+	// The VM closed its end of the socket
+	EventSocketClosed EventKind = "socket-closed"
+)
+
+// Lease is the dhcp lease acknowledged to a VM
+type Lease struct {
+	// Address of the VM
+	Addr netaddr.IP
+	// Default gateway
+	Router netaddr.IP
+	// DNS servers
+	DNSServers []netaddr.IP
+	// The dhcp server which acknowledged the lease
+	Server netaddr.IP
+	// The lease expires at, unless the VM renews it
+	ValidUntil time.Time
+}
+
+// Event is emitted to the Observer of the stack
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	// MAC address of the VM, not set by EventBackendError, and the EventDrop
+	// of the backend's queue, as the frames weren't switched yet
+	HardwareAddr net.HardwareAddr
+
+	// The lease, set by the lease events and EventAddrChanged
+	Lease Lease
+	// The previous address of the VM, set by EventAddrChanged
+	PrevAddr netaddr.IP
+	// Source addresses of the spoofed frame, set by EventSpoofBlocked.
+	// SpoofedAddr is only set for ipv4 and ARP frames.
+	SpoofedMAC  net.HardwareAddr
+	SpoofedAddr netaddr.IP
+	// Number of frames dropped, set by EventDrop and EventSpoofBlocked
+	Dropped int
+	// The reason of the drop, or the error of the backend
+	Err error
+}
+
+// Observer is notified about the events of the stack. Observe is called
+// from the datapath, it must return quickly, and mustn't retain the event's slices.
+type Observer interface {
+	Observe(e Event)
+}
+
+// ObserverFunc adapts a function to an Observer
+type ObserverFunc func(e Event)
+
+// Observe calls f(e)
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+// Notify the observer, if there's one
+func (s *Stack) emit(e Event) {
+	if s.Observer == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	s.Observer.Observe(e)
+}
+
+// The kind of the event of a lease acknowledged to the VM, given its lease before the ack
+func leaseEvent(before, after Lease, now time.Time) EventKind {
+	if before.Addr.IsZero() || now.After(before.ValidUntil) {
+		return EventLeaseAcquired
+	}
+	if before.Addr != after.Addr {
+		return EventAddrChanged
+	}
+	return EventLeaseRenewed
+}
+
+// Emit the expiry of the VMs' leases, until the intake is stopped
+func (s *Stack) watchLeases(w *workers) {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.intake.Done():
+			return
+		case now := <-ticker.C:
+			for _, port := range s.sw.ports {
+				if lease, ok := port.dm.expired(now); ok && !port.closed.Load() {
+					s.emit(Event{Kind: EventLeaseExpired, HardwareAddr: port.HardwareAddr, Lease: lease})
+				}
+			}
+		}
+	}
+}
+
+// Emit the frames dropped by the backend's queue every queueDropInterval, until the intake is stopped
+func (s *Stack) watchQueue(w *workers) {
+	ticker := time.NewTicker(queueDropInterval)
+	defer ticker.Stop()
+
+	prev := s.backend.QueueStats()
+	for {
+		select {
+		case <-w.intake.Done():
+			return
+		case <-ticker.C:
+			stats := s.backend.QueueStats()
+			for _, e := range queueDropEvents(prev, stats) {
+				s.emit(e)
+			}
+			prev = stats
+		}
+	}
+}
+
+// An event per reason the backend's queue dropped frames for, since the prev stats
+func queueDropEvents(prev, stats backpressure.Stats) []Event {
+	var events []Event
+	for _, drop := range []struct {
+		prev, now uint64
+		err       error
+	}{
+		{prev.DroppedTail, stats.DroppedTail, errQueueDroppedTail},
+		{prev.DroppedHead, stats.DroppedHead, errQueueDroppedHead},
+		{prev.TimedOut, stats.TimedOut, errQueueTimedOut},
+	} {
+		if drop.now > drop.prev {
+			events = append(events, Event{Kind: EventDrop, Dropped: int(drop.now - drop.prev), Err: drop.err})
+		}
+	}
+	return events
+}
+
+// Counts the frames of a VM's events, which are emitted at most once an interval
+type eventLimiter struct {
+	// Frames not reported yet, and the time of the last report in unix nanoseconds
+	pending    atomic.Int64
+	reportedAt atomic.Int64
+}
+
+// Count n frames. Returns the frames to report, or false if the last
+// event was emitted within interval.
+func (l *eventLimiter) count(n int, interval time.Duration) (int, bool) {
+	pending := l.pending.Add(int64(n))
+	now := time.Now().UnixNano()
+	last := l.reportedAt.Load()
+	if now-last < int64(interval) || !l.reportedAt.CompareAndSwap(last, now) {
+		return 0, false
+	}
+	l.pending.Add(-pending)
+	return int(pending), true
+}
+
+// Count the spoofed frame of the VM, and emit an event at most every spoofEventInterval
+func (s *Stack) spoofBlocked(port *vmPort, mac net.HardwareAddr, addr netaddr.IP) {
+	if s.Observer == nil {
+		return
+	}
+
+	dropped, ok := port.spoofs.count(1, spoofEventInterval)
+	if !ok {
+		return
+	}
+
+	s.emit(Event{
+		Kind:         EventSpoofBlocked,
+		HardwareAddr: port.HardwareAddr,
+		SpoofedMAC:   append(net.HardwareAddr(nil), mac...),
+		SpoofedAddr:  addr,
+		Dropped:      dropped,
+	})
+}
+
+// Count the frames dropped on the way to the VM, and emit an event at most every dropEventInterval
+func (s *Stack) droppedTo(port *vmPort, n int, err error) {
+	s.droppedToVM.Add(uint64(n))
+	if s.Observer == nil {
+		return
+	}
+
+	dropped, ok := port.drops.count(n, dropEventInterval)
+	if !ok {
+		return
+	}
+
+	s.emit(Event{Kind: EventDrop, HardwareAddr: port.HardwareAddr, Dropped: dropped, Err: err})
+}
+
+// JSON representation of an event, the unset fields are left out
+type jsonEvent struct {
+	Time        time.Time  `json:"time"`
+	Kind        EventKind  `json:"event"`
+	MAC         string     `json:"mac,omitempty"`
+	Addr        string     `json:"addr,omitempty"`
+	Router      string     `json:"router,omitempty"`
+	DNSServers  []string   `json:"dns_servers,omitempty"`
+	ValidUntil  *time.Time `json:"valid_until,omitempty"`
+	PrevAddr    string     `json:"prev_addr,omitempty"`
+	SpoofedMAC  string     `json:"spoofed_mac,omitempty"`
+	SpoofedAddr string     `json:"spoofed_addr,omitempty"`
+	Dropped     int        `json:"dropped,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes the event as a flat object, e.g.
+// {"time":"...","event":"lease-acquired","mac":"5e:8b:78:73:78:14","addr":"192.168.64.2",...}
+func (e Event) MarshalJSON() ([]byte, error) {
+	out := jsonEvent{
+		Time:       e.Time,
+		Kind:       e.Kind,
+		MAC:        e.HardwareAddr.String(),
+		Addr:       ipString(e.Lease.Addr),
+		Router:     ipString(e.Lease.Router),
+		PrevAddr:   ipString(e.PrevAddr),
+		SpoofedMAC: e.SpoofedMAC.String(),
+		Dropped:    e.Dropped,
+	}
+	if !e.SpoofedAddr.IsZero() {
+		out.SpoofedAddr = e.SpoofedAddr.String()
+	}
+	for _, server := range e.Lease.DNSServers {
+		out.DNSServers = append(out.DNSServers, server.String())
+	}
+	if !e.Lease.ValidUntil.IsZero() {
+		out.ValidUntil = &e.Lease.ValidUntil
+	}
+	if e.Err != nil {
+		out.Error = e.Err.Error()
+	}
+	return json.Marshal(out)
+}
+
+// Returns the address, or an empty string if it's not set
+func ipString(ip netaddr.IP) string {
+	if ip.IsZero() {
+		return ""
+	}
+	return ip.String()
+}
+
+// JSONObserver writes the events as JSON lines. The events are written by its own
+// goroutine, so that a slow writer doesn't hold up the datapath: the events beyond
+// jsonObserverDepth waiting to be written are dropped.
+type JSONObserver struct {
+	enc    *json.Encoder
+	events chan Event
+	done   chan struct{}
+	// The first failed write, returned by Close
+	err error
+
+	dropped atomic.Uint64
+	// Set once the observer is closed, guards events
+	closed bool
+	m      sync.RWMutex
+}
+
+// Events waiting to be written by a JSONObserver
+const jsonObserverDepth = 1024
+
+// NewJSONObserver returns an observer writing the events to w, one JSON object per line.
+// It must be closed once the stack stopped.
+func NewJSONObserver(w io.Writer) *JSONObserver {
+	o := &JSONObserver{
+		enc:    json.NewEncoder(w),
+		events: make(chan Event, jsonObserverDepth),
+		done:   make(chan struct{}),
+	}
+	go o.writeEvents()
+	return o
+}
+
+// Observe queues the event to be written, or drops it if the queue is full
+func (o *JSONObserver) Observe(e Event) {
+	// The event is retained until it's written, unlike the slices of the caller
+	e.HardwareAddr = slices.Clone(e.HardwareAddr)
+	e.SpoofedMAC = slices.Clone(e.SpoofedMAC)
+	e.Lease.DNSServers = slices.Clone(e.Lease.DNSServers)
+
+	o.m.RLock()
+	defer o.m.RUnlock()
+	if o.closed {
+		o.dropped.Add(1)
+		return
+	}
+
+	select {
+	case o.events <- e:
+	default:
+		o.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of events dropped, because the writer fell behind
+func (o *JSONObserver) Dropped() uint64 {
+	return o.dropped.Load()
+}
+
+// Close writes the events already queued, and returns the first failed write.
+// The events observed afterwards are dropped.
+func (o *JSONObserver) Close() error {
+	o.m.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.events)
+	}
+	o.m.Unlock()
+
+	<-o.done
+	if dropped := o.Dropped(); dropped > 0 {
+		log.Warn().Uint64("dropped", dropped).Msg("events dropped")
+	}
+	return o.err
+}
+
+// Write the events until the observer is closed
+func (o *JSONObserver) writeEvents() {
+	defer close(o.done)
+
+	for e := range o.events {
+		if err := o.enc.Encode(e); err != nil {
+			log.Error().Err(err).Msg("writing event")
+			if o.err == nil {
+				o.err = err
+			}
+		}
+	}
+}
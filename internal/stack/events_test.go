@@ -0,0 +1,144 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+)
+
+func TestQueueDropEvents(t *testing.T) {
+	prev := backpressure.Stats{Queued: 10, DroppedTail: 1, DroppedHead: 2, TimedOut: 3}
+
+	tests := []struct {
+		name  string
+		stats backpressure.Stats
+		want  []Event
+	}{
+		{name: "nothing dropped", stats: backpressure.Stats{Queued: 20, DroppedTail: 1, DroppedHead: 2, TimedOut: 3}},
+		{
+			name:  "dropped tail",
+			stats: backpressure.Stats{Queued: 20, DroppedTail: 5, DroppedHead: 2, TimedOut: 3},
+			want:  []Event{{Kind: EventDrop, Dropped: 4, Err: errQueueDroppedTail}},
+		},
+		{
+			name:  "every reason",
+			stats: backpressure.Stats{Queued: 20, DroppedTail: 2, DroppedHead: 4, TimedOut: 6, Prioritized: 2},
+			want: []Event{
+				{Kind: EventDrop, Dropped: 1, Err: errQueueDroppedTail},
+				{Kind: EventDrop, Dropped: 2, Err: errQueueDroppedHead},
+				{Kind: EventDrop, Dropped: 3, Err: errQueueTimedOut},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queueDropEvents(prev, tt.stats); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A writer blocked until release is closed
+type blockedWriter struct {
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+type failingWriter struct{}
+
+var errTestWrite = errors.New("write failed")
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errTestWrite }
+
+func TestJSONObserver(t *testing.T) {
+	var buf bytes.Buffer
+	o := NewJSONObserver(&buf)
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	o.Observe(Event{Kind: EventSocketClosed, HardwareAddr: mac})
+	// The caller's slices aren't retained
+	mac[5] = 2
+	o.Observe(Event{Kind: EventDrop, HardwareAddr: mac, Dropped: 3})
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"mac":"02:00:00:00:00:01"`) || !strings.Contains(lines[1], `"dropped":3`) {
+		t.Fatalf("got %q", lines)
+	}
+
+	// Dropped once closed
+	o.Observe(Event{Kind: EventSocketClosed})
+	if got := o.Dropped(); got != 1 {
+		t.Errorf("got %d dropped, want 1", got)
+	}
+	if err := o.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Observe doesn't wait for a slow writer, the events it can't keep up with are dropped
+func TestJSONObserverSlowWriter(t *testing.T) {
+	w := &blockedWriter{release: make(chan struct{})}
+	o := NewJSONObserver(w)
+
+	// One event is being written, jsonObserverDepth are queued
+	const observed = jsonObserverDepth + 11
+	for i := 0; i < observed; i++ {
+		o.Observe(Event{Kind: EventSocketClosed})
+	}
+	if got := o.Dropped(); got < 10 || got > 11 {
+		t.Errorf("got %d dropped, want 10 or 11", got)
+	}
+
+	close(w.release)
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := uint64(strings.Count(w.buf.String(), "\n")), observed-o.Dropped(); got != want {
+		t.Errorf("got %d events written, want %d", got, want)
+	}
+}
+
+func TestJSONObserverWriteFailed(t *testing.T) {
+	o := NewJSONObserver(failingWriter{})
+	o.Observe(Event{Kind: EventSocketClosed})
+	if err := o.Close(); !errors.Is(err, errTestWrite) {
+		t.Errorf("got %v, want %v", err, errTestWrite)
+	}
+}
+
+// The drops of a VM are reported at most every dropEventInterval, the frames in between are counted
+func TestDropEventsLimited(t *testing.T) {
+	s, port := newTestStack(t, nil)
+	var events []Event
+	s.Observer = ObserverFunc(func(e Event) { events = append(events, e) })
+
+	for i := 0; i < 3; i++ {
+		s.droppedTo(port, 2, errTestWrite)
+	}
+	// The next interval
+	port.drops.reportedAt.Add(-int64(dropEventInterval))
+	s.droppedTo(port, 1, errTestWrite)
+
+	if len(events) != 2 || events[0].Dropped != 2 || events[1].Dropped != 5 {
+		t.Errorf("got %+v, want 2 then 5 frames dropped", events)
+	}
+	if got := s.Stats().DroppedToVM; got != 7 {
+		t.Errorf("got %d frames dropped, want 7", got)
+	}
+}
@@ -0,0 +1,294 @@
+// nolint:exhaustivestruct,exhaustruct,godot
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+)
+
+const (
+	// Host address of the port forwards, if not specified otherwise
+	defaultForwardHost = "127.0.0.1"
+	// Time to wait for the VM to accept a forwarded connection
+	forwardDialTimeout = 10 * time.Second
+	// Forwarded UDP flows without traffic from the client are closed after this period
+	forwardUDPIdleTimeout = 90 * time.Second
+)
+
+var (
+	errInvalidPortForward = errors.New("expected [tcp/|udp/][host_ip:]host_port:vm_port port forward")
+	errNoLease            = errors.New("the VM has no address yet")
+)
+
+// PortForward exposes a port of the VM on the host, e.g. 127.0.0.1:2222 -> vm:22.
+// The forward always targets the first VM's current leased address.
+type PortForward struct {
+	// tcp or udp
+	Network string
+	// Host address to listen on, in host:port format
+	HostAddr string
+	// Port of the VM the traffic is forwarded to
+	VMPort uint16
+}
+
+// ParsePortForward parses a [tcp/|udp/][host_ip:]host_port:vm_port port forward.
+// The default network is tcp, the default host address is 127.0.0.1.
+func ParsePortForward(spec string) (PortForward, error) {
+	network := "tcp"
+	if proto, rest, ok := strings.Cut(spec, "/"); ok {
+		network, spec = proto, rest
+	}
+	if network != "tcp" && network != "udp" {
+		return PortForward{}, fmt.Errorf("%w: %s", errInvalidPortForward, spec)
+	}
+
+	i := strings.LastIndexByte(spec, ':')
+	if i < 0 {
+		return PortForward{}, fmt.Errorf("%w: %s", errInvalidPortForward, spec)
+	}
+	hostPart, vmPart := spec[:i], spec[i+1:]
+
+	vmPort, err := strconv.ParseUint(vmPart, 10, 16)
+	if err != nil || vmPort == 0 {
+		return PortForward{}, fmt.Errorf("%w: %s", errInvalidPortForward, spec)
+	}
+
+	host, hostPort := defaultForwardHost, hostPart
+	if j := strings.LastIndexByte(hostPart, ':'); j >= 0 {
+		host, hostPort = strings.Trim(hostPart[:j], "[]"), hostPart[j+1:]
+	}
+	// An empty host would listen on every interface, a zero port on a random one
+	if port, err := strconv.ParseUint(hostPort, 10, 16); err != nil || port == 0 || host == "" {
+		return PortForward{}, fmt.Errorf("%w: %s", errInvalidPortForward, spec)
+	}
+
+	return PortForward{
+		Network:  network,
+		HostAddr: net.JoinHostPort(host, hostPort),
+		VMPort:   uint16(vmPort),
+	}, nil
+}
+
+func (f PortForward) String() string {
+	return fmt.Sprintf("%s/%s -> vm:%d", f.Network, f.HostAddr, f.VMPort)
+}
+
+// vmDialer is implemented by the backends, which can reach the VM only from the inside,
+// e.g. the userspace backend. The VM is dialed through the host's network otherwise.
+type vmDialer interface {
+	DialVM(ctx context.Context, network string, addr netaddr.IPPort) (net.Conn, error)
+}
+
+// Open a connection to the given port of the VM's current address
+func (s *Stack) dialVM(ctx context.Context, network string, port uint16) (net.Conn, error) {
+	addr, ok := s.sw.primary().dm.leasedAddr()
+	if !ok {
+		return nil, errNoLease
+	}
+	target := netaddr.IPPortFrom(addr, port)
+
+	ctx, cancel := context.WithTimeout(ctx, forwardDialTimeout)
+	defer cancel()
+
+	if dialer, ok := s.backend.(vmDialer); ok {
+		return dialer.DialVM(ctx, network, target)
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, target.String())
+}
+
+// Listen on the host addresses of the port forwards. The listeners and the forwarded
+// connections are closed once ctx is done, their goroutines are joined by the tasks of w.
+func (s *Stack) startPortForwards(ctx context.Context, w *workers) error {
+	for _, forward := range s.PortForwards {
+		var err error
+		switch forward.Network {
+		case "udp":
+			err = s.forwardUDP(ctx, w, forward)
+		default:
+			err = s.forwardTCP(ctx, w, forward)
+		}
+		if err != nil {
+			return fmt.Errorf("forwarding %s: %w", forward, err)
+		}
+		log.Debug().Msgf("forwarding %s", forward)
+	}
+	return nil
+}
+
+func (s *Stack) forwardTCP(ctx context.Context, w *workers, forward PortForward) error {
+	ln, err := net.Listen("tcp", forward.HostAddr)
+	if err != nil {
+		return err
+	}
+
+	w.run(&w.tasks, func() {
+		<-ctx.Done()
+		ln.Close()
+	})
+
+	w.run(&w.tasks, func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Error().Err(err).Msgf("accepting %s", forward)
+				}
+				return
+			}
+
+			w.run(&w.tasks, func() {
+				vm, err := s.dialVM(ctx, "tcp", forward.VMPort)
+				if err != nil {
+					log.Error().Err(err).Msgf("dialing %s", forward)
+					client.Close()
+					return
+				}
+
+				stop := context.AfterFunc(ctx, func() {
+					client.Close()
+					vm.Close()
+				})
+				defer stop()
+				pipe(client, vm)
+			})
+		}
+	})
+
+	return nil
+}
+
+// udpSession is a forwarded UDP flow of a single client
+type udpSession struct {
+	vm net.Conn
+	// The VM address the session was opened to
+	addr netaddr.IP
+}
+
+func (s *Stack) forwardUDP(ctx context.Context, w *workers, forward PortForward) error {
+	pc, err := net.ListenPacket("udp", forward.HostAddr)
+	if err != nil {
+		return err
+	}
+
+	w.run(&w.tasks, func() {
+		<-ctx.Done()
+		pc.Close()
+	})
+
+	w.run(&w.tasks, func() {
+		sessions := make(map[string]*udpSession)
+		var m sync.Mutex
+
+		// Stops the replies of the sessions, once the listener is closed
+		defer func() {
+			m.Lock()
+			for _, session := range sessions {
+				session.vm.Close()
+			}
+			m.Unlock()
+		}()
+
+		buf := make([]byte, 65535)
+		for {
+			n, client, err := pc.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Error().Err(err).Msgf("reading %s", forward)
+				}
+				return
+			}
+
+			addr, ok := s.sw.primary().dm.leasedAddr()
+			if !ok {
+				continue
+			}
+
+			m.Lock()
+			session, ok := sessions[client.String()]
+			// Follow the VM to its new address
+			if ok && session.addr != addr {
+				session.vm.Close()
+				ok = false
+			}
+			if !ok {
+				vm, err := s.dialVM(ctx, "udp", forward.VMPort)
+				if err != nil {
+					m.Unlock()
+					log.Error().Err(err).Msgf("dialing %s", forward)
+					continue
+				}
+				session = &udpSession{vm: vm, addr: addr}
+				sessions[client.String()] = session
+
+				w.run(&w.tasks, func() {
+					replyUDP(pc, client, session.vm)
+					m.Lock()
+					if sessions[client.String()] == session {
+						delete(sessions, client.String())
+					}
+					m.Unlock()
+				})
+			}
+			m.Unlock()
+
+			_ = session.vm.SetReadDeadline(time.Now().Add(forwardUDPIdleTimeout))
+			if _, err := session.vm.Write(buf[:n]); err != nil {
+				log.Debug().Err(err).Msgf("writing %s", forward)
+			}
+		}
+	})
+
+	return nil
+}
+
+// Send the VM's datagrams back to the client, until the session is closed or idle
+func replyUDP(pc net.PacketConn, client net.Addr, vm net.Conn) {
+	defer vm.Close()
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := vm.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := pc.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Copies data between the conns in both directions, half-closing
+// each side once the other one is done sending
+func pipe(a net.Conn, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
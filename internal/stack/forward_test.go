@@ -0,0 +1,194 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestParsePortForward(t *testing.T) {
+	tests := []struct {
+		spec string
+		want PortForward
+		err  bool
+	}{
+		{spec: "2222:22", want: PortForward{Network: "tcp", HostAddr: "127.0.0.1:2222", VMPort: 22}},
+		{spec: "tcp/0.0.0.0:8080:80", want: PortForward{Network: "tcp", HostAddr: "0.0.0.0:8080", VMPort: 80}},
+		{spec: "udp/5353:53", want: PortForward{Network: "udp", HostAddr: "127.0.0.1:5353", VMPort: 53}},
+		{spec: "[::1]:8080:80", want: PortForward{Network: "tcp", HostAddr: "[::1]:8080", VMPort: 80}},
+		{spec: "udp/[fe80::1%en0]:5353:53", want: PortForward{Network: "udp", HostAddr: "[fe80::1%en0]:5353", VMPort: 53}},
+		{spec: "sctp/8080:80", err: true},
+		{spec: "TCP/8080:80", err: true},
+		{spec: "8080", err: true},
+		{spec: "tcp/", err: true},
+		{spec: "8080:", err: true},
+		{spec: ":80", err: true},
+		{spec: ":8080:80", err: true},
+		{spec: "[]:8080:80", err: true},
+		{spec: "70000:80", err: true},
+		{spec: "8080:70000", err: true},
+		{spec: "8080:-1", err: true},
+		{spec: "0:80", err: true},
+		{spec: "8080:0", err: true},
+		{spec: "ssh:22", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParsePortForward(tt.spec)
+			if tt.err {
+				if !errors.Is(err, errInvalidPortForward) {
+					t.Errorf("got %+v, %v, want %v", got, err, errInvalidPortForward)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// dialingBackend connects the forwards to echo, and reports the VM addresses they were dialed to
+type dialingBackend struct {
+	discardBackend
+	echo   map[string]string
+	dialed chan netaddr.IPPort
+}
+
+func (b dialingBackend) DialVM(ctx context.Context, network string, addr netaddr.IPPort) (net.Conn, error) {
+	b.dialed <- addr
+	var d net.Dialer
+	return d.DialContext(ctx, network, b.echo[network])
+}
+
+// Echoes the TCP streams and UDP datagrams sent to it, until the test ends
+func runEchoServers(t *testing.T) map[string]string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return map[string]string{"tcp": ln.Addr().String(), "udp": pc.LocalAddr().String()}
+}
+
+var errNoEcho = errors.New("no echo")
+
+// Sends a ping through the forward, and reads its echo
+func pingForward(client net.Conn, timeout time.Duration) error {
+	_ = client.SetDeadline(time.Now().Add(timeout))
+	if _, err := client.Write([]byte("ping")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		return err
+	}
+	if string(buf) != "ping" {
+		return errNoEcho
+	}
+	return nil
+}
+
+// The forwards dial the VM's current address, and the UDP sessions move along once it changes
+func TestPortForwardFollowsLease(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			hostAddr := freeUDPAddr(t)
+			if network == "tcp" {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				hostAddr = ln.Addr().String()
+				ln.Close()
+			}
+
+			b := dialingBackend{echo: runEchoServers(t), dialed: make(chan netaddr.IPPort, 16)}
+			s, _, stop := startTestStack(t, NetworkParams{
+				CustomBackend: b,
+				PortForwards:  []PortForward{{Network: network, HostAddr: hostAddr, VMPort: 22}},
+			})
+			t.Cleanup(func() { _ = stop() })
+
+			var client net.Conn
+			for i, addr := range []string{"192.168.64.2", "192.168.64.3"} {
+				dm := &s.sw.primary().dm
+				dm.m.Lock()
+				dm.lease = lease{addr: netaddr.MustParseIP(addr), validUntil: time.Now().Add(time.Hour)}
+				dm.m.Unlock()
+
+				// A new TCP connection for each address, the UDP client sends from the same port.
+				// The forwards might not be listening yet at first.
+				if i == 0 || network == "tcp" {
+					eventually(t, func() bool {
+						if client != nil {
+							client.Close()
+						}
+						var err error
+						if client, err = net.Dial(network, hostAddr); err != nil {
+							return false
+						}
+						return network == "tcp" || pingForward(client, 50*time.Millisecond) == nil
+					})
+					defer client.Close()
+				}
+				if network == "tcp" || i > 0 {
+					if err := pingForward(client, 5*time.Second); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				// A retried probe might have dialed the VM more than once
+				if len(b.dialed) == 0 {
+					t.Fatalf("%s not dialed", addr)
+				}
+				for len(b.dialed) > 0 {
+					if got, want := <-b.dialed, netaddr.IPPortFrom(netaddr.MustParseIP(addr), 22); got != want {
+						t.Errorf("dialed %s, want %s", got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+// nolint:godot
+package stack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// How long the fragments of a datagram are tracked after the first one arrived, like Linux's ipfrag_time
+	fragmentTimeout = 30 * time.Second
+	// Fragmented datagrams of a VM tracked at the same time, the first fragments beyond are dropped
+	maxFragmentedDatagrams = 64
+	// Fragments of a VM held until their first fragment arrives, the ones beyond are dropped
+	maxHeldFragments = 64
+
+	udpHeaderLen  = 8
+	tcpHeaderLen  = 20
+	icmpHeaderLen = 8
+)
+
+// Identifies the fragments of a datagram (RFC 791)
+type fragmentKey struct {
+	src, dst [4]byte
+	protocol layers.IPProtocol
+	id       uint16
+}
+
+func newFragmentKey(ip *layers.IPv4) fragmentKey {
+	return fragmentKey{
+		src:      [4]byte(ip.SrcIP),
+		dst:      [4]byte(ip.DstIP),
+		protocol: ip.Protocol,
+		id:       ip.Id,
+	}
+}
+
+// The bytes from start to end of a datagram
+type fragmentRange struct {
+	start, end int
+}
+
+// A fragmented datagram of a VM
+type fragmentedDatagram struct {
+	expiry time.Time
+	// Set once the first fragment arrived, with its verdict
+	decided, allowed bool
+	// The ranges of the datagram received, neither overlapping nor adjacent
+	received []fragmentRange
+	// Length of the datagram, known once its last fragment arrived
+	size int
+	// Copies of the fragments arrived before the first one
+	held [][]byte
+}
+
+// Add the fragment's range to the ones received, merging the ranges it overlaps or touches
+func (d *fragmentedDatagram) receive(start, end int, last bool) {
+	if last {
+		d.size = end
+	}
+
+	merged := fragmentRange{start: start, end: end}
+	ranges := d.received[:0]
+	for _, r := range d.received {
+		if r.end < merged.start || merged.end < r.start {
+			ranges = append(ranges, r)
+			continue
+		}
+		merged = fragmentRange{start: min(merged.start, r.start), end: max(merged.end, r.end)}
+	}
+	d.received = append(ranges, merged)
+}
+
+// Determine if every fragment of the datagram arrived
+func (d *fragmentedDatagram) complete() bool {
+	return d.size > 0 && len(d.received) == 1 && d.received[0].start == 0 && d.received[0].end >= d.size
+}
+
+// Verdict of a fragment following the first one
+type fragmentVerdict int
+
+const (
+	fragmentDropped fragmentVerdict = iota
+	fragmentAllowed
+	// Held until the verdict of its first fragment
+	fragmentHeld
+)
+
+// fragmentTracker remembers the fragmented datagrams of a VM, until all of their
+// fragments arrived, or fragmentTimeout. Only the first fragment carries the transport
+// header, the rest of the fragments inherit its verdict. The zero value is ready to use.
+type fragmentTracker struct {
+	datagrams map[fragmentKey]*fragmentedDatagram
+	// Fragments held by the datagrams
+	held int
+	// Held fragments dropped, because their first fragment wasn't allowed, or didn't arrive in time
+	discarded atomic.Uint64
+	m         sync.Mutex
+}
+
+// Returns the datagram of the key, a new one if it's not tracked yet.
+// Returns nil if there are too many datagrams already.
+func (t *fragmentTracker) datagram(key fragmentKey, now time.Time) *fragmentedDatagram {
+	if t.datagrams == nil {
+		t.datagrams = make(map[fragmentKey]*fragmentedDatagram)
+	}
+
+	if d, ok := t.datagrams[key]; ok {
+		if !now.After(d.expiry) {
+			return d
+		}
+		t.forget(key, d)
+	}
+
+	if len(t.datagrams) >= maxFragmentedDatagrams {
+		t.expire(now)
+	}
+	if len(t.datagrams) >= maxFragmentedDatagrams {
+		return nil
+	}
+
+	d := &fragmentedDatagram{expiry: now.Add(fragmentTimeout)}
+	t.datagrams[key] = d
+	return d
+}
+
+// Forget the expired datagrams
+func (t *fragmentTracker) expire(now time.Time) {
+	for key, d := range t.datagrams {
+		if now.After(d.expiry) {
+			t.forget(key, d)
+		}
+	}
+}
+
+// Forget the datagram, and drop its held fragments
+func (t *fragmentTracker) forget(key fragmentKey, d *fragmentedDatagram) {
+	t.discard(d)
+	delete(t.datagrams, key)
+}
+
+// Drop the held fragments of the datagram
+func (t *fragmentTracker) discard(d *fragmentedDatagram) {
+	t.held -= len(d.held)
+	t.discarded.Add(uint64(len(d.held)))
+	d.held = nil
+}
+
+// Let the rest of the datagram through, its first fragment carries size bytes.
+// Returns false if there are too many datagrams already.
+func (t *fragmentTracker) allow(key fragmentKey, size int, now time.Time) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	d := t.datagram(key, now)
+	if d == nil {
+		return false
+	}
+	d.decided, d.allowed = true, true
+	d.receive(0, size, false)
+	return true
+}
+
+// Drop the rest of the datagram, its first fragment wasn't allowed
+func (t *fragmentTracker) deny(key fragmentKey, now time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if d := t.datagram(key, now); d != nil {
+		d.decided, d.allowed = true, false
+		t.discard(d)
+	}
+}
+
+// Returns the fragments held until the first fragment was allowed.
+// The datagram is forgotten, once all of its fragments arrived.
+func (t *fragmentTracker) release(key fragmentKey) [][]byte {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	d, ok := t.datagrams[key]
+	if !ok || !d.allowed {
+		return nil
+	}
+
+	held := d.held
+	t.held -= len(held)
+	d.held = nil
+	if d.complete() {
+		delete(t.datagrams, key)
+	}
+	return held
+}
+
+// Determine the verdict of a fragment following the first one, carrying the bytes from
+// start to end of the datagram. A copy of the fragment is held, until its first fragment
+// arrives. The datagram is forgotten, once all of its fragments arrived.
+func (t *fragmentTracker) follow(key fragmentKey, start, end int, last bool, rawBytes []byte, now time.Time) fragmentVerdict {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	d := t.datagram(key, now)
+	switch {
+	case d == nil || d.decided && !d.allowed:
+		return fragmentDropped
+	case !d.decided:
+		if t.held >= maxHeldFragments {
+			t.expire(now)
+		}
+		if t.held >= maxHeldFragments {
+			return fragmentDropped
+		}
+		d.held = append(d.held, bytes.Clone(rawBytes))
+		t.held++
+		d.receive(start, end, last)
+		return fragmentHeld
+	}
+
+	d.receive(start, end, last)
+	if d.complete() {
+		delete(t.datagrams, key)
+	}
+	return fragmentAllowed
+}
+
+// Determine if the ipv4 datagram is fragmented
+func isFragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// The part of the transport header the rules rely on, which mustn't be split,
+// nor overwritten by the fragments (RFC 1858)
+func minTransportHeaderLen(protocol layers.IPProtocol) int {
+	switch protocol {
+	case layers.IPProtocolTCP:
+		return tcpHeaderLen
+	case layers.IPProtocolUDP:
+		return udpHeaderLen
+	case layers.IPProtocolICMPv4:
+		return icmpHeaderLen
+	default:
+		return 0
+	}
+}
+
+// Determine if the VM is allowed to send the fragment. The first fragment is checked
+// by the address rules only, the port based ones need the whole datagram, then
+// the rest of the fragments follow its verdict, until fragmentTimeout. The fragments
+// arriving before the first one are held until its verdict, see heldFragments.
+//
+// Dropped:
+//
+// - tiny first fragments, which split the transport header
+//
+// - fragments overlapping the transport header of the first one
+//
+// - fragmented DNS queries, which would bypass the inspection of the queries
+//
+// - fragments whose first fragment wasn't allowed, or didn't arrive in time
+//
+// - first fragments beyond maxFragmentedDatagrams, and held fragments beyond maxHeldFragments
+func (s *Stack) allowFragment(port *vmPort, packet *frame.Parser, rawBytes []byte) bool {
+	ip := &packet.IPv4
+	key := newFragmentKey(ip)
+	headerLen := minTransportHeaderLen(ip.Protocol)
+	now := time.Now()
+
+	if ip.FragOffset != 0 {
+		start := int(ip.FragOffset) * 8
+		if start < headerLen {
+			return s.dropFragment("fragment overlaps the transport header")
+		}
+
+		last := ip.Flags&layers.IPv4MoreFragments == 0
+		switch port.fragments.follow(key, start, start+len(ip.Payload), last, rawBytes, now) {
+		case fragmentAllowed:
+			return true
+		case fragmentHeld:
+			log.Debug().Msg("fragment held until its first fragment")
+			return false
+		default:
+			return s.dropFragment("first fragment wasn't allowed")
+		}
+	}
+
+	if len(ip.Payload) < headerLen {
+		port.fragments.deny(key, now)
+		return s.dropFragment("first fragment splits the transport header")
+	}
+	if ip.Protocol == layers.IPProtocolUDP && binary.BigEndian.Uint16(ip.Payload[2:4]) == dnsPort {
+		port.fragments.deny(key, now)
+		return s.dropFragment("fragmented DNS query")
+	}
+
+	if !s.allowIPv4(port, packet) {
+		port.fragments.deny(key, now)
+		return false
+	}
+	if !port.fragments.allow(key, len(ip.Payload), now) {
+		return s.dropFragment("too many fragmented datagrams")
+	}
+	return true
+}
+
+// Returns the fragments which arrived before the allowed first fragment, they follow it
+func (s *Stack) heldFragments(port *vmPort, packet *frame.Parser) [][]byte {
+	if !packet.Has(layers.LayerTypeIPv4) || !isFragment(&packet.IPv4) || packet.IPv4.FragOffset != 0 {
+		return nil
+	}
+	return port.fragments.release(newFragmentKey(&packet.IPv4))
+}
+
+// Count the dropped fragment, always returns false
+func (s *Stack) dropFragment(reason string) bool {
+	s.droppedFragments.Add(1)
+	log.Debug().Str("reason", reason).Msg("fragment not allowed from VM")
+	return false
+}
@@ -0,0 +1,210 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
+)
+
+// recordingBackend keeps the frames written to it
+type recordingBackend struct {
+	discardBackend
+	written [][]byte
+}
+
+func (b *recordingBackend) Write(p []byte) (int, error) {
+	b.written = append(b.written, p)
+	return len(p), nil
+}
+
+// A fragment of the VM's datagram to testRemote, carrying data from offset, in 8 byte units
+func fragmentFrame(t *testing.T, protocol layers.IPProtocol, id, offset uint16, more bool, data []byte) []byte {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: testVMMAC, DstMAC: testHostMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, Id: id, FragOffset: offset, SrcIP: testVMAddr, DstIP: testRemote}
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, gopacket.Payload(data)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The UDP header of a datagram from port 40000, followed by n bytes of payload
+func udpHeaderTo(dstPort byte, n int) []byte {
+	return append([]byte{0x9c, 0x40, 0, dstPort, 0, 0, 0, 0}, make([]byte, n)...)
+}
+
+func TestAllowFragment(t *testing.T) {
+	udp := layers.IPProtocolUDP
+	first := fragmentFrame(t, udp, 1, 0, true, udpHeaderTo(80, 8))
+	middle := fragmentFrame(t, udp, 1, 2, true, make([]byte, 16))
+	last := fragmentFrame(t, udp, 1, 4, false, make([]byte, 8))
+	dns := fragmentFrame(t, udp, 1, 0, true, udpHeaderTo(53, 8))
+	tcpFirst := fragmentFrame(t, layers.IPProtocolTCP, 1, 0, true, make([]byte, 24))
+
+	type step struct {
+		frame []byte
+		// The frames written to the backend, the held fragments follow their first fragment
+		sent [][]byte
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		dropped uint64
+		// Datagrams still tracked afterwards
+		tracked int
+	}{
+		{
+			name:  "in order",
+			steps: []step{{first, [][]byte{first}}, {middle, [][]byte{middle}}, {last, [][]byte{last}}},
+		},
+		{
+			name:  "last fragment before the middle one",
+			steps: []step{{first, [][]byte{first}}, {last, [][]byte{last}}, {middle, [][]byte{middle}}},
+		},
+		{
+			name:    "missing fragment",
+			steps:   []step{{first, [][]byte{first}}, {last, [][]byte{last}}},
+			tracked: 1,
+		},
+		{
+			name:  "fragments before their first fragment",
+			steps: []step{{middle, nil}, {last, nil}, {first, [][]byte{first, middle, last}}},
+		},
+		{
+			name:    "fragments of a denied first fragment",
+			steps:   []step{{middle, nil}, {dns, nil}, {last, nil}},
+			dropped: 3,
+			tracked: 1,
+		},
+		{
+			name:    "fragmented DNS query",
+			steps:   []step{{dns, nil}},
+			dropped: 1,
+			tracked: 1,
+		},
+		{
+			name:    "tiny first fragment",
+			steps:   []step{{fragmentFrame(t, udp, 1, 0, true, []byte{0x9c, 0x40, 0, 80}), nil}, {middle, nil}},
+			dropped: 2,
+			tracked: 1,
+		},
+		{
+			name: "overlapping the transport header",
+			steps: []step{
+				{tcpFirst, [][]byte{tcpFirst}},
+				{fragmentFrame(t, layers.IPProtocolTCP, 1, 2, false, make([]byte, 8)), nil},
+			},
+			dropped: 1,
+			tracked: 1,
+		},
+		{
+			name:    "fragment without its first fragment",
+			steps:   []step{{middle, nil}},
+			tracked: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, port := newTestStack(t, nil)
+			backend := &recordingBackend{}
+			s.backend = backend
+			packet := frame.NewParser()
+			out := make(outbox)
+
+			for i, step := range tt.steps {
+				backend.written = nil
+				s.preparePacket(out, port, packet, step.frame)
+				if len(backend.written) != len(step.sent) {
+					t.Fatalf("step %d: got %d frames sent, want %d", i, len(backend.written), len(step.sent))
+				}
+				for j, sent := range step.sent {
+					if string(backend.written[j]) != string(sent) {
+						t.Errorf("step %d: frame %d isn't the one expected", i, j)
+					}
+				}
+			}
+
+			if got := s.Stats().DroppedFragments; got != tt.dropped {
+				t.Errorf("got %d fragments dropped, want %d", got, tt.dropped)
+			}
+			if got := len(port.fragments.datagrams); got != tt.tracked {
+				t.Errorf("got %d datagrams tracked, want %d", got, tt.tracked)
+			}
+		})
+	}
+}
+
+func TestFragmentLimits(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(fragmentTimeout + time.Second)
+
+	t.Run("datagrams", func(t *testing.T) {
+		var tracker fragmentTracker
+		for id := uint16(0); id < maxFragmentedDatagrams; id++ {
+			if !tracker.allow(fragmentKey{id: id}, 16, now) {
+				t.Fatalf("datagram %d not allowed", id)
+			}
+		}
+		if tracker.allow(fragmentKey{id: maxFragmentedDatagrams}, 16, now) {
+			t.Error("datagram beyond the limit allowed")
+		}
+		if !tracker.allow(fragmentKey{id: maxFragmentedDatagrams}, 16, expired) {
+			t.Error("datagram not allowed, once the others expired")
+		}
+	})
+
+	t.Run("held fragments", func(t *testing.T) {
+		var tracker fragmentTracker
+		key := fragmentKey{id: 1}
+		for i := 0; i < maxHeldFragments; i++ {
+			if got := tracker.follow(key, 8*(i+1), 8*(i+2), false, []byte{1}, now); got != fragmentHeld {
+				t.Fatalf("fragment %d: got verdict %d", i, got)
+			}
+		}
+		if got := tracker.follow(key, 1000, 1008, true, []byte{1}, now); got != fragmentDropped {
+			t.Errorf("got verdict %d beyond the limit", got)
+		}
+	})
+}
+
+func TestFragmentExpiry(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(fragmentTimeout + time.Second)
+	key := fragmentKey{id: 1}
+
+	t.Run("allowed datagram", func(t *testing.T) {
+		var tracker fragmentTracker
+		tracker.allow(key, 16, now)
+		if got := tracker.follow(key, 16, 24, false, []byte{1}, now); got != fragmentAllowed {
+			t.Errorf("got verdict %d in time", got)
+		}
+		// Held as the fragment of a new datagram
+		if got := tracker.follow(key, 24, 32, true, []byte{1}, expired); got != fragmentHeld {
+			t.Errorf("got verdict %d after the expiry", got)
+		}
+	})
+
+	t.Run("held fragments", func(t *testing.T) {
+		var tracker fragmentTracker
+		tracker.follow(key, 16, 24, true, []byte{1}, now)
+		tracker.allow(key, 16, expired)
+		if held := tracker.release(key); held != nil {
+			t.Errorf("got %d fragments released after the expiry", len(held))
+		}
+		if got := tracker.discarded.Load(); got != 1 {
+			t.Errorf("got %d fragments discarded, want 1", got)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+// nolint:godot
+package stack
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How often the VM sockets are checked for a closed peer, where the reads don't report it
+var hangUpCheckInterval = time.Second
+
+// ErrVMClosed is returned by Run, when the VM of Fd closed its end of the socket,
+// e.g. because the hypervisor stopped the VM
+var ErrVMClosed = errors.New("the VM closed its socket")
+
+// Determine if the error of a VM socket means that the VM closed its end.
+//
+// A datagram socket whose peer is gone reads EOF (macOS). On Linux the reads
+// keep blocking, only the writes fail, with ECONNREFUSED: watchHangUps polls
+// the sockets, so that an idle VM which closed its socket is noticed too.
+func hungUp(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ENOTCONN) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// React to the VM closing its socket. The stack is stopped if it's the VM of Fd,
+// the port of a peer VM is released: its addresses and lease are forgotten,
+// and its socket is closed. The other VMs keep running.
+func (s *Stack) hangUp(port *vmPort) {
+	if !port.closed.CompareAndSwap(false, true) {
+		return
+	}
+	s.emit(Event{Kind: EventSocketClosed, HardwareAddr: port.HardwareAddr})
+
+	if port == s.sw.primary() {
+		log.Info().Stringer("mac", port.HardwareAddr).Msg("VM closed its socket, stopping")
+		s.stop(ErrVMClosed)
+		return
+	}
+
+	log.Info().Stringer("mac", port.HardwareAddr).Msg("peer VM closed its socket, releasing its port")
+	s.sw.detach(port)
+	port.dm.release()
+
+	// Unblocks the reader of the socket
+	if err := port.close(); err != nil {
+		log.Error().Err(err).Msg("closing socket")
+	}
+}
+
+// Check the VM sockets for a closed peer every hangUpCheckInterval, until the intake is stopped.
+// Returns right away where the reads report it, or the peer can't be checked.
+func (s *Stack) watchHangUps(w *workers) {
+	ticker := time.NewTicker(hangUpCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.intake.Done():
+			return
+		case <-ticker.C:
+			for _, port := range s.sw.ports {
+				if port.closed.Load() {
+					continue
+				}
+
+				closed, err := peerClosed(port.conn)
+				if errors.Is(err, errors.ErrUnsupported) {
+					return
+				}
+				if err != nil {
+					log.Debug().Err(err).Msg("can't check the VM sockets for a closed peer")
+					return
+				}
+				if closed {
+					s.hangUp(port)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+//go:build linux
+
+// nolint:godot
+package stack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SOCK_DIAG_BY_FAMILY request of the sock_diag netlink family
+	sockDiagByFamily = 20
+	// Asks for the inode of the socket's peer
+	udiagShowPeer = 0x4
+	// Attribute of the peer's inode in the reply
+	unixDiagPeer = 2
+	// Size of struct unix_diag_req and struct unix_diag_msg
+	unixDiagReqLen = 24
+	unixDiagMsgLen = 16
+	// The attributes are aligned to 4 bytes
+	nlaAlignTo = 4
+)
+
+var errNoDiagReply = errors.New("no sock_diag reply")
+
+// Determine if the peer of the datagram socket closed its end. The reads of the socket keep
+// blocking on Linux, but the kernel reports the inode of a closed peer as 0 to sock_diag.
+func peerClosed(conn net.Conn) (bool, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false, errors.ErrUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+
+	var st unix.Stat_t
+	var statErr error
+	if err := raw.Control(func(fd uintptr) { statErr = unix.Fstat(int(fd), &st) }); err != nil {
+		return false, err
+	}
+	if statErr != nil {
+		return false, fmt.Errorf("stat socket: %w", statErr)
+	}
+
+	ino, err := diagPeerInode(uint32(st.Ino))
+	if err != nil {
+		return false, err
+	}
+	return ino == 0, nil
+}
+
+// Ask sock_diag for the inode of the peer of the unix socket with the inode
+func diagPeerInode(ino uint32) (uint32, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return 0, fmt.Errorf("opening sock_diag socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	// struct nlmsghdr, followed by struct unix_diag_req of any state, with any cookie
+	req := make([]byte, unix.NLMSG_HDRLEN+unixDiagReqLen)
+	binary.NativeEndian.PutUint32(req[0:], uint32(len(req)))
+	binary.NativeEndian.PutUint16(req[4:], sockDiagByFamily)
+	binary.NativeEndian.PutUint16(req[6:], unix.NLM_F_REQUEST)
+	diag := req[unix.NLMSG_HDRLEN:]
+	diag[0] = unix.AF_UNIX
+	binary.NativeEndian.PutUint32(diag[4:], ^uint32(0))
+	binary.NativeEndian.PutUint32(diag[8:], ino)
+	binary.NativeEndian.PutUint32(diag[12:], udiagShowPeer)
+	binary.NativeEndian.PutUint32(diag[16:], ^uint32(0))
+	binary.NativeEndian.PutUint32(diag[20:], ^uint32(0))
+
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return 0, fmt.Errorf("sending sock_diag request: %w", err)
+	}
+	buf := make([]byte, os.Getpagesize())
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return 0, fmt.Errorf("reading sock_diag reply: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return 0, fmt.Errorf("parsing sock_diag reply: %w", err)
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Type == unix.NLMSG_ERROR {
+			if len(msg.Data) >= 4 {
+				return 0, fmt.Errorf("sock_diag: %w", syscall.Errno(-int32(binary.NativeEndian.Uint32(msg.Data))))
+			}
+			return 0, errNoDiagReply
+		}
+		if msg.Header.Type != sockDiagByFamily || len(msg.Data) < unixDiagMsgLen {
+			continue
+		}
+
+		// The attributes follow struct unix_diag_msg, a socket without a peer has none
+		attrs := msg.Data[unixDiagMsgLen:]
+		for len(attrs) >= unix.SizeofRtAttr {
+			length := int(binary.NativeEndian.Uint16(attrs[0:]))
+			if length < unix.SizeofRtAttr || length > len(attrs) {
+				break
+			}
+			if binary.NativeEndian.Uint16(attrs[2:]) == unixDiagPeer && length >= unix.SizeofRtAttr+4 {
+				return binary.NativeEndian.Uint32(attrs[unix.SizeofRtAttr:]), nil
+			}
+			attrs = attrs[min((length+nlaAlignTo-1)&^(nlaAlignTo-1), len(attrs)):]
+		}
+		return 0, nil
+	}
+	return 0, errNoDiagReply
+}
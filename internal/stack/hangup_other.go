@@ -0,0 +1,13 @@
+//go:build !linux
+
+package stack
+
+import (
+	"errors"
+	"net"
+)
+
+// The reads of a datagram socket whose peer is gone return EOF, e.g. on macOS, there's nothing to poll
+func peerClosed(net.Conn) (bool, error) {
+	return false, errors.ErrUnsupported
+}
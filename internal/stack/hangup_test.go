@@ -0,0 +1,72 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Waits for the socket-closed event of the VM
+func waitSocketClosed(t *testing.T, closed <-chan net.HardwareAddr, mac net.HardwareAddr) {
+	t.Helper()
+
+	select {
+	case got := <-closed:
+		if !bytes.Equal(got, mac) {
+			t.Fatalf("got %s closed, want %s", got, mac)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s closing its socket not noticed", mac)
+	}
+}
+
+func socketClosedObserver(closed chan<- net.HardwareAddr) Observer {
+	return ObserverFunc(func(e Event) {
+		if e.Kind == EventSocketClosed {
+			closed <- e.HardwareAddr
+		}
+	})
+}
+
+// The idle VMs closing their socket are noticed, without a frame sent to them
+func TestHangUpIdleVM(t *testing.T) {
+	prev := hangUpCheckInterval
+	hangUpCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { hangUpCheckInterval = prev })
+
+	t.Run("vm of fd", func(t *testing.T) {
+		closed := make(chan net.HardwareAddr, 1)
+		_, vm, stop := startTestStack(t, NetworkParams{CustomBackend: discardBackend{}, Observer: socketClosedObserver(closed)})
+		t.Cleanup(func() { _ = stop() })
+
+		vm.Close()
+		waitSocketClosed(t, closed, testVMMAC)
+		if err := stop(); !errors.Is(err, ErrVMClosed) {
+			t.Errorf("got %v, want %v", err, ErrVMClosed)
+		}
+	})
+
+	t.Run("peer vm", func(t *testing.T) {
+		peer, peerFd := vmSocket(t)
+		closed := make(chan net.HardwareAddr, 1)
+		s, _, stop := startTestStack(t, NetworkParams{
+			CustomBackend: discardBackend{},
+			Observer:      socketClosedObserver(closed),
+			PeerVMs:       []VM{{Fd: peerFd, HardwareAddr: testPeerMAC}},
+		})
+		t.Cleanup(func() { _ = stop() })
+
+		peer.Close()
+		waitSocketClosed(t, closed, testPeerMAC)
+		if !s.sw.ports[1].closed.Load() || s.sw.primary().closed.Load() {
+			t.Error("got the wrong port released")
+		}
+		// The stack keeps running
+		if err := stop(); err != nil {
+			t.Errorf("got %v, want the stack running until it's stopped", err)
+		}
+	})
+}
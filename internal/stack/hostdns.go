@@ -0,0 +1,57 @@
+// nolint:godot
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Answer the host's DNS queries for the VM names on HostDNSAddr. The listener is closed
+// once ctx is done, its goroutine is joined by the tasks of w.
+func (s *Stack) startHostDNS(ctx context.Context, w *workers) error {
+	conn, err := net.ListenPacket("udp", s.HostDNSAddr)
+	if err != nil {
+		return fmt.Errorf("listening for the host's DNS queries: %w", err)
+	}
+
+	w.run(&w.tasks, func() {
+		<-ctx.Done()
+		conn.Close()
+	})
+	w.run(&w.tasks, func() { s.serveHostDNS(conn) })
+
+	log.Debug().Stringer("addr", conn.LocalAddr()).Msg("dns: answering the host's queries")
+	return nil
+}
+
+// Answer the host's queries, until conn is closed
+func (s *Stack) serveHostDNS(conn net.PacketConn) {
+	buf := make([]byte, maxDNSMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msg("dns: reading the host's query")
+			}
+			return
+		}
+
+		query, ok := decodeDNS(buf[:n])
+		if !ok || query.QR {
+			continue
+		}
+
+		reply, err := serializeDNS(s.resolver.answerHost(query))
+		if err != nil {
+			log.Error().Err(err).Msg("dns: building the reply to the host")
+			continue
+		}
+		if _, err := conn.WriteTo(reply, addr); err != nil {
+			log.Error().Err(err).Msg("dns: writing the reply to the host")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// A free loopback UDP address
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func queryHostDNS(t *testing.T, addr, name string) *layers.DNS {
+	t.Helper()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(dnsQuery(t, 7, name)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxDNSMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, ok := decodeDNS(buf[:n])
+	if !ok || !reply.QR || reply.ID != 7 {
+		t.Fatalf("got %+v, want the reply to the query", reply)
+	}
+	return reply
+}
+
+func TestHostDNS(t *testing.T) {
+	addr := freeUDPAddr(t)
+	_, vm := runTestStack(t, NetworkParams{VMName: "web", HostDNSAddr: addr})
+	leased := leaseTestVM(t, vm)
+
+	tests := []struct {
+		name  string
+		query string
+		code  layers.DNSResponseCode
+		addr  net.IP
+	}{
+		{name: "vm", query: "Web.vm.local", addr: leased},
+		{name: "unknown vm", query: "db.vm.local", code: layers.DNSResponseCodeNXDomain},
+		{name: "external name", query: "example.com", code: layers.DNSResponseCodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := queryHostDNS(t, addr, tt.query)
+			if reply.ResponseCode != tt.code {
+				t.Errorf("got %s, want %s", reply.ResponseCode, tt.code)
+			}
+			if tt.addr != nil && (len(reply.Answers) != 1 || !reply.Answers[0].IP.Equal(tt.addr)) {
+				t.Errorf("got answers %v, want %s", reply.Answers, tt.addr)
+			}
+		})
+	}
+}
+
+func TestHostDNSWithoutNames(t *testing.T) {
+	_, err := NewNetwork(NetworkParams{Backend: BackendUserspace, HostDNSAddr: "127.0.0.1:5354"})
+	if !errors.Is(err, errHostDNSWithoutNames) {
+		t.Errorf("got %v, want %v", err, errHostDNSWithoutNames)
+	}
+}
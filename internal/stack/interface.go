@@ -0,0 +1,58 @@
+// nolint:godot
+package stack
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/netif"
+	"github.com/rs/zerolog/log"
+)
+
+var errInterfaceMismatch = errors.New("the backend created a different network than configured")
+
+// Interface returns the network the backend created, once Run started it
+func (s *Stack) Interface() netif.Interface {
+	return s.backend.Interface()
+}
+
+// Log the network the backend created, and check it against the NetworkParams.
+// The dhcp snooping and the anti-spoofing rules rely on the configured subnet,
+// the VMs' traffic would be dropped on a different one. The values the backend
+// didn't report are not checked, nor is the MAC address it assigned: the VMs keep their own.
+func (s *Stack) checkInterface() error {
+	iface := s.backend.Interface()
+	logInterface(iface)
+
+	if s.subnet.IsValid() && !iface.StartAddr.IsZero() &&
+		(iface.StartAddr != s.StartAddr || iface.EndAddr != s.EndAddr || iface.SubnetMask != s.SubnetMask) {
+		return fmt.Errorf("%w: %s-%s/%s instead of %s-%s/%s", errInterfaceMismatch,
+			iface.StartAddr, iface.EndAddr, iface.SubnetMask, s.StartAddr, s.EndAddr, s.SubnetMask)
+	}
+
+	if s.MTU != 0 && iface.MTU != 0 && iface.MTU != s.MTU {
+		return fmt.Errorf("%w: MTU %d instead of %d", errInterfaceMismatch, iface.MTU, s.MTU)
+	}
+
+	s.setLinkMTU(iface.MTU)
+	return nil
+}
+
+func logInterface(iface netif.Interface) {
+	event := log.Info().Int("mtu", iface.MTU).Int("max_packet_size", iface.MaxPacketSize)
+	if iface.HardwareAddr != nil {
+		event.Stringer("mac", iface.HardwareAddr)
+	}
+	if !iface.StartAddr.IsZero() {
+		event.Stringer("start_addr", iface.StartAddr).
+			Stringer("end_addr", iface.EndAddr).
+			Stringer("subnet_mask", iface.SubnetMask)
+	}
+	if iface.NAT66Prefix.IsValid() {
+		event.Stringer("nat66_prefix", iface.NAT66Prefix)
+	}
+	if iface.ID != "" {
+		event.Str("interface_id", iface.ID)
+	}
+	event.Msg("backend started")
+}
@@ -0,0 +1,74 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/netif"
+	"inet.af/netaddr"
+)
+
+// interfaceBackend reports iface as the network it created
+type interfaceBackend struct {
+	discardBackend
+	iface netif.Interface
+}
+
+func (b interfaceBackend) Interface() netif.Interface { return b.iface }
+
+// The stack fails to start on a network other than configured
+func TestCheckInterface(t *testing.T) {
+	ip := netaddr.MustParseIP
+	configured := netif.Interface{StartAddr: ip("192.168.64.1"), EndAddr: ip("192.168.64.255"), SubnetMask: ip("255.255.255.0"), MTU: 1500}
+	with := func(change func(iface *netif.Interface)) netif.Interface {
+		iface := configured
+		change(&iface)
+		return iface
+	}
+
+	tests := []struct {
+		name  string
+		iface netif.Interface
+		p     NetworkParams
+		err   error
+	}{
+		{name: "configured network", iface: configured, p: NetworkParams{MTU: 1500}},
+		{name: "nothing reported", p: NetworkParams{MTU: 1500}},
+		{name: "other start", iface: with(func(i *netif.Interface) { i.StartAddr = ip("192.168.65.1") }), err: errInterfaceMismatch},
+		{name: "other end", iface: with(func(i *netif.Interface) { i.EndAddr = ip("192.168.64.128") }), err: errInterfaceMismatch},
+		{name: "other subnet mask", iface: with(func(i *netif.Interface) { i.SubnetMask = ip("255.255.0.0") }), err: errInterfaceMismatch},
+		{name: "other MTU", iface: with(func(i *netif.Interface) { i.MTU = 9000 }), p: NetworkParams{MTU: 1500}, err: errInterfaceMismatch},
+		{name: "MTU not configured", iface: with(func(i *netif.Interface) { i.MTU = 9000 })},
+		{
+			// The VMs keep their own MAC address
+			name:  "other MAC",
+			iface: with(func(i *netif.Interface) { i.HardwareAddr = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x99} }),
+		},
+		{
+			// The LAN's dhcp server hands out the addresses
+			name:  "other range in bridged mode",
+			iface: with(func(i *netif.Interface) { i.StartAddr = ip("10.0.0.1") }),
+			p:     NetworkParams{Mode: ModeBridged, BridgeInterface: "en0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.p.CustomBackend = interfaceBackend{iface: tt.iface}
+			s, _, stop := startTestStack(t, tt.p)
+
+			err := stop()
+			if tt.err == nil && err != nil {
+				t.Fatalf("got %v, want the stack started", err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && tt.iface.MTU != 0 && s.mtu() != tt.iface.MTU {
+				t.Errorf("got MTU %d, want %d", s.mtu(), tt.iface.MTU)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// nolint:godot
+package stack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+)
+
+const (
+	// MTU of the VMs' interfaces, if the backend doesn't report one
+	defaultMTU = 1500
+
+	ipv4FlagDF        = 0x4000
+	ipProtocolICMP    = 1
+	icmpQuotedPayload = 8
+)
+
+// The MTU the VMs' frames are checked against, reported by the backend, or configured
+func (s *Stack) setLinkMTU(reported int) {
+	mtu := reported
+	if mtu == 0 {
+		mtu = s.MTU
+	}
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	s.linkMTU.Store(int64(mtu))
+}
+
+// Returns the MTU of the VMs' interfaces, the default one until the backend is started
+func (s *Stack) mtu() int {
+	if mtu := s.linkMTU.Load(); mtu != 0 {
+		return int(mtu)
+	}
+	return defaultMTU
+}
+
+// Determine if the frame read from the VM fits the MTU. The frames that don't are dropped
+// and counted, truncated ones didn't even fit the read buffer. The VM is sent an ICMP
+// fragmentation needed for the DF datagrams, so that path MTU discovery works.
+func (s *Stack) fitsMTU(port *vmPort, rawBytes []byte, truncated bool) bool {
+	mtu := s.mtu()
+	if !truncated && len(rawBytes) <= ethHeaderLen+mtu {
+		return true
+	}
+
+	if truncated {
+		s.truncatedFromVM.Add(1)
+	} else {
+		s.oversizedFromVM.Add(1)
+	}
+	log.Debug().Int("size", len(rawBytes)).Bool("truncated", truncated).Int("mtu", mtu).Msg("frame from VM exceeds the MTU")
+
+	if frame, ok := s.fragmentationNeeded(port, rawBytes, mtu); ok {
+		s.sendToVM(port, frame)
+	}
+	return false
+}
+
+// Determine if the frame read from the backend fits the VMs' MTU. The VM would drop it anyway.
+func (s *Stack) fitsMTUToVM(rawBytes []byte) bool {
+	if len(rawBytes) <= ethHeaderLen+s.mtu() {
+		return true
+	}
+
+	s.oversizedToVM.Add(1)
+	log.Debug().Int("size", len(rawBytes)).Msg("frame to VM exceeds the MTU")
+	return false
+}
+
+// Builds the ICMP fragmentation needed reply of the gateway (RFC 1191), if the frame
+// is an ipv4 datagram with DF set, sent from the VM's leased address.
+// The header is intact even if the frame was truncated.
+func (s *Stack) fragmentationNeeded(port *vmPort, rawBytes []byte, mtu int) ([]byte, bool) {
+	if len(rawBytes) < ethHeaderLen+ipv4HeaderLen || binary.BigEndian.Uint16(rawBytes[12:14]) != ipv4EtherType {
+		return nil, false
+	}
+
+	ip := rawBytes[ethHeaderLen:]
+	headerLen := int(ip[0]&0x0f) * 4
+	if headerLen < ipv4HeaderLen || len(ip) < headerLen || binary.BigEndian.Uint16(ip[6:8])&ipv4FlagDF == 0 {
+		return nil, false
+	}
+
+	// ICMP errors aren't sent about ICMP errors, nor to spoofed addresses
+	if ip[9] == ipProtocolICMP && len(ip) > headerLen && !icmpQuery(ip[headerLen]) {
+		return nil, false
+	}
+	gateway := s.gatewayAddr()
+	if gateway.IsZero() || !port.dm.validIPAddress(netaddr.IPFrom4([4]byte(ip[12:16]))) {
+		return nil, false
+	}
+
+	// The header of the datagram, and the first 8 bytes of its payload are quoted
+	quoted := ip[:min(len(ip), headerLen+icmpQuotedPayload)]
+	frame, err := fragmentationNeededFrame(net.HardwareAddr(rawBytes[0:6]), port.HardwareAddr, gateway, quoted, mtu)
+	if err != nil {
+		log.Error().Err(err).Msg("building ICMP fragmentation needed")
+		return nil, false
+	}
+	return frame, true
+}
+
+// Determine if the ICMP type is a query (e.g. echo), not an error
+func icmpQuery(icmpType uint8) bool {
+	switch icmpType {
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench,
+		layers.ICMPv4TypeRedirect, layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+		return false
+	default:
+		return true
+	}
+}
+
+// ICMP destination unreachable, fragmentation needed of the gateway, quoting the VM's datagram
+func fragmentationNeededFrame(gatewayMAC, vmMAC net.HardwareAddr, gateway netaddr.IP, quoted []byte, mtu int) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       gatewayMAC,
+		DstMAC:       vmMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    gateway.IPAddr().IP.To4(),
+		DstIP:    net.IP(quoted[12:16]),
+	}
+	// The next-hop MTU takes the place of the sequence number
+	icmp := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+		Seq:      uint16(mtu),
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, icmp, gopacket.Payload(quoted)); err != nil {
+		return nil, fmt.Errorf("serializing ICMP: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,146 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// A frame of the VM to testRemote, size bytes long, with the datagram's payload starting with l4
+func mtuFrame(t *testing.T, src net.IP, protocol layers.IPProtocol, df bool, l4 []byte, size int) []byte {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: testVMMAC, DstMAC: testHostMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, SrcIP: src, DstIP: testRemote}
+	if df {
+		ip.Flags = layers.IPv4DontFragment
+	}
+	payload := append(l4, make([]byte, size-ethHeaderLen-ipv4HeaderLen-len(l4))...)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Determine if the ones' complement sum of the bytes is all ones, as of a valid checksum
+func validChecksum(b []byte) bool {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return sum == 0xffff
+}
+
+func TestFitsMTU(t *testing.T) {
+	const mtu = 1400
+	udp := layers.IPProtocolUDP
+	icmp := layers.IPProtocolICMPv4
+	udpHeader := []byte{0x9c, 0x40, 0, 53, 0, 0, 0, 0}
+	echo := []byte{layers.ICMPv4TypeEchoRequest, 0, 0, 0, 0, 1, 0, 1}
+	unreachable := []byte{layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort, 0, 0, 0, 0, 0, 0}
+	spoofed := net.IPv4(192, 168, 64, 77).To4()
+
+	tests := []struct {
+		name  string
+		frame []byte
+		// The frame was truncated when it was read
+		truncated bool
+		fits      bool
+		// The counters of the dropped frames
+		oversized, truncatedCount uint64
+		// The VM is sent an ICMP fragmentation needed
+		icmp bool
+	}{
+		{name: "fits", frame: mtuFrame(t, testVMAddr, udp, true, udpHeader, ethHeaderLen+mtu), fits: true},
+		{name: "oversized", frame: mtuFrame(t, testVMAddr, udp, true, udpHeader, ethHeaderLen+mtu+1), oversized: 1, icmp: true},
+		{name: "truncated", frame: mtuFrame(t, testVMAddr, udp, true, udpHeader, ethHeaderLen+mtu), truncated: true, truncatedCount: 1, icmp: true},
+		{name: "fragmentable", frame: mtuFrame(t, testVMAddr, udp, false, udpHeader, ethHeaderLen+mtu+1), oversized: 1},
+		{name: "spoofed source", frame: mtuFrame(t, spoofed, udp, true, udpHeader, ethHeaderLen+mtu+1), oversized: 1},
+		{name: "ICMP query", frame: mtuFrame(t, testVMAddr, icmp, true, echo, ethHeaderLen+mtu+1), oversized: 1, icmp: true},
+		{name: "ICMP error", frame: mtuFrame(t, testVMAddr, icmp, true, unreachable, ethHeaderLen+mtu+1), oversized: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, port := newTestStack(t, nil)
+			s.setLinkMTU(mtu)
+			vm, fd := vmSocket(t)
+			conn, err := fileConn(fd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			port.conn = conn
+
+			if got := s.fitsMTU(port, tt.frame, tt.truncated); got != tt.fits {
+				t.Errorf("got fits %t, want %t", got, tt.fits)
+			}
+			stats := s.Stats()
+			if stats.OversizedFromVM != tt.oversized || stats.TruncatedFromVM != tt.truncatedCount {
+				t.Errorf("got %d oversized, %d truncated, want %d, %d", stats.OversizedFromVM, stats.TruncatedFromVM, tt.oversized, tt.truncatedCount)
+			}
+
+			if !tt.icmp {
+				expectNoFrame(t, vm)
+				return
+			}
+			packet := readFrame(t, vm, func(p gopacket.Packet) bool { return p.Layer(layers.LayerTypeICMPv4) != nil })
+			eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+			ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			reply := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+
+			if eth.SrcMAC.String() != testHostMAC.String() || eth.DstMAC.String() != testVMMAC.String() {
+				t.Errorf("got frame %s -> %s", eth.SrcMAC, eth.DstMAC)
+			}
+			if !ip.SrcIP.Equal(s.gateway.IPAddr().IP) || !ip.DstIP.Equal(testVMAddr) {
+				t.Errorf("got datagram %s -> %s", ip.SrcIP, ip.DstIP)
+			}
+			if want := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded); reply.TypeCode != want {
+				t.Errorf("got %s, want %s", reply.TypeCode, want)
+			}
+			// The unused field, then the next-hop MTU
+			if reply.Id != 0 || reply.Seq != mtu {
+				t.Errorf("got unused %d, next-hop MTU %d, want 0, %d", reply.Id, reply.Seq, mtu)
+			}
+			// The datagram's header and the first 8 bytes of its payload
+			quoted := tt.frame[ethHeaderLen : ethHeaderLen+ipv4HeaderLen+8]
+			if !bytes.Equal(reply.Payload, quoted) {
+				t.Errorf("got quoted % x, want % x", reply.Payload, quoted)
+			}
+			if !validChecksum(ip.Contents) {
+				t.Errorf("got invalid IP header checksum %#04x", ip.Checksum)
+			}
+			if !validChecksum(append(reply.Contents, reply.Payload...)) {
+				t.Errorf("got invalid ICMP checksum %#04x", reply.Checksum)
+			}
+		})
+	}
+}
+
+func TestFitsMTUToVM(t *testing.T) {
+	s, _ := newTestStack(t, nil)
+	s.setLinkMTU(1400)
+
+	if !s.fitsMTUToVM(make([]byte, ethHeaderLen+1400)) {
+		t.Error("got the frame of the MTU dropped")
+	}
+	if s.fitsMTUToVM(make([]byte, ethHeaderLen+1401)) {
+		t.Error("got the oversized frame passed")
+	}
+	if got := s.Stats().OversizedToVM; got != 1 {
+		t.Errorf("got %d oversized, want 1", got)
+	}
+}
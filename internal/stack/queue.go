@@ -0,0 +1,257 @@
+// nolint:godot
+package stack
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/dgram"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
+	"github.com/nagypeterjob/sock-vmnet/internal/pool"
+)
+
+const (
+	// Number of batches waiting for a worker of the multi-queue datapath
+	queueDepth = 8
+
+	ipv4EtherType = 0x0800
+	ethHeaderLen  = 14
+	ipv4HeaderLen = 20
+	// The more fragments flag, and the fragment offset of the ipv4 header
+	ipv4FragmentBits = 0x3fff
+	ipProtocolTCP    = 6
+	ipProtocolUDP    = 17
+)
+
+// A frame read from a VM, waiting for a worker
+type vmFrame struct {
+	port     *vmPort
+	rawBytes []byte
+}
+
+// queues of the multi-queue datapath. The frames are hashed to the workers by
+// their flow, so the frames of a flow are handled by the same worker, in order.
+//
+// A VM's socket is still read by a single goroutine, which hands the frames of a read
+// over to the workers in a batch per worker, instead of one by one. The workers decode,
+// filter and switch the frames, and write them to the VMs in batches as well.
+type queues struct {
+	// Frames sent by the VMs
+	vm []chan []vmFrame
+	// Frames sent to the VMs
+	host []chan [][]byte
+
+	// Buffers of the frames read from the VMs, owned by the worker
+	// from the time they are queued, until the frame is handled
+	buffers *pool.Pool
+	// Batches handed over to the workers, returned once they are handled
+	vmBatches   batches[vmFrame]
+	hostBatches batches[[]byte]
+}
+
+func newQueues(workers int, frameSize int) *queues {
+	// Every worker has queueDepth batches waiting, and one in hand
+	inFlight := workers * (queueDepth + 1)
+	q := &queues{
+		vm:          make([]chan []vmFrame, workers),
+		host:        make([]chan [][]byte, workers),
+		buffers:     pool.New(inFlight*dgram.MaxBatchSize, frameSize),
+		vmBatches:   make(batches[vmFrame], inFlight),
+		hostBatches: make(batches[[]byte], inFlight),
+	}
+	for i := 0; i < workers; i++ {
+		q.vm[i] = make(chan []vmFrame, queueDepth)
+		q.host[i] = make(chan [][]byte, queueDepth)
+	}
+	return q
+}
+
+// batches is a bounded free list of the batches of the workers, like pool.Pool
+type batches[T any] chan []T
+
+func (b batches[T]) get() []T {
+	select {
+	case batch := <-b:
+		return batch
+	default:
+		return make([]T, 0, dgram.MaxBatchSize)
+	}
+}
+
+// Return the batch to the list, without keeping its frames
+func (b batches[T]) put(batch []T) {
+	clear(batch)
+	select {
+	case b <- batch[:0]:
+	default:
+	}
+}
+
+// Start the workers of both directions, and the dispatcher of the backend's frames
+func (s *Stack) startQueues(w *workers) {
+	for i := range s.queues.vm {
+		vm, host := s.queues.vm[i], s.queues.host[i]
+		w.run(&w.senders, func() { s.handleVMFrames(w.drain, vm) })
+		// The host workers stop once the dispatcher closes their queue
+		w.run(&w.senders, func() { s.handleHostFrames(w.drain, host) })
+	}
+	w.run(&w.senders, func() { s.dispatchHostFrames(w) })
+}
+
+// Add the frame read from the VM to the pending batch of its flow's worker
+func (q *queues) addVMFrame(pending [][]vmFrame, port *vmPort, rawBytes []byte) {
+	i := flowHash(rawBytes) % uint32(len(q.vm))
+	if pending[i] == nil {
+		pending[i] = q.vmBatches.get()
+	}
+	pending[i] = append(pending[i], vmFrame{port: port, rawBytes: rawBytes})
+}
+
+// Hand the pending batches over to the workers.
+// Returns false if the drain deadline is exceeded.
+func (q *queues) queueVMFrames(ctx context.Context, pending [][]vmFrame) bool {
+	for i, batch := range pending {
+		if len(batch) == 0 {
+			continue
+		}
+		select {
+		case q.vm[i] <- batch:
+			pending[i] = nil
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// Stop the workers of the VMs' frames, once the queued frames are handled.
+// Called when every VM reader has stopped.
+func (q *queues) closeVM() {
+	for _, queue := range q.vm {
+		close(queue)
+	}
+}
+
+// Worker of the frames sent by the VMs, runs until its queue is closed, or the drain deadline
+func (s *Stack) handleVMFrames(drain context.Context, queue <-chan []vmFrame) {
+	out := make(outbox)
+	packet := frame.NewParser()
+	for {
+		select {
+		case <-drain.Done():
+			return
+		case batch, ok := <-queue:
+			if !ok {
+				return
+			}
+			for _, f := range batch {
+				s.preparePacket(out, f.port, packet, f.rawBytes)
+			}
+			s.flush(out)
+
+			for _, f := range batch {
+				s.queues.buffers.Put(f.rawBytes)
+			}
+			s.queues.vmBatches.put(batch)
+		}
+	}
+}
+
+// Worker of the frames sent to the VMs, runs until its queue is closed, or the drain deadline
+func (s *Stack) handleHostFrames(drain context.Context, queue <-chan [][]byte) {
+	out := make(outbox)
+	packet := frame.NewParser()
+	for {
+		select {
+		case <-drain.Done():
+			return
+		case batch, ok := <-queue:
+			if !ok {
+				return
+			}
+			s.sendFrames(out, packet, batch)
+			s.queues.hostBatches.put(batch)
+		}
+	}
+}
+
+// Queue the backend's frames to the workers of their flows, in a batch per worker.
+// Closes the queues once the intake is stopped, and the backend's frames are dispatched.
+func (s *Stack) dispatchHostFrames(w *workers) {
+	defer func() {
+		for _, queue := range s.queues.host {
+			close(queue)
+		}
+	}()
+
+	frames := s.backend.Frames()
+	received := make([][]byte, 0, dgram.MaxBatchSize)
+	pending := make([][][]byte, len(s.queues.host))
+	for {
+		bytes, ok := nextFrame(w.intake, w.drain, frames)
+		if !ok {
+			return
+		}
+
+		received = drainFrames(frames, append(received, bytes))
+		for i, rawBytes := range received {
+			queue := flowHash(rawBytes) % uint32(len(s.queues.host))
+			if pending[queue] == nil {
+				pending[queue] = s.queues.hostBatches.get()
+			}
+			pending[queue] = append(pending[queue], rawBytes)
+			received[i] = nil
+		}
+		received = received[:0]
+
+		for i, batch := range pending {
+			if len(batch) == 0 {
+				continue
+			}
+			select {
+			case s.queues.host[i] <- batch:
+				pending[i] = nil
+			case <-w.drain.Done():
+				return
+			}
+		}
+	}
+}
+
+// Hashes the addresses, the protocol, and the ports of an ipv4 frame with FNV-1a,
+// so that the flows between the same hosts are spread over the workers.
+// Every other frame (ARP, dhcp before the lease, ...) hashes to 0.
+//
+// Only the first fragment of a datagram carries the ports, so the fragments are
+// hashed without them: every fragment of a datagram goes to the same worker.
+func flowHash(rawBytes []byte) uint32 {
+	if len(rawBytes) < ethHeaderLen+ipv4HeaderLen || binary.BigEndian.Uint16(rawBytes[12:14]) != ipv4EtherType {
+		return 0
+	}
+
+	ip := rawBytes[ethHeaderLen:]
+	hash := fnvAdd(fnvOffset, ip[12:20])
+	hash = fnvAdd(hash, ip[9:10])
+
+	if ip[9] != ipProtocolTCP && ip[9] != ipProtocolUDP || binary.BigEndian.Uint16(ip[6:8])&ipv4FragmentBits != 0 {
+		return hash
+	}
+	headerLen := int(ip[0]&0x0f) * 4
+	if headerLen < ipv4HeaderLen || len(ip) < headerLen+4 {
+		return hash
+	}
+	return fnvAdd(hash, ip[headerLen:headerLen+4])
+}
+
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+func fnvAdd(hash uint32, data []byte) uint32 {
+	for _, b := range data {
+		hash ^= uint32(b)
+		hash *= fnvPrime
+	}
+	return hash
+}
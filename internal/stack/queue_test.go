@@ -0,0 +1,169 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/dgram"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+var testPeerMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x43}
+
+// The VM's end of a socketpair, and the stack's end
+func benchSocket(b *testing.B) (dgram.Conn, int) {
+	b.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := net.FileConn(os.NewFile(uintptr(fds[1]), "vm"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+
+	frames, err := dgram.New(conn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return frames, fds[0]
+}
+
+// Runs a stack of two VMs, which are leased 192.168.64.2 and 192.168.64.3
+func runBenchStack(b *testing.B, queues int) (dgram.Conn, dgram.Conn) {
+	b.Helper()
+
+	sender, senderFd := benchSocket(b)
+	receiver, receiverFd := benchSocket(b)
+
+	s, err := NewNetwork(NetworkParams{
+		Fd:            senderFd,
+		HardwareAddr:  testVMMAC,
+		PeerVMs:       []VM{{Fd: receiverFd, HardwareAddr: testPeerMAC}},
+		StartAddr:     netaddr.MustParseIP("192.168.64.1"),
+		EndAddr:       netaddr.MustParseIP("192.168.64.255"),
+		SubnetMask:    netaddr.MustParseIP("255.255.255.0"),
+		CustomBackend: discardBackend{},
+		Queues:        queues,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i, port := range s.sw.ports {
+		port.dm.lease = lease{addr: netaddr.IPv4(192, 168, 64, byte(2+i)), validUntil: time.Now().Add(time.Hour)}
+		s.sw.learn(port.HardwareAddr, port)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Run(ctx)
+	}()
+	b.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return sender, receiver
+}
+
+// Every frame of a flow is hashed to the same worker, the fragments too
+func TestFlowHash(t *testing.T) {
+	udpTo := func(src, dst layers.UDPPort) *layers.UDP { return &layers.UDP{SrcPort: src, DstPort: dst} }
+	whole := ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, udpTo(40000, 443), gopacket.Payload(make([]byte, 100)))
+	first := fragmentFrame(t, layers.IPProtocolUDP, 1, 0, true, udpHeaderTo(187, 8))
+
+	tests := []struct {
+		name  string
+		base  []byte
+		frame []byte
+		same  bool
+	}{
+		{name: "same flow", base: whole, frame: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, udpTo(40000, 443)), same: true},
+		{name: "other source port", base: whole, frame: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, udpTo(40001, 443))},
+		{name: "other destination port", base: whole, frame: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, udpTo(40000, 53))},
+		{
+			name:  "other TCP ports",
+			base:  ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, &layers.TCP{SrcPort: 40000, DstPort: 443}),
+			frame: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, &layers.TCP{SrcPort: 40000, DstPort: 22}),
+		},
+		{name: "other protocol", base: whole, frame: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, &layers.TCP{SrcPort: 40000, DstPort: 443})},
+		{name: "other address", base: whole, frame: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testGateway, udpTo(40000, 443))},
+		// The ports are only carried by the first fragment
+		{name: "middle fragment", base: first, frame: fragmentFrame(t, layers.IPProtocolUDP, 1, 2, true, make([]byte, 8)), same: true},
+		{name: "last fragment", base: first, frame: fragmentFrame(t, layers.IPProtocolUDP, 1, 3, false, make([]byte, 8)), same: true},
+		{name: "first fragment to other ports", base: first, frame: fragmentFrame(t, layers.IPProtocolUDP, 2, 0, true, udpHeaderTo(53, 8)), same: true},
+		{name: "fragment of other protocol", base: first, frame: fragmentFrame(t, layers.IPProtocolTCP, 1, 2, false, make([]byte, 8))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := flowHash(tt.frame) == flowHash(tt.base); got != tt.same {
+				t.Errorf("got the same hash %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+// Frames sent by one VM to the other through the stack, over 64 UDP flows
+func BenchmarkDatapath(b *testing.B) {
+	for _, queues := range []int{1, 4} {
+		b.Run(fmt.Sprintf("queues=%d", queues), func(b *testing.B) {
+			sender, receiver := runBenchStack(b, queues)
+
+			batch := make([][]byte, dgram.MaxBatchSize)
+			for i := range batch {
+				eth := &layers.Ethernet{SrcMAC: testVMMAC, DstMAC: testPeerMAC, EthernetType: layers.EthernetTypeIPv4}
+				ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 168, 64, 2), DstIP: net.IPv4(192, 168, 64, 3)}
+				udp := &layers.UDP{SrcPort: layers.UDPPort(50000 + i), DstPort: 9}
+				_ = udp.SetNetworkLayerForChecksum(ip)
+
+				buf := gopacket.NewSerializeBuffer()
+				opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+				if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(make([]byte, 1472))); err != nil {
+					b.Fatal(err)
+				}
+				batch[i] = buf.Bytes()
+			}
+
+			bufs := make([][]byte, dgram.MaxBatchSize)
+			for i := range bufs {
+				bufs[i] = make([]byte, 1515)
+			}
+			sizes := make([]int, dgram.MaxBatchSize)
+
+			b.SetBytes(int64(len(batch[0])))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			go func() {
+				for sent := 0; sent < b.N; {
+					n, err := sender.WriteBatch(batch[:min(len(batch), b.N-sent)])
+					if err != nil {
+						return
+					}
+					sent += n
+				}
+			}()
+
+			for received := 0; received < b.N; {
+				n, err := receiver.ReadBatch(bufs, sizes)
+				if err != nil {
+					b.Fatal(err)
+				}
+				received += n
+			}
+		})
+	}
+}
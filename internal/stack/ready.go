@@ -0,0 +1,88 @@
+// nolint:godot
+package stack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+)
+
+// ErrNoLease is returned by Run, when the VM of Fd wasn't acknowledged a lease within ReadyTimeout
+var ErrNoLease = errors.New("the VM wasn't acknowledged a lease in time")
+
+// Readiness is the report of the VM of Fd, written to Ready once its first lease is acknowledged
+type Readiness struct {
+	HardwareAddr string       `json:"mac"`
+	Addr         netaddr.IP   `json:"addr"`
+	Gateway      netaddr.IP   `json:"gateway"`
+	SubnetMask   netaddr.IP   `json:"subnet_mask"`
+	DNSServers   []netaddr.IP `json:"dns_servers"`
+	MTU          int          `json:"mtu"`
+}
+
+// Wait for the first lease of the VM of Fd, and write the readiness report.
+// Stops the stack with ErrNoLease, if the lease isn't acknowledged within ReadyTimeout.
+// Ready is closed, whether the report was written or not.
+func (s *Stack) reportReady(w *workers) {
+	if s.Ready != nil {
+		defer s.Ready.Close()
+	}
+
+	var timeout <-chan time.Time
+	if s.ReadyTimeout > 0 {
+		timer := time.NewTimer(s.ReadyTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.intake.Done():
+		return
+	case <-timeout:
+		log.Error().Dur("timeout", s.ReadyTimeout).Msg("no lease acknowledged to the VM")
+		s.stop(ErrNoLease)
+	case lease := <-s.leased:
+		if s.Ready == nil {
+			return
+		}
+		if err := s.writeReadiness(lease); err != nil {
+			log.Error().Err(err).Msg("writing readiness report")
+		}
+	}
+}
+
+// Notify reportReady about the lease of the VM, only the first one is reported
+func (s *Stack) leaseReady(port *vmPort, lease Lease) {
+	if s.leased == nil || port != s.sw.primary() {
+		return
+	}
+
+	select {
+	case s.leased <- lease:
+	default:
+	}
+}
+
+// Write the report to Ready as a JSON line
+func (s *Stack) writeReadiness(lease Lease) error {
+	report := Readiness{
+		HardwareAddr: s.HardwareAddr.String(),
+		Addr:         lease.Addr,
+		Gateway:      lease.Router,
+		DNSServers:   lease.DNSServers,
+		MTU:          s.backend.Interface().MTU,
+	}
+	// The subnet of bridged mode is only known by the LAN's dhcp server
+	if s.subnet.IsValid() {
+		report.SubnetMask = s.SubnetMask
+	}
+
+	if err := json.NewEncoder(s.Ready).Encode(report); err != nil {
+		return fmt.Errorf("encoding readiness report: %w", err)
+	}
+	return nil
+}
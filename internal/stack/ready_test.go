@@ -0,0 +1,41 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var errTestStart = errors.New("start failed")
+
+// startFailedBackend fails to start
+type startFailedBackend struct {
+	discardBackend
+}
+
+func (startFailedBackend) Start() error { return errTestStart }
+
+// readyBuffer records the report, and whether it was closed
+type readyBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *readyBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+// Ready is closed without a report, when the stack fails to start
+func TestReadyClosedOnFailedStart(t *testing.T) {
+	ready := &readyBuffer{}
+	_, _, stop := startTestStack(t, NetworkParams{CustomBackend: startFailedBackend{}, Ready: ready})
+
+	if err := stop(); !errors.Is(err, errTestStart) {
+		t.Fatalf("got %v, want %v", err, errTestStart)
+	}
+	if !ready.closed || ready.Len() != 0 {
+		t.Errorf("got closed %v with %q, want closed without a report", ready.closed, ready.String())
+	}
+}
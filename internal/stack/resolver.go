@@ -0,0 +1,137 @@
+// nolint:exhaustivestruct,exhaustruct,godot
+package stack
+
+import (
+	"sync"
+
+	"github.com/google/gopacket/layers"
+	"inet.af/netaddr"
+)
+
+const (
+	// Domain of the VM names, if not configured otherwise, e.g: <vmname>.vm.local
+	DefaultLocalDomain = "vm.local"
+	// TTL of the locally answered records. Kept short, since leases may change.
+	localDNSTTL = 10
+)
+
+// localResolver answers the names of the VMs known to the process,
+// and the statically configured host overrides.
+type localResolver struct {
+	// Domain of the VM names, in lower case without the trailing dot
+	domain string
+	// Static host overrides, they take precedence over the VM names
+	static map[string][]netaddr.IP
+	// The VMs by their fully qualified names
+	vms map[string]*vmPort
+
+	m sync.RWMutex
+}
+
+func newLocalResolver(domain string, static map[string][]netaddr.IP) *localResolver {
+	hosts := make(map[string][]netaddr.IP, len(static))
+	for name, addrs := range static {
+		hosts[normalizeDomain(name)] = addrs
+	}
+
+	return &localResolver{
+		domain: normalizeDomain(domain),
+		static: hosts,
+		vms:    make(map[string]*vmPort),
+	}
+}
+
+// Registers a VM, so that <name>.<domain> resolves to its leased address
+func (r *localResolver) addVM(port *vmPort) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.vms[normalizeDomain(port.Name)+"."+r.domain] = port
+}
+
+// Returns the addresses of the name, as seen from the segment. The VMs of other
+// segments are unknown. The second return value reports whether the resolver
+// is authoritative for the name.
+func (r *localResolver) lookup(name string, segment uint16) ([]netaddr.IP, bool) {
+	name = normalizeDomain(name)
+	if addrs, ok := r.static[name]; ok {
+		return addrs, true
+	}
+
+	if !r.local(name) {
+		return nil, false
+	}
+	return r.vmAddr(name, segment, false), true
+}
+
+// Determine if the normalized name is in the domain of the VM names
+func (r *localResolver) local(name string) bool {
+	return matchDomain("*."+r.domain, name)
+}
+
+// Returns the leased address of the VM of the normalized name, if it's in the segment,
+// or in any segment if anySegment is set
+func (r *localResolver) vmAddr(name string, segment uint16, anySegment bool) []netaddr.IP {
+	r.m.RLock()
+	port, ok := r.vms[name]
+	r.m.RUnlock()
+	if !ok || !anySegment && port.Segment != segment {
+		return nil
+	}
+
+	if addr, ok := port.dm.leasedAddr(); ok {
+		return []netaddr.IP{addr}
+	}
+	return nil
+}
+
+// Answers the query, if the resolver is authoritative for the name.
+// Unknown names in the local domain are answered with NXDOMAIN.
+func (r *localResolver) answer(query *layers.DNS, segment uint16) (*layers.DNS, bool) {
+	addrs, ok := r.lookup(string(query.Questions[0].Name), segment)
+	if !ok {
+		return nil, false
+	}
+	return r.reply(query, addrs), true
+}
+
+// Answers the host's query for the names of the VMs, of every segment. The other names,
+// including the static host overrides, are refused: the host has its own resolvers for them.
+func (r *localResolver) answerHost(query *layers.DNS) *layers.DNS {
+	if len(query.Questions) != 1 {
+		return newDNSReply(query, layers.DNSResponseCodeFormErr)
+	}
+
+	name := normalizeDomain(string(query.Questions[0].Name))
+	if !r.local(name) {
+		return newDNSReply(query, layers.DNSResponseCodeRefused)
+	}
+	return r.reply(query, r.vmAddr(name, 0, true))
+}
+
+// The authoritative reply to the query of a name with the addresses,
+// or NXDOMAIN if it has none
+func (r *localResolver) reply(query *layers.DNS, addrs []netaddr.IP) *layers.DNS {
+	if len(addrs) == 0 {
+		return newDNSReply(query, layers.DNSResponseCodeNXDomain)
+	}
+
+	reply := newDNSReply(query, layers.DNSResponseCodeNoErr)
+	reply.AA = true
+
+	// Names with addresses, but queried for other types are answered without records
+	question := query.Questions[0]
+	if question.Type != layers.DNSTypeA || question.Class != layers.DNSClassIN {
+		return reply
+	}
+
+	for _, addr := range addrs {
+		reply.Answers = append(reply.Answers, layers.DNSResourceRecord{
+			Name:  question.Name,
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   localDNSTTL,
+			IP:    addr.IPAddr().IP,
+		})
+	}
+	return reply
+}
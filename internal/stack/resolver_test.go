@@ -0,0 +1,73 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"inet.af/netaddr"
+)
+
+func TestLocalResolverAnswer(t *testing.T) {
+	leased := &vmPort{VM: VM{Name: "Dev", Segment: 3}}
+	leased.dm.lease = lease{addr: netaddr.MustParseIP("192.168.64.5"), validUntil: time.Now().Add(time.Hour)}
+	unleased := &vmPort{VM: VM{Name: "idle", Segment: 3}}
+
+	r := newLocalResolver("vm.local.", map[string][]netaddr.IP{"Build.Internal": {netaddr.MustParseIP("10.1.1.1")}})
+	r.addVM(leased)
+	r.addVM(unleased)
+
+	tests := []struct {
+		name     string
+		query    string
+		segment  uint16
+		answered bool
+		code     layers.DNSResponseCode
+		addr     string
+	}{
+		{name: "vm", query: "dev.vm.local", segment: 3, answered: true, addr: "192.168.64.5"},
+		{name: "vm of another segment", query: "dev.vm.local", segment: 4, answered: true, code: layers.DNSResponseCodeNXDomain},
+		{name: "vm without lease", query: "idle.vm.local", segment: 3, answered: true, code: layers.DNSResponseCodeNXDomain},
+		{name: "unknown vm", query: "ghost.vm.local.", segment: 3, answered: true, code: layers.DNSResponseCodeNXDomain},
+		{name: "static host", query: "BUILD.internal", segment: 3, answered: true, addr: "10.1.1.1"},
+		{name: "external name", query: "example.com", segment: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := decodeDNS(dnsQuery(t, 1, tt.query))
+			reply, ok := r.answer(query, tt.segment)
+			if ok != tt.answered {
+				t.Fatalf("got answered %v, want %v", ok, tt.answered)
+			}
+			if !ok {
+				return
+			}
+			if reply.ResponseCode != tt.code {
+				t.Errorf("got %s, want %s", reply.ResponseCode, tt.code)
+			}
+			if tt.addr != "" && (len(reply.Answers) != 1 || reply.Answers[0].IP.String() != tt.addr) {
+				t.Errorf("got answers %v, want %s", reply.Answers, tt.addr)
+			}
+		})
+	}
+}
+
+// The static host overrides of allowed domains are learned by the egress policy
+func TestLocalAnswersAllowEgress(t *testing.T) {
+	s, vm := runTestStack(t, NetworkParams{
+		DNSHosts:       map[string][]netaddr.IP{"registry.internal": {netaddr.MustParseIP("10.0.0.5")}},
+		AllowedDomains: []string{"registry.internal"},
+	})
+	addr := leaseTestVM(t, vm)
+
+	_, _ = vm.Write(udpFrame(t, addr, testGateway, 5353, 53, dnsQuery(t, 9, "registry.internal")))
+	if _, reply := readDNSReply(t, vm); len(reply.Answers) != 1 {
+		t.Fatalf("got %d answers, want 1", len(reply.Answers))
+	}
+
+	if !s.allowEgress(netaddr.MustParseIP("10.0.0.5")) {
+		t.Error("static host not allowed")
+	}
+}
@@ -0,0 +1,171 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+var testTenantMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x44}
+
+// injectingBackend sends the frames of frames to the VMs, and passes the uplinked ones to uplinked
+type injectingBackend struct {
+	discardBackend
+	frames   chan []byte
+	uplinked chan []byte
+}
+
+func (b injectingBackend) Frames() <-chan []byte { return b.frames }
+
+func (b injectingBackend) Write(p []byte) (int, error) {
+	select {
+	case b.uplinked <- append([]byte(nil), p...):
+	default:
+	}
+	return len(p), nil
+}
+
+// The test's end of a VM socket, and the stack's end
+func vmSocket(t *testing.T) (net.Conn, int) {
+	t.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fds[1]), "vm")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, fds[0]
+}
+
+// Fails if the VM receives a frame in a while
+func expectNoFrame(t *testing.T, vm net.Conn) {
+	t.Helper()
+
+	_ = vm.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := vm.Read(make([]byte, 65536))
+	if err == nil {
+		t.Fatalf("got a frame of %d bytes, want none", n)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal(err)
+	}
+}
+
+// Runs a stack of the VM leased testVMAddr and the peer VM leased 192.168.64.3 in segment 0,
+// and a VM of another tenant leased 192.168.64.4 in segment 1
+func runTenantStack(t *testing.T) (vm, peer, tenant net.Conn, backend injectingBackend) {
+	t.Helper()
+
+	peer, peerFd := vmSocket(t)
+	tenant, tenantFd := vmSocket(t)
+	backend = injectingBackend{frames: make(chan []byte, 8), uplinked: make(chan []byte, 64)}
+
+	s, vm := runTestStack(t, NetworkParams{
+		CustomBackend: backend,
+		PeerVMs: []VM{
+			{Fd: peerFd, HardwareAddr: testPeerMAC},
+			{Fd: tenantFd, HardwareAddr: testTenantMAC, Segment: 1},
+		},
+	})
+	for i, port := range s.sw.ports {
+		port.dm.m.Lock()
+		port.dm.lease = lease{addr: netaddr.IPv4(192, 168, 64, byte(2+i)), validUntil: time.Now().Add(time.Hour)}
+		port.dm.m.Unlock()
+		s.sw.learn(port.HardwareAddr, port)
+	}
+	return vm, peer, tenant, backend
+}
+
+func TestSegmentUnicast(t *testing.T) {
+	vm, peer, tenant, _ := runTenantStack(t)
+	peerAddr, tenantAddr := net.IPv4(192, 168, 64, 3).To4(), net.IPv4(192, 168, 64, 4).To4()
+
+	_, _ = vm.Write(ipv4Frame(t, testVMMAC, testTenantMAC, testVMAddr, tenantAddr, &layers.UDP{SrcPort: 4000, DstPort: 4000}))
+	// Addressed to the tenant's IP address, through the MAC address of the peer
+	_, _ = vm.Write(ipv4Frame(t, testVMMAC, testPeerMAC, testVMAddr, tenantAddr, &layers.UDP{SrcPort: 4001, DstPort: 4000}))
+	_, _ = vm.Write(ipv4Frame(t, testVMMAC, testPeerMAC, testVMAddr, peerAddr, &layers.UDP{SrcPort: 4002, DstPort: 4000}))
+
+	packet := readFrame(t, peer, func(gopacket.Packet) bool { return true })
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || udp.SrcPort != 4002 {
+		t.Errorf("got %v, want the frame addressed to the peer", packet)
+	}
+	expectNoFrame(t, peer)
+	expectNoFrame(t, tenant)
+}
+
+// The broadcasts are flooded to the VMs of the segment only, the backend gets them too
+func TestSegmentBroadcast(t *testing.T) {
+	vm, peer, tenant, backend := runTenantStack(t)
+
+	request := serializeFrame(t,
+		&layers.Ethernet{SrcMAC: testVMMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   testVMMAC,
+			SourceProtAddress: testVMAddr,
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    net.IPv4(192, 168, 64, 4).To4(),
+		},
+	)
+	_, _ = vm.Write(request)
+
+	readFrame(t, peer, func(p gopacket.Packet) bool { return p.Layer(layers.LayerTypeARP) != nil })
+	select {
+	case <-backend.uplinked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast not uplinked")
+	}
+	expectNoFrame(t, tenant)
+}
+
+// The host routes the frames between the VMs of the vmnet interface, the ones of another segment are dropped
+func TestSegmentFromHost(t *testing.T) {
+	vm, _, tenant, backend := runTenantStack(t)
+	peerAddr, tenantAddr := net.IPv4(192, 168, 64, 3).To4(), net.IPv4(192, 168, 64, 4).To4()
+
+	tests := []struct {
+		name    string
+		src     net.IP
+		allowed bool
+	}{
+		{name: "from the VM of another segment", src: tenantAddr},
+		{name: "from the peer VM", src: peerAddr, allowed: true},
+		{name: "from the internet", src: testRemote, allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend.frames <- ipv4Frame(t, testHostMAC, testVMMAC, tt.src, testVMAddr, &layers.UDP{SrcPort: 4000, DstPort: 4000})
+			if !tt.allowed {
+				expectNoFrame(t, vm)
+				return
+			}
+			packet := readFrame(t, vm, func(gopacket.Packet) bool { return true })
+			if ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ok || !ip.SrcIP.Equal(tt.src) {
+				t.Errorf("got %v, want the frame from %s", packet, tt.src)
+			}
+		})
+	}
+
+	// The tenant is still reached from the host, e.g. from the internet
+	backend.frames <- ipv4Frame(t, testHostMAC, testTenantMAC, testRemote, tenantAddr, &layers.UDP{SrcPort: 4000, DstPort: 4000})
+	readFrame(t, tenant, func(gopacket.Packet) bool { return true })
+}
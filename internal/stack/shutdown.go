@@ -0,0 +1,160 @@
+// nolint:godot
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long the frames already read are sent on shutdown, if not configured otherwise
+const DefaultDrainTimeout = time.Second
+
+// workers of the datapath, stopped in order by shutdown
+type workers struct {
+	// Cancelled when the stack stops, the workers don't take new frames afterwards
+	intake     context.Context
+	stopIntake context.CancelFunc
+	// Cancelled at the drain deadline, the frames not sent by then are dropped
+	drain     context.Context
+	stopDrain context.CancelFunc
+
+	// Readers of the VMs' sockets
+	readers sync.WaitGroup
+	// Every other worker: the workers of the multi-queue datapath, and the senders of the backend's frames
+	senders sync.WaitGroup
+	// The backend's supervisor and the lease watcher, stopped with the intake,
+	// so that the backend isn't restarted while it's stopped
+	background sync.WaitGroup
+	// Goroutines serving the VMs beside the datapath: the queries forwarded by the DNS proxy,
+	// and the port forwards. Joined before the backend is stopped and the sockets are closed.
+	tasks sync.WaitGroup
+}
+
+func newWorkers() *workers {
+	w := &workers{}
+	w.intake, w.stopIntake = context.WithCancel(context.Background())
+	w.drain, w.stopDrain = context.WithCancel(context.Background())
+	return w
+}
+
+// Run f in a new goroutine, joined by wg
+func (w *workers) run(wg *sync.WaitGroup, f func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f()
+	}()
+}
+
+// Returns the next frame. Once the intake is stopped, only the frames already
+// queued are returned, until the drain deadline. Returns false if there are no more.
+func nextFrame(intake, drain context.Context, frames <-chan []byte) ([]byte, bool) {
+	select {
+	case <-drain.Done():
+		return nil, false
+	case bytes, ok := <-frames:
+		return bytes, ok
+	case <-intake.Done():
+	}
+
+	select {
+	case <-drain.Done():
+		return nil, false
+	case bytes, ok := <-frames:
+		return bytes, ok
+	default:
+		return nil, false
+	}
+}
+
+// Stop the stack in order: stop the intake of the VMs' and the backend's frames,
+// send the frames already read until the drain deadline, join the workers and the tasks,
+// then stop the backend and close the VMs' sockets.
+// Returns the errors of every step.
+func (s *Stack) shutdown(w *workers) error {
+	var errs []error
+
+	w.stopIntake()
+	w.background.Wait()
+
+	// Unblock the readers of the VMs' sockets
+	for _, port := range s.sw.ports {
+		// The sockets of the peer VMs which hung up are closed already
+		if err := port.conn.SetReadDeadline(time.Now()); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, fmt.Errorf("stopping reads of %s: %w", port.HardwareAddr, err))
+		}
+	}
+
+	timeout := s.DrainTimeout
+	if timeout == 0 {
+		timeout = DefaultDrainTimeout
+	}
+
+	// The VMs might not read their sockets anymore, the blocked writes are given up at the deadline
+	deadline := time.AfterFunc(timeout, func() {
+		w.stopDrain()
+		for _, port := range s.sw.ports {
+			port.conn.SetWriteDeadline(time.Now())
+		}
+	})
+
+	w.readers.Wait()
+	if s.queues != nil {
+		// The VMs' frames already queued are still handled
+		s.queues.closeVM()
+	}
+	w.senders.Wait()
+	// The datapath doesn't start new tasks anymore, the port forwards are closed with the intake,
+	// and the queries being forwarded are given up at the drain deadline
+	w.tasks.Wait()
+
+	if !deadline.Stop() {
+		log.Warn().Dur("timeout", timeout).Msg("drain deadline exceeded, frames were dropped")
+	}
+	w.stopDrain()
+
+	log.Info().Msg("Stopping backend")
+	if err := s.backend.Stop(); err != nil {
+		errs = append(errs, fmt.Errorf("stopping backend: %w", err))
+	}
+
+	s.logStats()
+
+	if err := s.closeConns(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close the VMs' sockets
+func (s *Stack) closeConns() error {
+	var errs []error
+	for _, port := range s.sw.ports {
+		if port.conn == nil {
+			continue
+		}
+
+		if err := port.close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing socket of %s: %w", port.HardwareAddr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Stack) logStats() {
+	stats := s.Stats()
+	log.Info().Uint64("queued", stats.Queue.Queued).Uint64("waited", stats.Queue.Waited).
+		Uint64("dropped_tail", stats.Queue.DroppedTail).Uint64("dropped_head", stats.Queue.DroppedHead).
+		Uint64("timed_out", stats.Queue.TimedOut).Uint64("prioritized", stats.Queue.Prioritized).
+		Uint64("dropped_to_vm", stats.DroppedToVM).Uint64("backend_restarts", stats.BackendRestarts).
+		Uint64("truncated_from_vm", stats.TruncatedFromVM).Uint64("oversized_from_vm", stats.OversizedFromVM).
+		Uint64("oversized_to_vm", stats.OversizedToVM).Uint64("dropped_fragments", stats.DroppedFragments).
+		Msg("Frames sent to the VMs")
+}
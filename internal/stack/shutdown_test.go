@@ -0,0 +1,113 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// An upstream resolver which never answers
+func runSilentUpstream(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxDNSMessageSize)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// Waits until cond holds, or fails the test
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The queries being forwarded are given up at the drain deadline, and joined before Run returns
+func TestShutdownJoinsDNSQueries(t *testing.T) {
+	s, vm, stop := startTestStack(t, NetworkParams{
+		DNSUpstreams: []string{runSilentUpstream(t)},
+		DrainTimeout: 100 * time.Millisecond,
+	})
+	t.Cleanup(func() { _ = stop() })
+	addr := leaseTestVM(t, vm)
+
+	_, _ = vm.Write(udpFrame(t, addr, testGateway, 5353, 53, dnsQuery(t, 1, "example.com")))
+	eventually(t, func() bool { return len(s.dns.inFlight) == 1 })
+
+	start := time.Now()
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= defaultDNSTimeout {
+		t.Errorf("stopped in %s, the query wasn't given up", elapsed)
+	}
+	if n := len(s.dns.inFlight); n != 0 {
+		t.Errorf("got %d queries in flight after Run returned", n)
+	}
+}
+
+// The forwarded connections are closed, and their goroutines joined before Run returns
+func TestShutdownClosesPortForwards(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostAddr := ln.Addr().String()
+	ln.Close()
+
+	_, vm, stop := startTestStack(t, NetworkParams{
+		PortForwards: []PortForward{{Network: "tcp", HostAddr: hostAddr, VMPort: 22}},
+	})
+	t.Cleanup(func() { _ = stop() })
+	addr := leaseTestVM(t, vm)
+
+	// The VM never accepts the connection, it's being dialed until the stack stops
+	client, err := net.Dial("tcp", hostAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// The backend resolves the VM's address first
+	readFrame(t, vm, func(p gopacket.Packet) bool {
+		arp, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+		return ok && arp.Operation == layers.ARPRequest && net.IP(arp.DstProtAddress).Equal(addr)
+	})
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closed before Run returned
+	_ = client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want the connection closed", err)
+	}
+	if _, err := net.Dial("tcp", hostAddr); err == nil {
+		t.Error("the port forward is still listening")
+	}
+}
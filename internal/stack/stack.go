@@ -3,16 +3,40 @@ package stack
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
-	"github.com/google/gopacket"
-	"github.com/nagypeterjob/sock-vmnet/internal/vmnet"
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"github.com/nagypeterjob/sock-vmnet/internal/dgram"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"inet.af/netaddr"
 )
 
-// NetworkParams is a collection of parameters needed for vmnet
+// NetworkMode defines what the VM is allowed to reach
+type NetworkMode string
+
+const (
+	// The VM reaches the internet through NAT
+	ModeShared NetworkMode = "shared"
+	// The VM can only reach the host and the peer VMs on the same subnet
+	ModeHost NetworkMode = "host"
+	// The VM joins the LAN of a host interface, its address comes from the LAN's dhcp server
+	ModeBridged NetworkMode = "bridged"
+)
+
+var (
+	errUnknownMode         = errors.New("unknown network mode")
+	errDNSProxyInHostMode  = errors.New("the DNS proxy would give the VM a path to the internet in host mode")
+	errNoBridgeInterface   = errors.New("bridged mode requires a bridge interface")
+	errHostDNSWithoutNames = errors.New("the host's DNS queries are only answered for the VM names, no VM is named")
+)
+
+// NetworkParams is a collection of parameters needed for the stack and its backend
 type NetworkParams struct {
 	// Socket file descriptor
 	Fd int
@@ -20,16 +44,96 @@ type NetworkParams struct {
 	HardwareAddr net.HardwareAddr
 	// Enables debug logging
 	Debug bool
+	// The host side of the network. Default Backend is vmnet.
+	Backend BackendKind
+	// Default Mode is shared
+	Mode NetworkMode
+	// Host interface the VM is bridged to in bridged mode, e.g. en0
+	BridgeInterface string
+	// The only dhcp server trusted to hand out the VMs' leases. Default DHCPServer is the gateway,
+	// in bridged mode it's the LAN's dhcp server which acknowledges the first lease of the VM.
+	DHCPServer netaddr.IP
 	// First IP address of the subnet operated by macOS's built-in DHCP server.
 	// The running vms get IP address assigned from the (StartAddr + 1) - EndAddr range.
 	// The StartAddr will be the gateway address exclusively.
-	// Default StartAddr is 192.168.64.1.
+	// Default StartAddr is 192.168.64.1. Ignored in bridged mode.
 	StartAddr netaddr.IP
 	// Last IP address of the subnet operated by macOS's built-in DHCP server.
 	// Default StartAddr is 192.168.64.255.
 	EndAddr netaddr.IP
 	// The default ubnet mask is 255.255.255.0
 	SubnetMask netaddr.IP
+	// MTU of the VM's interface. Default MTU is chosen by the backend, 1500.
+	MTU int
+	// Let the VM reach the VMs of other vmnet interfaces. Only used by the vmnet backend.
+	DisableIsolation bool
+	// UUID of the vmnet network, the VMs of the processes started with the same identifier
+	// share a network. Only used by the vmnet backend in host mode, where vmnet doesn't run
+	// a dhcp server on these networks.
+	NetworkID string
+	// ULA /64 prefix of the VM's IPv6 address, e.g. fd9b:5a14:ba57:e3d3::/64.
+	// Only used by the vmnet backend in shared mode. Default NAT66Prefix is chosen by vmnet.
+	NAT66Prefix string
+	// Ports of the host's loopback interface the VM reaches through the gateway.
+	// Only used by the userspace backend. Default HostPorts is none.
+	HostPorts []uint16
+	// Upstream resolvers of the embedded DNS proxy, in host[:port] format.
+	// If not empty, DNS queries sent by the VM to the gateway (or to the DNS servers
+	// offered by dhcp) are answered by the proxy instead of being passed to the backend.
+	DNSUpstreams []string
+	// Domain names the VM is allowed to reach, e.g. pypi.org or *.github.com.
+	// If not empty, the VM can only send traffic beyond the gateway to addresses
+	// it resolved from these names, until the TTL of the DNS answer expires.
+	AllowedDomains []string
+	// Path of a hosts file or a list of domain names, one per line.
+	// Queries sent by the VM for these names are answered with NXDOMAIN.
+	DNSBlocklist string
+	// Log the names the VM queries and the response codes of the replies
+	LogDNS bool
+	// Name of the VM. If set, the VM's leased address is resolvable as <VMName>.<LocalDomain>
+	// by the VM itself and the peer VMs of its segment, and by the host through HostDNSAddr.
+	VMName string
+	// Domain of the VM names. Default LocalDomain is vm.local.
+	LocalDomain string
+	// UDP address the VM names of every segment are answered on to the host's DNS queries,
+	// e.g. 127.0.0.1:5354. Default HostDNSAddr is empty, the host can't resolve the names.
+	HostDNSAddr string
+	// Static host overrides answered to the VM's queries
+	DNSHosts map[string][]netaddr.IP
+	// Ports of the VM exposed on the host
+	PortForwards []PortForward
+	// Segment of the VM, see VM.Segment
+	Segment uint16
+	// Additional VMs attached to the stack's switch. The VMs of the same segment
+	// reach each other directly, and share the backend with the VM of Fd.
+	PeerVMs []VM
+	// Number of workers per direction. If greater than 1, the frames are hashed
+	// to the workers by their addresses, protocol and ports, so that filtering and decoding scale across cores,
+	// while the frames of a flow keep their order. A VM's socket is still read by
+	// a single goroutine, and its writes are serialized. Default Queues is 1.
+	Queues int
+	// What happens to the frames read from the backend when its queue is full.
+	// Default QueuePolicy is drop-tail.
+	QueuePolicy backpressure.Policy
+	// Number of frames queued by the backend. Default QueueDepth is 100.
+	QueueDepth int
+	// How long the block policy waits for room in the queue. Default QueueTimeout is 10ms.
+	QueueTimeout time.Duration
+	// Notified about the leases of the VMs, the spoofed and the dropped frames,
+	// the failures of the backend and the closed sockets. Default Observer is nil.
+	Observer Observer
+	// The readiness report of the VM of Fd is written to, once its first lease is
+	// acknowledged, then it's closed. It's closed by Run without a report, if the stack
+	// fails to start. Default Ready is nil, no report is written.
+	Ready io.WriteCloser
+	// Run returns ErrNoLease, if the VM of Fd isn't acknowledged a lease in time.
+	// Default ReadyTimeout is 0, Run waits for the lease forever.
+	ReadyTimeout time.Duration
+	// Used instead of the backend of Backend, if set, e.g. a backend implemented by the embedder
+	CustomBackend Backend
+	// How long the frames already read are sent to the VMs and the backend once the stack
+	// is stopped. The frames left afterwards are dropped. Default DrainTimeout is 1s.
+	DrainTimeout time.Duration
 }
 
 // Represents a dhcpd lease, e.g:
@@ -46,78 +150,326 @@ type NetworkParams struct {
 
 // Stack orchestrates the duplex socket communication
 type Stack struct {
-	// Network parameters passed to vmnet
+	// Network parameters passed to the backend
 	NetworkParams
-	// Manages dhcp communication
-	dm dhcpManager
+	// Switches the frames between the VMs, the dhcp communication is managed per VM
+	sw *l2Switch
 
-	// Gateway IP
+	// Gateway IP, learned from dhcp in bridged mode
 	gateway netaddr.IP
+	// The subnet of the VMs and the gateway
+	subnet netaddr.IPPrefix
+
+	// The host side of the network, e.g. the vmnet API
+	backend Backend
+
+	// Embedded DNS proxy, nil if disabled
+	dns *dnsProxy
+
+	// Domain based egress allowlist, nil if disabled
+	egress *egressPolicy
+
+	// Names the VM isn't allowed to resolve, nil if disabled
+	blocklist *dnsBlocklist
 
-	// Represents the vmnet API
-	vmnet *vmnet.VMNet
+	// Resolves the VM names and the static host overrides, nil if disabled
+	resolver *localResolver
 
-	// Store the DecodeOptions in Stack, and use it at multiple places
-	// to avoid code duplication
-	packetDecodeOptions gopacket.DecodeOptions
+	// Logs the queries and the replies if LogDNS is set, independently of the log level
+	dnsLog zerolog.Logger
+
+	// Workers of the multi-queue datapath, nil if disabled
+	queues *queues
+	// Workers of the running stack, set by Run
+	workers *workers
+
+	// Frames dropped, because the VM's socket couldn't be written
+	droppedToVM atomic.Uint64
+	// Frames dropped, because they exceeded the MTU, see fitsMTU
+	truncatedFromVM atomic.Uint64
+	oversizedFromVM atomic.Uint64
+	oversizedToVM   atomic.Uint64
+	// Fragments dropped by the fragment policy, see allowFragment
+	droppedFragments atomic.Uint64
+	// MTU of the VMs' interfaces, set once the backend is started
+	linkMTU atomic.Int64
+	// Restarts of the backend by the supervisor
+	backendRestarts atomic.Uint64
+
+	// Stops Run with the cause, set by Run
+	stop context.CancelCauseFunc
+
+	// The first lease of the VM of Fd, nil if there's no readiness report, nor a timeout
+	leased chan Lease
+}
+
+// Stats counts the frames dropped between the backend and the VMs
+type Stats struct {
+	// Outcomes of the frames read from the backend
+	Queue backpressure.Stats
+	// Frames dropped, because the VM's socket couldn't be written,
+	// e.g. its buffer was full (ENOBUFS)
+	DroppedToVM uint64
+	// Restarts of the backend after a transient failure
+	BackendRestarts uint64
+	// Frames of the VMs which didn't fit the read buffer
+	TruncatedFromVM uint64
+	// Frames of the VMs which exceeded the MTU
+	OversizedFromVM uint64
+	// Frames read from the backend which exceeded the MTU
+	OversizedToVM uint64
+	// Fragments of the VMs dropped by the fragment policy, e.g. tiny or overlapping ones
+	DroppedFragments uint64
+}
+
+// Stats returns the counters of the stack
+func (s *Stack) Stats() Stats {
+	stats := Stats{
+		Queue:            s.backend.QueueStats(),
+		DroppedToVM:      s.droppedToVM.Load(),
+		BackendRestarts:  s.backendRestarts.Load(),
+		TruncatedFromVM:  s.truncatedFromVM.Load(),
+		OversizedFromVM:  s.oversizedFromVM.Load(),
+		OversizedToVM:    s.oversizedToVM.Load(),
+		DroppedFragments: s.droppedFragments.Load(),
+	}
+	// The held fragments aren't known to be dropped until their first fragment's verdict
+	for _, port := range s.sw.ports {
+		stats.DroppedFragments += port.fragments.discarded.Load()
+	}
+	return stats
 }
 
 // NewNetwork creates a new Network.
 //
+// With the vmnet backend:
+//
 // - NAT provided by vmnet
 //
 // - vmenet(n) interface
 //
 // - bridge100 interface
+//
+// - in bridged mode, the VM joins the LAN of BridgeInterface instead
+//
+// With the userspace backend:
+//
+// - NAT provided by a userspace TCP/IP stack, no host interfaces are created
 func NewNetwork(p NetworkParams) (*Stack, error) {
 	// First IP of the range is reserved for the gateway
 	gateway := p.StartAddr
 
-	return &Stack{
+	switch p.Mode {
+	case "":
+		p.Mode = ModeShared
+	case ModeShared:
+	case ModeHost:
+		if len(p.DNSUpstreams) > 0 {
+			return nil, errDNSProxyInHostMode
+		}
+	case ModeBridged:
+		if p.BridgeInterface == "" {
+			return nil, errNoBridgeInterface
+		}
+		// The gateway is offered by the LAN's dhcp server
+		gateway = netaddr.IP{}
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownMode, p.Mode)
+	}
+
+	var subnet netaddr.IPPrefix
+	if !gateway.IsZero() {
+		prefixLen, _ := net.IPMask(p.SubnetMask.IPAddr().IP.To4()).Size()
+		prefix, err := gateway.Prefix(uint8(prefixLen))
+		if err != nil {
+			return nil, fmt.Errorf("calculating subnet: %w", err)
+		}
+		subnet = prefix
+	}
+
+	backend, err := newBackend(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var dns *dnsProxy
+	if len(p.DNSUpstreams) > 0 {
+		dns = newDNSProxy(p.DNSUpstreams)
+	}
+
+	var egress *egressPolicy
+	if len(p.AllowedDomains) > 0 {
+		egress = newEgressPolicy(p.AllowedDomains)
+	}
+
+	var blocklist *dnsBlocklist
+	if p.DNSBlocklist != "" {
+		if blocklist, err = loadDNSBlocklist(p.DNSBlocklist); err != nil {
+			return nil, err
+		}
+	}
+
+	vms := append([]VM{{Fd: p.Fd, HardwareAddr: p.HardwareAddr, Name: p.VMName, Segment: p.Segment}}, p.PeerVMs...)
+	// The built-in dhcp server runs on the gateway
+	dhcpServer := gateway
+	if !p.DHCPServer.IsZero() {
+		dhcpServer = p.DHCPServer
+	}
+
+	sw, err := newSwitch(vms, dhcpServer)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsLog := zerolog.Nop()
+	if p.LogDNS {
+		dnsLog = log.Logger.Level(zerolog.InfoLevel)
+	}
+
+	st := &Stack{
 		NetworkParams: p,
 		gateway:       gateway,
-		dm: dhcpManager{
-			lease: lease{},
-		},
-		vmnet: vmnet.New(vmnet.Params{
-			StartAddr:  p.StartAddr,
-			EndAddr:    p.EndAddr,
-			SubnetMask: p.SubnetMask,
-			Debug:      p.Debug,
-		}),
-		// Lazy && NoCopy should be the fastest mode with the least allocations
-		packetDecodeOptions: gopacket.DecodeOptions{Lazy: true, NoCopy: true},
-	}, nil
+		subnet:        subnet,
+		sw:            sw,
+		backend:       backend,
+		dns:           dns,
+		egress:        egress,
+		blocklist:     blocklist,
+		dnsLog:        dnsLog,
+	}
+
+	if p.HostDNSAddr != "" && !hasVMNames(vms) {
+		return nil, errHostDNSWithoutNames
+	}
+	if hasVMNames(vms) || len(p.DNSHosts) > 0 {
+		domain := p.LocalDomain
+		if domain == "" {
+			domain = DefaultLocalDomain
+		}
+
+		st.resolver = newLocalResolver(domain, p.DNSHosts)
+		for _, port := range sw.ports {
+			if port.Name != "" {
+				st.resolver.addVM(port)
+			}
+		}
+	}
+
+	return st, nil
 }
 
-// Run the networking stack.
-func (s *Stack) Run(ctx context.Context) error {
-	cntx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// Run the networking stack until ctx is done, the VM of Fd closes its socket, or the backend fails
+// for good, then shut it down in order. Returns the errors of the startup, or of the shutdown,
+// and ErrVMClosed if the VM closed its socket, ErrBackendFailed if the backend failed.
+func (s *Stack) Run(ctx context.Context) (err error) {
+	cntx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	s.stop = cancel
 
-	// New FileConn from the socket's file descriptor
-	// From this point we can Read/Write the socket as with any net.Conn impl.
-	conn, err := fileConn(s.Fd)
-	if err != nil {
-		return fmt.Errorf("opening file connection: %w", err)
+	w := newWorkers()
+	s.workers = w
+
+	// Closes the sockets and Ready, and stops the backend if the stack fails to start,
+	// otherwise shutdown and reportReady do it
+	started := false
+	backendStarted := false
+	defer func() {
+		if started {
+			return
+		}
+		// Closes the port forwards already listening
+		cancel(nil)
+		w.tasks.Wait()
+		if backendStarted {
+			if stopErr := s.backend.Stop(); stopErr != nil {
+				err = errors.Join(err, fmt.Errorf("stopping backend: %w", stopErr))
+			}
+		}
+		if closeErr := s.closeConns(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+		// No report is written, reportReady isn't started
+		if s.Ready != nil {
+			if closeErr := s.Ready.Close(); closeErr != nil {
+				err = errors.Join(err, fmt.Errorf("closing readiness report: %w", closeErr))
+			}
+		}
+	}()
+
+	// New FileConn from the sockets' file descriptor
+	// From this point we can Read/Write the sockets as with any net.Conn impl.
+	for _, port := range s.sw.ports {
+		conn, err := fileConn(port.Fd)
+		if err != nil {
+			return fmt.Errorf("opening file connection: %w", err)
+		}
+		port.conn = conn
+
+		if port.frames, err = dgram.New(conn); err != nil {
+			return fmt.Errorf("opening batched connection: %w", err)
+		}
 	}
-	defer conn.Close()
 
-	// Start vmnet operations
-	if err := s.vmnet.Start(); err != nil {
+	// Start backend operations
+	if err := s.backend.Start(); err != nil {
 		return fmt.Errorf("starting interface: %w", err)
 	}
+	backendStarted = true
 
-	defer func() {
-		log.Info().Msg("Stopping vmnet")
-		s.vmnet.Stop()
-	}()
+	if err := s.checkInterface(); err != nil {
+		return err
+	}
 
-	// read & write vmnet
-	go s.read(cntx, conn)
-	go s.write(cntx, conn)
+	if err := s.startPortForwards(cntx, w); err != nil {
+		return err
+	}
+	if s.HostDNSAddr != "" {
+		if err := s.startHostDNS(cntx, w); err != nil {
+			return err
+		}
+	}
+	started = true
+
+	// Set before the workers inspecting the leases are started
+	if s.Ready != nil || s.ReadyTimeout > 0 {
+		s.leased = make(chan Lease, 1)
+	}
+
+	// read & write the backend, each VM is written by its own worker
+	if s.Queues > 1 {
+		// The frame size is only known once the backend is started
+		s.queues = newQueues(s.Queues, s.readBufferSize())
+		s.startQueues(w)
+	} else {
+		w.run(&w.senders, func() { s.read(w.intake, w.drain, s.backend.Frames()) })
+	}
+	for _, port := range s.sw.ports {
+		w.run(&w.readers, func() { s.write(w, port) })
+	}
+	w.run(&w.background, func() { s.supervise(w) })
+	w.run(&w.background, func() { s.watchHangUps(w) })
+	if s.Observer != nil {
+		w.run(&w.background, func() { s.watchLeases(w) })
+		w.run(&w.background, func() { s.watchQueue(w) })
+	}
+	if s.leased != nil {
+		w.run(&w.background, func() { s.reportReady(w) })
+	}
 
 	<-cntx.Done()
 
-	return nil
+	err = s.shutdown(w)
+	// Stopped by the stack itself
+	if cause := context.Cause(cntx); errors.Is(cause, ErrVMClosed) || errors.Is(cause, ErrBackendFailed) || errors.Is(cause, ErrNoLease) {
+		return errors.Join(cause, err)
+	}
+	return err
+}
+
+// Returns the VM's gateway. In bridged mode it's the router offered by the LAN's dhcp server.
+func (s *Stack) gatewayAddr() netaddr.IP {
+	if s.gateway.IsZero() {
+		return s.sw.primary().dm.router()
+	}
+	return s.gateway
 }
@@ -0,0 +1,156 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+var (
+	testVMMAC   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x42}
+	testGateway = net.IPv4(192, 168, 64, 1).To4()
+)
+
+// Starts a stack with the userspace backend for the VM at the returned end of a socketpair.
+// The stack is stopped once the test ends.
+func runTestStack(t *testing.T, p NetworkParams) (*Stack, net.Conn) {
+	t.Helper()
+
+	s, vm, stop := startTestStack(t, p)
+	t.Cleanup(func() { _ = stop() })
+	return s, vm
+}
+
+// Starts a stack like runTestStack, stop stops it and returns the error of Run
+func startTestStack(t *testing.T, p NetworkParams) (*Stack, net.Conn, func() error) {
+	t.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// FileConn dups the descriptor, closing vm closes the VM's end
+	f := os.NewFile(uintptr(fds[1]), "vm")
+	vm, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { vm.Close() })
+
+	p.Fd = fds[0]
+	p.HardwareAddr = testVMMAC
+	p.StartAddr = netaddr.MustParseIP("192.168.64.1")
+	p.EndAddr = netaddr.MustParseIP("192.168.64.255")
+	p.SubnetMask = netaddr.MustParseIP("255.255.255.0")
+	if p.CustomBackend == nil {
+		p.Backend = BackendUserspace
+	}
+
+	s, err := NewNetwork(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	stop := sync.OnceValue(func() error {
+		cancel()
+		return <-done
+	})
+	return s, vm, stop
+}
+
+// Leases an address to the VM over dhcp
+func leaseTestVM(t *testing.T, vm net.Conn) net.IP {
+	t.Helper()
+
+	_, _ = vm.Write(dhcpFrame(t, layers.DHCPMsgTypeDiscover, nil))
+	offer := readDHCP(t, vm)
+	_, _ = vm.Write(dhcpFrame(t, layers.DHCPMsgTypeRequest, offer.YourClientIP))
+	ack := readDHCP(t, vm)
+
+	return ack.YourClientIP.To4()
+}
+
+func serializeFrame(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// A frame of the VM to dst
+func udpFrame(t *testing.T, src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: testVMMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+
+	return serializeFrame(t, eth, ip, udp, gopacket.Payload(payload))
+}
+
+func dhcpFrame(t *testing.T, msgType layers.DHCPMsgType, requested net.IP) []byte {
+	t.Helper()
+
+	opts := layers.DHCPOptions{layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)})}
+	if requested != nil {
+		opts = append(opts, layers.NewDHCPOption(layers.DHCPOptRequestIP, requested.To4()))
+	}
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          7,
+		ClientHWAddr: testVMMAC,
+		Options:      opts,
+	}
+	eth := &layers.Ethernet{SrcMAC: testVMMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4zero.To4(), DstIP: net.IPv4bcast.To4()}
+	udp := &layers.UDP{SrcPort: 68, DstPort: 67}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+
+	return serializeFrame(t, eth, ip, udp, dhcp)
+}
+
+// Reads frames sent to the VM until match returns a layer
+func readFrame(t *testing.T, vm net.Conn, match func(gopacket.Packet) bool) gopacket.Packet {
+	t.Helper()
+
+	buf := make([]byte, 65536)
+	for {
+		_ = vm.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := vm.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := gopacket.NewPacket(append([]byte(nil), buf[:n]...), layers.LayerTypeEthernet, gopacket.Default)
+		if match(packet) {
+			return packet
+		}
+	}
+}
+
+func readDHCP(t *testing.T, vm net.Conn) *layers.DHCPv4 {
+	t.Helper()
+
+	packet := readFrame(t, vm, func(p gopacket.Packet) bool { return p.Layer(layers.LayerTypeDHCPv4) != nil })
+	return packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+}
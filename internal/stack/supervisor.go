@@ -0,0 +1,129 @@
+// nolint:godot
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+)
+
+// Variables, so that the tests don't wait for long
+var (
+	// Wait before the first restart of the backend, doubled after every failed attempt
+	restartMinBackoff = 100 * time.Millisecond
+	// Longest wait between the restarts of the backend
+	restartMaxBackoff = 30 * time.Second
+)
+
+// ErrBackendFailed is returned by Run, when the backend failed, and restarting it can't help
+var ErrBackendFailed = errors.New("backend failed")
+
+// Restart the backend when it fails, until the intake is stopped.
+// Transient failures are retried with exponential backoff, while the VMs' sockets
+// stay open. The stack is stopped with ErrBackendFailed on a fatal failure.
+func (s *Stack) supervise(w *workers) {
+	for {
+		select {
+		case <-w.intake.Done():
+			return
+		case err := <-s.backend.Failures():
+			if !s.restart(w, err) {
+				return
+			}
+		}
+	}
+}
+
+// Restart the backend, until it starts or fails for good.
+// Returns false if the backend is down, or the intake is stopped.
+func (s *Stack) restart(w *workers, err error) bool {
+	backoff := restartMinBackoff
+	for attempt := 1; ; attempt++ {
+		s.emit(Event{Kind: EventBackendError, Err: err})
+		if !s.backend.Transient(err) {
+			log.Error().Err(err).Msg("backend failed")
+			s.stop(fmt.Errorf("%w: %w", ErrBackendFailed, err))
+			return false
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("backoff", backoff).Msg("restarting backend")
+		select {
+		case <-w.intake.Done():
+			return false
+		case <-time.After(backoff):
+		}
+
+		if err = s.backend.Restart(); err == nil {
+			break
+		}
+		backoff = min(2*backoff, restartMaxBackoff)
+	}
+
+	s.backendRestarts.Add(1)
+	log.Info().Msg("backend restarted")
+
+	// The VMs keep their leases, they can't follow the network elsewhere
+	if err := s.checkInterface(); err != nil {
+		s.stop(fmt.Errorf("%w: %w", ErrBackendFailed, err))
+		return false
+	}
+
+	s.announceLeases()
+	return true
+}
+
+// The leases are kept by the stack across the restarts, so the anti-spoofing rules
+// still let the VMs use their addresses. The restarted backend learns them from
+// gratuitous ARPs, without waiting for the VMs to speak first.
+func (s *Stack) announceLeases() {
+	for _, port := range s.sw.ports {
+		addr, ok := port.dm.leasedAddr()
+		if !ok || port.closed.Load() {
+			continue
+		}
+
+		frame, err := gratuitousARP(port.HardwareAddr, addr)
+		if err != nil {
+			log.Error().Err(err).Msg("building gratuitous ARP")
+			continue
+		}
+
+		if _, err := s.backend.Write(frame); err != nil {
+			log.Error().Err(err).Msg("writing to backend")
+		}
+	}
+}
+
+// ARP request of the VM for its own address
+func gratuitousARP(mac net.HardwareAddr, addr netaddr.IP) ([]byte, error) {
+	ip := addr.IPAddr().IP.To4()
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   mac,
+		SourceProtAddress: ip,
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, arp); err != nil {
+		return nil, fmt.Errorf("serializing gratuitous ARP: %w", err)
+	}
+	return buf.Bytes(), nil
+}
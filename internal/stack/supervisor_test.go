@@ -0,0 +1,138 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	errTestTransient = errors.New("transient failure")
+	errTestFatal     = errors.New("fatal failure")
+)
+
+// restartingBackend fails on demand, and fails to restart with restartErrs in turn
+type restartingBackend struct {
+	discardBackend
+	failures    chan error
+	restartErrs []error
+	stopped     atomic.Bool
+
+	m        sync.Mutex
+	restarts []time.Time
+}
+
+func (b *restartingBackend) Failures() <-chan error   { return b.failures }
+func (b *restartingBackend) Transient(err error) bool { return errors.Is(err, errTestTransient) }
+
+func (b *restartingBackend) Stop() error {
+	b.stopped.Store(true)
+	return nil
+}
+
+func (b *restartingBackend) Restart() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.restarts = append(b.restarts, time.Now())
+	if n := len(b.restarts); n <= len(b.restartErrs) {
+		return b.restartErrs[n-1]
+	}
+	return nil
+}
+
+// The times Restart was called at
+func (b *restartingBackend) restartTimes() []time.Time {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return slices.Clone(b.restarts)
+}
+
+func setRestartBackoff(t *testing.T, minBackoff, maxBackoff time.Duration) {
+	t.Helper()
+
+	prevMin, prevMax := restartMinBackoff, restartMaxBackoff
+	restartMinBackoff, restartMaxBackoff = minBackoff, maxBackoff
+	t.Cleanup(func() { restartMinBackoff, restartMaxBackoff = prevMin, prevMax })
+}
+
+// The wait before the restarts is doubled after every failed one, up to the maximum
+func TestSupervisorBackoff(t *testing.T) {
+	setRestartBackoff(t, 10*time.Millisecond, 40*time.Millisecond)
+
+	b := &restartingBackend{
+		failures:    make(chan error, 1),
+		restartErrs: []error{errTestTransient, errTestTransient, errTestTransient, errTestTransient},
+	}
+	s, _, stop := startTestStack(t, NetworkParams{CustomBackend: b})
+	t.Cleanup(func() { _ = stop() })
+
+	failed := time.Now()
+	b.failures <- errTestTransient
+	eventually(t, func() bool { return s.Stats().BackendRestarts == 1 })
+
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond}
+	restarts := b.restartTimes()
+	if len(restarts) != len(want) {
+		t.Fatalf("got %d restarts, want %d", len(restarts), len(want))
+	}
+	prev := failed
+	for i, at := range restarts {
+		if backoff := at.Sub(prev); backoff < want[i] {
+			t.Errorf("restart %d after %s, want at least %s", i+1, backoff, want[i])
+		}
+		prev = at
+	}
+}
+
+func TestSupervisorFailures(t *testing.T) {
+	setRestartBackoff(t, time.Millisecond, time.Millisecond)
+
+	tests := []struct {
+		name        string
+		failure     error
+		restartErrs []error
+		restarts    int
+		restarted   uint64
+		err         error
+	}{
+		{name: "transient", failure: errTestTransient, restarts: 1, restarted: 1},
+		{name: "transient, restarted after a transient failure", failure: errTestTransient, restartErrs: []error{errTestTransient}, restarts: 2, restarted: 1},
+		{name: "fatal", failure: errTestFatal, err: errTestFatal},
+		{name: "transient, failed to restart for good", failure: errTestTransient, restartErrs: []error{errTestFatal}, restarts: 1, err: errTestFatal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &restartingBackend{failures: make(chan error, 1), restartErrs: tt.restartErrs}
+			s, _, stop := startTestStack(t, NetworkParams{CustomBackend: b})
+			t.Cleanup(func() { _ = stop() })
+
+			b.failures <- tt.failure
+			if tt.err != nil {
+				// The stack stops itself
+				eventually(t, b.stopped.Load)
+			} else {
+				eventually(t, func() bool { return s.Stats().BackendRestarts == tt.restarted })
+			}
+
+			err := stop()
+			if tt.err == nil && err != nil {
+				t.Fatalf("got %v, want the stack running until it's stopped", err)
+			}
+			if tt.err != nil && (!errors.Is(err, ErrBackendFailed) || !errors.Is(err, tt.err)) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if got := len(b.restartTimes()); got != tt.restarts {
+				t.Errorf("got %d restarts, want %d", got, tt.restarts)
+			}
+			if got := s.Stats().BackendRestarts; got != tt.restarted {
+				t.Errorf("got %d successful restarts, want %d", got, tt.restarted)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// nolint:exhaustivestruct,exhaustruct,godot
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/dgram"
+	"inet.af/netaddr"
+)
+
+var errDuplicateMAC = errors.New("multiple VMs with the same MAC address")
+
+// VM is a VM socket attached to the stack
+type VM struct {
+	// Socket file descriptor
+	Fd int
+	// The vm's MAC address provided by Virtualization.Framework
+	HardwareAddr net.HardwareAddr
+	// Name of the VM, resolvable as <Name>.<LocalDomain> if set
+	Name string
+	// Segment of the VM, like an 802.1Q VLAN ID. The VMs only reach the VMs of
+	// their own segment. Default Segment is 0, shared by the VMs without one.
+	Segment uint16
+}
+
+// vmPort is a port of the switch, connected to a VM's socket
+type vmPort struct {
+	VM
+
+	// Manages dhcp communication of the VM
+	dm dhcpManager
+
+	// The VM's socket, opened by Run
+	conn net.Conn
+	// Batched reads and writes of the VM's socket
+	frames dgram.Conn
+	// Serializes the batched writes of the workers
+	wm sync.Mutex
+
+	// Fragmented datagrams of the VM, whose first fragment was allowed
+	fragments fragmentTracker
+
+	// The spoofed frames, and the frames dropped on the way to the VM, not reported yet
+	spoofs eventLimiter
+	drops  eventLimiter
+
+	// Set once the VM closed its end of the socket
+	closed    atomic.Bool
+	closeOnce sync.Once
+}
+
+// Close the VM's socket. Only the first call closes it, the next ones return nil.
+func (p *vmPort) close() error {
+	var err error
+	p.closeOnce.Do(func() { err = p.conn.Close() })
+	return err
+}
+
+// l2Switch is a learning ethernet switch between the VM ports.
+// Frames sent to unknown or multicast destinations are uplinked to the backend.
+// Frames are only switched between the ports of the same segment.
+//
+// A port can only learn the MAC address of its own VM, the frames
+// sent from any other address are dropped by the anti-spoofing rules.
+type l2Switch struct {
+	ports []*vmPort
+
+	// Ports by the MAC addresses learned from the VMs' frames
+	table map[string]*vmPort
+	m     sync.RWMutex
+}
+
+func newSwitch(vms []VM, server netaddr.IP) (*l2Switch, error) {
+	sw := &l2Switch{
+		table: make(map[string]*vmPort),
+	}
+
+	seen := make(map[string]bool)
+	for _, vm := range vms {
+		if seen[string(vm.HardwareAddr)] {
+			return nil, fmt.Errorf("%w: %s", errDuplicateMAC, vm.HardwareAddr)
+		}
+		seen[string(vm.HardwareAddr)] = true
+
+		sw.ports = append(sw.ports, &vmPort{
+			VM: vm,
+			dm: dhcpManager{
+				lease:        lease{},
+				hardwareAddr: vm.HardwareAddr,
+				server:       server,
+			},
+		})
+	}
+
+	return sw, nil
+}
+
+// The first VM, the port forwards target its address
+func (sw *l2Switch) primary() *vmPort {
+	return sw.ports[0]
+}
+
+// Remember that the MAC address is behind the port. A closed port doesn't learn,
+// the frames its VM sent before closing the socket would bring back the detached entries.
+func (sw *l2Switch) learn(mac net.HardwareAddr, port *vmPort) {
+	sw.m.RLock()
+	known := sw.table[string(mac)] == port
+	sw.m.RUnlock()
+	if known {
+		return
+	}
+
+	sw.m.Lock()
+	defer sw.m.Unlock()
+	// Checked under the lock, hangUp marks the port closed before detaching it
+	if port.closed.Load() {
+		return
+	}
+	sw.table[string(mac)] = port
+}
+
+// Returns the port the MAC address was learned on
+func (sw *l2Switch) lookup(mac net.HardwareAddr) (*vmPort, bool) {
+	sw.m.RLock()
+	defer sw.m.RUnlock()
+	port, ok := sw.table[string(mac)]
+	return port, ok
+}
+
+// Forget the MAC addresses learned on the port, the frames sent to them are uplinked afterwards
+func (sw *l2Switch) detach(port *vmPort) {
+	sw.m.Lock()
+	defer sw.m.Unlock()
+	for mac, learned := range sw.table {
+		if learned == port {
+			delete(sw.table, mac)
+		}
+	}
+}
+
+// Returns the port of the VM which leased the address
+func (sw *l2Switch) owner(addr netaddr.IP) (*vmPort, bool) {
+	for _, port := range sw.ports {
+		if port.closed.Load() {
+			continue
+		}
+		if leased, ok := port.dm.leasedAddr(); ok && leased == addr {
+			return port, true
+		}
+	}
+	return nil, false
+}
+
+// Determine if any of the VMs is named
+func hasVMNames(vms []VM) bool {
+	for _, vm := range vms {
+		if vm.Name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Multicast and broadcast addresses have the least significant bit of the first octet set
+func isMulticastMAC(mac net.HardwareAddr) bool {
+	return len(mac) > 0 && mac[0]&1 == 1
+}
@@ -0,0 +1,172 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
+	"inet.af/netaddr"
+)
+
+func TestNewSwitchDuplicateMAC(t *testing.T) {
+	_, err := newSwitch([]VM{{HardwareAddr: testVMMAC}, {HardwareAddr: testVMMAC}}, netaddr.IP{})
+	if !errors.Is(err, errDuplicateMAC) {
+		t.Errorf("got %v, want %v", err, errDuplicateMAC)
+	}
+}
+
+func TestSwitchTable(t *testing.T) {
+	sw, err := newSwitch([]VM{{HardwareAddr: testVMMAC}, {HardwareAddr: testPeerMAC}}, netaddr.IP{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, peer := sw.ports[0], sw.ports[1]
+
+	if _, ok := sw.lookup(testVMMAC); ok {
+		t.Fatal("MAC address known before it was learned")
+	}
+	sw.learn(testVMMAC, vm)
+	sw.learn(testPeerMAC, peer)
+	if got, ok := sw.lookup(testVMMAC); !ok || got != vm {
+		t.Fatalf("got port %v, want the VM's", got)
+	}
+
+	// Only the entries of the detached port are forgotten
+	sw.detach(peer)
+	if _, ok := sw.lookup(testPeerMAC); ok {
+		t.Error("MAC address of the detached port still known")
+	}
+	if got, ok := sw.lookup(testVMMAC); !ok || got != vm {
+		t.Error("MAC address of the other port forgotten")
+	}
+
+	// A closed port doesn't learn its MAC address again
+	peer.closed.Store(true)
+	sw.learn(testPeerMAC, peer)
+	if _, ok := sw.lookup(testPeerMAC); ok {
+		t.Error("MAC address learned by a closed port")
+	}
+}
+
+func TestSwitchOwner(t *testing.T) {
+	addr := netaddr.MustParseIP("192.168.64.3")
+
+	tests := []struct {
+		name   string
+		lease  lease
+		closed bool
+		owned  bool
+	}{
+		{name: "leased", lease: lease{addr: addr, validUntil: time.Now().Add(time.Hour)}, owned: true},
+		{name: "lease expired", lease: lease{addr: addr, validUntil: time.Now().Add(-time.Minute)}},
+		{name: "other address", lease: lease{addr: netaddr.MustParseIP("192.168.64.4"), validUntil: time.Now().Add(time.Hour)}},
+		{name: "closed", lease: lease{addr: addr, validUntil: time.Now().Add(time.Hour)}, closed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sw, err := newSwitch([]VM{{HardwareAddr: testVMMAC}, {HardwareAddr: testPeerMAC}}, netaddr.IP{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			peer := sw.ports[1]
+			peer.dm.lease = tt.lease
+			peer.closed.Store(tt.closed)
+
+			got, ok := sw.owner(addr)
+			if ok != tt.owned || ok && got != peer {
+				t.Errorf("got %v, %v, want owned %v", got, ok, tt.owned)
+			}
+		})
+	}
+}
+
+// A stack of the VM and a peer VM leased 192.168.64.3, the frames uplinked are recorded
+func newTestSwitchStack(t *testing.T) (*Stack, *vmPort, *vmPort, *recordingBackend) {
+	t.Helper()
+
+	s, port := newTestStack(t, nil)
+	backend := &recordingBackend{}
+	s.backend = backend
+
+	vm, conn := net.Pipe()
+	t.Cleanup(func() { vm.Close() })
+	peer := &vmPort{VM: VM{HardwareAddr: testPeerMAC}, conn: conn}
+	peer.dm.lease = lease{addr: netaddr.MustParseIP("192.168.64.3"), validUntil: time.Now().Add(time.Hour)}
+	s.sw.ports = append(s.sw.ports, peer)
+
+	return s, port, peer, backend
+}
+
+// The anti-spoofing rules keep a port from learning the MAC address of another VM
+func TestSwitchLearnsOwnMACOnly(t *testing.T) {
+	s, port, peer, _ := newTestSwitchStack(t)
+	peerAddr := net.IPv4(192, 168, 64, 3).To4()
+	packet := frame.NewParser()
+	out := make(outbox)
+
+	// Sent with the peer's MAC address and IP address
+	spoofed := ipv4Frame(t, testPeerMAC, testHostMAC, peerAddr, testRemote, &layers.UDP{SrcPort: 40000, DstPort: 443})
+	s.preparePacket(out, port, packet, spoofed)
+	if got, ok := s.sw.lookup(testPeerMAC); ok {
+		t.Errorf("peer's MAC address learned on port %v", got.HardwareAddr)
+	}
+
+	// The peer's own frame
+	s.preparePacket(out, peer, packet, spoofed)
+	if got, ok := s.sw.lookup(testPeerMAC); !ok || got != peer {
+		t.Error("peer's MAC address not learned on its port")
+	}
+
+	// The VM can't take it over either
+	s.preparePacket(out, port, packet, spoofed)
+	if got, _ := s.sw.lookup(testPeerMAC); got != peer {
+		t.Error("peer's MAC address moved to the VM's port")
+	}
+}
+
+// Once a peer VM hung up, its entries are gone, and the frames sent to it are uplinked
+func TestSwitchAfterHangUp(t *testing.T) {
+	s, port, peer, backend := newTestSwitchStack(t)
+	peerAddr := net.IPv4(192, 168, 64, 3).To4()
+	packet := frame.NewParser()
+	out := make(outbox)
+
+	fromPeer := ipv4Frame(t, testPeerMAC, testVMMAC, peerAddr, testVMAddr, &layers.UDP{SrcPort: 40000, DstPort: 4000})
+	toPeer := ipv4Frame(t, testVMMAC, testPeerMAC, testVMAddr, peerAddr, &layers.UDP{SrcPort: 4000, DstPort: 40000})
+	s.preparePacket(out, peer, packet, fromPeer)
+	s.preparePacket(out, port, packet, toPeer)
+	if len(out[peer]) != 1 {
+		t.Fatalf("got %d frames switched to the peer, want 1", len(out[peer]))
+	}
+
+	s.hangUp(peer)
+	delete(out, peer)
+	backend.written = nil
+
+	if _, ok := s.sw.lookup(testPeerMAC); ok {
+		t.Error("MAC address of the closed port still known")
+	}
+	if _, ok := s.sw.owner(netaddr.IPFrom4([4]byte(peerAddr))); ok {
+		t.Error("address of the closed port still owned")
+	}
+
+	// A frame the peer sent before it closed the socket doesn't bring its entry back
+	s.preparePacket(out, peer, packet, fromPeer)
+	if _, ok := s.sw.lookup(testPeerMAC); ok {
+		t.Error("MAC address learned again by the closed port")
+	}
+
+	s.switchFrame(out, port, testPeerMAC, toPeer)
+	s.switchFrame(out, port, layers.EthernetBroadcast, toPeer)
+	if len(out[peer]) != 0 {
+		t.Errorf("got %d frames switched to the closed port", len(out[peer]))
+	}
+	if len(backend.written) != 2 {
+		t.Errorf("got %d frames uplinked, want 2", len(backend.written))
+	}
+}
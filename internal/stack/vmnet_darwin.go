@@ -0,0 +1,32 @@
+package stack
+
+import "github.com/nagypeterjob/sock-vmnet/internal/vmnet"
+
+func newVMNetBackend(p NetworkParams) (Backend, error) {
+	mode := vmnet.Shared
+	switch p.Mode {
+	case ModeHost:
+		mode = vmnet.Host
+	case ModeBridged:
+		mode = vmnet.Bridged
+	}
+
+	isolation := vmnet.Enabled
+	if p.DisableIsolation {
+		isolation = vmnet.Disabled
+	}
+
+	return vmnet.New(vmnet.Params{
+		StartAddr:       p.StartAddr,
+		EndAddr:         p.EndAddr,
+		SubnetMask:      p.SubnetMask,
+		Mode:            mode,
+		BridgeInterface: p.BridgeInterface,
+		Isolation:       isolation,
+		MTU:             p.MTU,
+		NetworkID:       p.NetworkID,
+		NAT66Prefix:     p.NAT66Prefix,
+		Queue:           p.queueParams(),
+		Debug:           p.Debug,
+	})
+}
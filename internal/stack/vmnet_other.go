@@ -0,0 +1,11 @@
+//go:build !darwin
+
+package stack
+
+import "errors"
+
+var errVMNetUnsupported = errors.New("the vmnet backend is only available on macOS")
+
+func newVMNetBackend(NetworkParams) (Backend, error) {
+	return nil, errVMNetUnsupported
+}
@@ -5,65 +5,183 @@ import (
 	"errors"
 	"net"
 	"syscall"
+	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/dgram"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
 	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
 )
 
-func (s *Stack) read(ctx context.Context, conn net.Conn) {
+// Frames to be sent to the VMs, written in a single batch per VM
+type outbox map[*vmPort][][]byte
+
+// Send the frames to the VMs, frames is either the backend's, or a queue of the multi-queue datapath.
+// Once the intake is stopped, the frames already queued are sent until the drain deadline.
+func (s *Stack) read(intake, drain context.Context, frames <-chan []byte) {
+	out := make(outbox)
+	packet := frame.NewParser()
+	received := make([][]byte, 0, dgram.MaxBatchSize)
 	for {
-		select {
-		case <-ctx.Done():
+		bytes, ok := nextFrame(intake, drain, frames)
+		if !ok {
 			return
-		case bytes := <-s.vmnet.Event:
-			s.writeConn(conn, bytes)
 		}
+
+		received = drainFrames(frames, append(received, bytes))
+		s.sendFrames(out, packet, received)
+		received = received[:0]
 	}
 }
 
-func (s *Stack) writeConn(conn net.Conn, rawBytes []byte) {
-	packet := gopacket.NewPacket(rawBytes, layers.LayerTypeEthernet, s.packetDecodeOptions)
+// Send the backend's frames to the VMs in a batch per VM, then release them
+func (s *Stack) sendFrames(out outbox, packet *frame.Parser, received [][]byte) {
+	for _, rawBytes := range received {
+		s.writeConn(out, packet, rawBytes)
+	}
+	s.flush(out)
 
-	if !allowedFromHost(&packet) {
-		log.Debug().Msg("frame not allowed from host")
-		return
+	// The frames were copied to the VM sockets, the backend can reuse them
+	for i, rawBytes := range received {
+		s.backend.Release(rawBytes)
+		received[i] = nil
 	}
+}
 
-	layer := packet.Layer(layers.LayerTypeEthernet)
-	if eth, ok := layer.(*layers.Ethernet); ok {
-		if string(eth.DstMAC) == string(s.HardwareAddr) {
-			s.dm.inspect(&packet, s.gateway)
+// Add the frames already queued to the batch
+func drainFrames(frames <-chan []byte, received [][]byte) [][]byte {
+	for len(received) < dgram.MaxBatchSize {
+		select {
+		case bytes, ok := <-frames:
+			if !ok {
+				return received
+			}
+			received = append(received, bytes)
+		default:
+			return received
 		}
 	}
+	return received
+}
 
-	if _, err := conn.Write(rawBytes); err != nil {
-		if errors.Is(err, net.ErrClosed) {
-			log.Debug().Msg("socket is already closed")
-			return
+// Write the batched frames to the VMs
+func (s *Stack) flush(out outbox) {
+	for port, frames := range out {
+		if len(frames) == 0 {
+			continue
+		}
+
+		port.wm.Lock()
+		n, err := port.frames.WriteBatch(frames)
+		port.wm.Unlock()
+		if err != nil {
+			s.droppedTo(port, len(frames)-n, err)
+			s.writeFailed(port, err)
 		}
 
-		if errors.Is(err, syscall.ENOBUFS) {
-			log.Debug().Msg("write socket buffer is full")
+		// Keep the slice for the next batch, but not the frames
+		clear(frames)
+		out[port] = frames[:0]
+	}
+}
+
+func (s *Stack) writeConn(out outbox, packet *frame.Parser, rawBytes []byte) {
+	if !s.fitsMTUToVM(rawBytes) || !packet.Decode(rawBytes) {
+		return
+	}
+
+	dst := packet.Ethernet.DstMAC
+	if port, ok := s.sw.lookup(dst); ok {
+		if !s.allowedFromHost(port, packet) {
+			log.Debug().Msg("frame not allowed from host")
 			return
 		}
 
-		log.Error().Err(err).Msg("writing to connection")
+		s.inspectLease(port, packet)
+
+		s.inspectDNSReply(packet)
+
+		out[port] = append(out[port], rawBytes)
+		return
+	}
+
+	// Unicast frames sent to unknown addresses aren't flooded,
+	// only the VMs which haven't sent anything yet could miss them.
+	if !isMulticastMAC(dst) {
+		log.Debug().Stringer("address", dst).Msg("frame sent to unknown address")
+		return
+	}
+
+	for _, port := range s.sw.ports {
+		if port.closed.Load() || !s.allowedFromHost(port, packet) {
+			continue
+		}
+
+		// dhcp servers of a LAN might broadcast their replies
+		s.inspectLease(port, packet)
+
+		out[port] = append(out[port], rawBytes)
 	}
 }
 
-func allowedFromHost(packet *gopacket.Packet) bool {
-	var layer gopacket.Layer
+// Record the lease, if the frame acknowledges one to the VM
+func (s *Stack) inspectLease(port *vmPort, packet *frame.Parser) {
+	before, after, ok := port.dm.inspect(packet)
+	if !ok {
+		return
+	}
+
+	log.Debug().Stringer("address", after.Addr).Msg("dhcp: acknowledged")
+	e := Event{Kind: leaseEvent(before, after, time.Now()), HardwareAddr: port.HardwareAddr, Lease: after}
+	if e.Kind == EventAddrChanged {
+		e.PrevAddr = before.Addr
+	}
+	s.emit(e)
+	s.leaseReady(port, after)
+}
+
+// Write the frame to the VM socket
+func (s *Stack) sendToVM(port *vmPort, rawBytes []byte) {
+	if _, err := port.conn.Write(rawBytes); err != nil {
+		s.droppedTo(port, 1, err)
+		s.writeFailed(port, err)
+	}
+}
+
+// Handle the error of a write to the VM socket
+func (s *Stack) writeFailed(port *vmPort, err error) {
+	if hungUp(err) {
+		s.hangUp(port)
+		return
+	}
+	logWriteError(err)
+}
+
+func logWriteError(err error) {
+	if errors.Is(err, net.ErrClosed) {
+		log.Debug().Msg("socket is already closed")
+		return
+	}
+
+	if errors.Is(err, syscall.ENOBUFS) {
+		log.Debug().Msg("write socket buffer is full")
+		return
+	}
+
+	log.Error().Err(err).Msg("writing to connection")
+}
+
+func (s *Stack) allowedFromHost(port *vmPort, packet *frame.Parser) bool {
 	// allow if ARP packet
-	layer = (*packet).Layer(layers.LayerTypeARP)
-	if _, ok := layer.(*layers.ARP); ok {
+	if packet.Has(layers.LayerTypeARP) {
 		return true
 	}
 
-	// allow if ipv4 packet
-	layer = (*packet).Layer(layers.LayerTypeIPv4)
-	if _, ok := layer.(*layers.IPv4); ok {
-		return true
+	// allow if ipv4 packet, unless the host routed it from a VM of another segment
+	if packet.Has(layers.LayerTypeIPv4) {
+		peer, ok := s.sw.owner(netaddr.IPFrom4([4]byte(packet.IPv4.SrcIP)))
+		return !ok || peer.Segment == port.Segment
 	}
 	return false
 }
@@ -0,0 +1,219 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package stack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
+	"github.com/nagypeterjob/sock-vmnet/internal/netif"
+	"inet.af/netaddr"
+)
+
+// discardBackend accepts every frame and never sends any
+type discardBackend struct{}
+
+func (discardBackend) Start() error                   { return nil }
+func (discardBackend) Stop() error                    { return nil }
+func (discardBackend) Write(p []byte) (int, error)    { return len(p), nil }
+func (discardBackend) Frames() <-chan []byte          { return nil }
+func (discardBackend) Release([]byte)                 {}
+func (discardBackend) FrameSize() int                 { return 1514 }
+func (discardBackend) Interface() netif.Interface     { return netif.Interface{MTU: 1500} }
+func (discardBackend) QueueStats() backpressure.Stats { return backpressure.Stats{} }
+func (discardBackend) Failures() <-chan error         { return nil }
+func (discardBackend) Transient(error) bool           { return false }
+func (discardBackend) Restart() error                 { return nil }
+
+var (
+	testVMAddr  = net.IPv4(192, 168, 64, 2).To4()
+	testHostMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0xfe}
+	testRemote  = net.IPv4(192, 0, 2, 1).To4()
+)
+
+// A stack of a VM leased testVMAddr, which isn't running.
+// The frames are handed to its workers' functions directly.
+func newTestStack(t testing.TB, egress []string) (*Stack, *vmPort) {
+	t.Helper()
+
+	gateway := netaddr.MustParseIP("192.168.64.1")
+	sw, err := newSwitch([]VM{{HardwareAddr: testVMMAC}}, gateway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := sw.primary()
+	port.dm.lease = lease{addr: netaddr.IPFrom4([4]byte(testVMAddr)), server: gateway, validUntil: time.Now().Add(time.Hour)}
+
+	s := &Stack{backend: discardBackend{}, sw: sw, gateway: gateway}
+	if egress != nil {
+		s.egress = newEgressPolicy(egress)
+	}
+	return s, port
+}
+
+func ipv4Frame(t testing.TB, srcMAC, dstMAC net.HardwareAddr, src, dst net.IP, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: src, DstIP: dst}
+	switch l4 := l[0].(type) {
+	case *layers.TCP:
+		ip.Protocol = layers.IPProtocolTCP
+		_ = l4.SetNetworkLayerForChecksum(ip)
+	case *layers.UDP:
+		ip.Protocol = layers.IPProtocolUDP
+		_ = l4.SetNetworkLayerForChecksum(ip)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{eth, ip}, l...)...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Neither direction allocates per frame, not even the DNS and dhcp frames the stack inspects
+func TestWorkerAllocs(t *testing.T) {
+	payload := gopacket.Payload(make([]byte, 1000))
+	dhcpAck := &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		// The broadcast reply to another client of the LAN
+		ClientHWAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x99},
+		YourClientIP: net.IPv4(192, 168, 64, 99),
+		Options:      layers.DHCPOptions{layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeAck)})},
+	}
+	reply := dnsReply(1, "example.com", answerA("example.com", "192.0.2.1"))
+
+	tests := []struct {
+		name   string
+		egress []string
+		fromVM []byte
+		toVM   []byte
+	}{
+		{
+			name:   "tcp",
+			fromVM: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, &layers.TCP{SrcPort: 40000, DstPort: 443, ACK: true}, payload),
+			toVM:   ipv4Frame(t, testHostMAC, testVMMAC, testRemote, testVMAddr, &layers.TCP{SrcPort: 443, DstPort: 40000, ACK: true}, payload),
+		},
+		{
+			name:   "udp",
+			fromVM: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, &layers.UDP{SrcPort: 40000, DstPort: 443}, payload),
+			toVM:   ipv4Frame(t, testHostMAC, testVMMAC, testRemote, testVMAddr, &layers.UDP{SrcPort: 443, DstPort: 40000}, payload),
+		},
+		{
+			name:   "unsolicited dns reply",
+			egress: []string{"example.com"},
+			fromVM: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testGateway, &layers.UDP{SrcPort: 40000, DstPort: 443}, payload),
+			toVM:   ipv4Frame(t, testHostMAC, testVMMAC, testGateway, testVMAddr, &layers.UDP{SrcPort: 53, DstPort: 40000}, reply),
+		},
+		{
+			name:   "dhcp reply",
+			fromVM: ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, &layers.UDP{SrcPort: 40000, DstPort: 443}, payload),
+			toVM:   ipv4Frame(t, testHostMAC, layers.EthernetBroadcast, testGateway, net.IPv4bcast.To4(), &layers.UDP{SrcPort: 67, DstPort: 68}, dhcpAck),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, port := newTestStack(t, tt.egress)
+			packet := frame.NewParser()
+			out := make(outbox)
+
+			if allocs := testing.AllocsPerRun(100, func() { s.preparePacket(out, port, packet, tt.fromVM) }); allocs != 0 {
+				t.Errorf("got %v allocations from the VM", allocs)
+			}
+			if _, ok := s.sw.lookup(testVMMAC); !ok {
+				t.Fatal("frame of the VM not switched")
+			}
+
+			allocs := testing.AllocsPerRun(100, func() {
+				s.writeConn(out, packet, tt.toVM)
+				if len(out[port]) != 1 {
+					t.Fatal("frame not sent to the VM")
+				}
+				out[port] = out[port][:0]
+			})
+			if allocs != 0 {
+				t.Errorf("got %v allocations to the VM", allocs)
+			}
+		})
+	}
+}
+
+// In host mode the VM only reaches the host and the peer VMs, even the DNS servers of the lease beyond the subnet
+func TestReachableHostMode(t *testing.T) {
+	peerAddr := net.IPv4(192, 168, 64, 3).To4()
+	offSubnetDNS := net.IPv4(198, 51, 100, 53).To4()
+	query := gopacket.Payload(dnsQuery(t, 1, "example.com"))
+
+	tests := []struct {
+		name  string
+		frame []byte
+		host  bool
+		// Allowed in shared mode
+		shared bool
+	}{
+		{
+			name:   "global unicast egress",
+			frame:  ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testRemote, &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true}),
+			shared: true,
+		},
+		{
+			name:   "dns query beyond the subnet",
+			frame:  ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, offSubnetDNS, &layers.UDP{SrcPort: 40000, DstPort: 53}, query),
+			shared: true,
+		},
+		{
+			name:   "dns query to the gateway",
+			frame:  ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testGateway, &layers.UDP{SrcPort: 40000, DstPort: 53}, query),
+			host:   true,
+			shared: true,
+		},
+		{
+			name:   "host",
+			frame:  ipv4Frame(t, testVMMAC, testHostMAC, testVMAddr, testGateway, &layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true}),
+			host:   true,
+			shared: true,
+		},
+		{
+			name:   "peer VM",
+			frame:  ipv4Frame(t, testVMMAC, testPeerMAC, testVMAddr, peerAddr, &layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true}),
+			host:   true,
+			shared: true,
+		},
+	}
+
+	for _, mode := range []NetworkMode{ModeHost, ModeShared} {
+		for _, tt := range tests {
+			t.Run(string(mode)+"/"+tt.name, func(t *testing.T) {
+				s, port := newTestStack(t, nil)
+				s.Mode = mode
+				s.subnet = netaddr.MustParseIPPrefix("192.168.64.0/24")
+				port.dm.lease.dnsServers = []netaddr.IP{netaddr.IPFrom4([4]byte(testGateway)), netaddr.IPFrom4([4]byte(offSubnetDNS))}
+
+				peer := &vmPort{VM: VM{HardwareAddr: testPeerMAC}}
+				peer.dm.lease = lease{addr: netaddr.IPFrom4([4]byte(peerAddr)), validUntil: time.Now().Add(time.Hour)}
+				s.sw.ports = append(s.sw.ports, peer)
+
+				packet := frame.NewParser()
+				if !packet.Decode(tt.frame) {
+					t.Fatal("frame not decoded")
+				}
+				want := tt.host
+				if mode == ModeShared {
+					want = tt.shared
+				}
+				if got := s.allowedFromVM(port, packet, tt.frame); got != want {
+					t.Errorf("got allowed %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
@@ -1,90 +1,224 @@
 package stack
 
 import (
-	"context"
 	"errors"
 	"net"
+	"os"
 	"syscall"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/dgram"
+	"github.com/nagypeterjob/sock-vmnet/internal/frame"
 	"github.com/rs/zerolog/log"
 	"inet.af/netaddr"
 )
 
 var broadcastIP = netaddr.IPv4(255, 255, 255, 255)
 
-func (s *Stack) write(ctx context.Context, conn net.Conn) {
-	bytes := make([]byte, s.vmnet.MaxPacketSize)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			n, err := conn.Read(bytes)
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
+// Read the VM's frames until the intake is stopped. The frames already read are still handled.
+func (s *Stack) write(w *workers, port *vmPort) {
+	bufs := make([][]byte, dgram.MaxBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, s.readBufferSize())
+	}
+	sizes := make([]int, dgram.MaxBatchSize)
+	packet := frame.NewParser()
+	out := make(outbox)
+	var pending [][]vmFrame
+	if s.queues != nil {
+		pending = make([][]vmFrame, len(s.queues.vm))
+	}
+
+	for w.intake.Err() == nil {
+		n, err := port.frames.ReadBatch(bufs, sizes)
+		if err != nil {
+			// shutdown unblocks the read
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+
+			if hungUp(err) {
+				s.hangUp(port)
+				return
+			}
+
+			// The socket of a peer VM is closed once it hung up
+			if errors.Is(err, net.ErrClosed) {
+				if !port.closed.Load() {
 					log.Error().Msg("socket is already closed")
-					return
 				}
+				return
+			}
 
-				if errors.Is(err, syscall.ENOBUFS) {
-					log.Error().Err(err).Msgf("read socket buffer is full")
-					return
-				}
+			if errors.Is(err, syscall.ENOBUFS) {
+				log.Error().Err(err).Msgf("read socket buffer is full")
+				return
+			}
 
-				log.Error().Err(err).Msgf("reading from")
+			log.Error().Err(err).Msgf("reading from")
+			continue
+		}
+
+		closed := false
+		for i := 0; i < n; i++ {
+			// Ethernet frames are never empty, the VM closed its socket
+			if sizes[i] == 0 {
+				closed = true
+				break
+			}
+
+			// A full buffer means that the datagram was truncated
+			if !s.fitsMTU(port, bufs[i][:sizes[i]], sizes[i] == len(bufs[i])) {
+				continue
+			}
+
+			if s.queues == nil {
+				s.preparePacket(out, port, packet, bufs[i][:sizes[i]])
 				continue
 			}
 
-			s.preparePacket(bytes[:n])
+			// The worker owns the buffer from now on
+			s.queues.addVMFrame(pending, port, bufs[i][:sizes[i]])
+			bufs[i] = s.queues.buffers.Get()
 		}
-	}
-}
 
-func (s *Stack) preparePacket(rawBytes []byte) {
-	packet := gopacket.NewPacket(rawBytes, layers.LayerTypeEthernet, s.packetDecodeOptions)
-	layer := packet.Layer(layers.LayerTypeEthernet)
+		// The frames read before the VM closed its socket are still handled
+		if s.queues == nil {
+			s.flush(out)
+		} else if !s.queues.queueVMFrames(w.drain, pending) {
+			return
+		}
 
-	if eth, ok := layer.(*layers.Ethernet); ok {
-		// It doesn't come from our VM
-		if string(eth.SrcMAC) != string(s.HardwareAddr) {
+		if closed {
+			s.hangUp(port)
 			return
 		}
 	}
+}
+
+// One byte more than the largest frame of the backend, so that the truncated datagrams stand out
+func (s *Stack) readBufferSize() int {
+	return s.backend.FrameSize() + 1
+}
+
+// Classify the VM's frame, and switch it to the peer VMs in out or uplink it to the backend
+func (s *Stack) preparePacket(out outbox, port *vmPort, packet *frame.Parser, rawBytes []byte) {
+	if !packet.Decode(rawBytes) {
+		return
+	}
+
+	// It doesn't come from our VM
+	if string(packet.Ethernet.SrcMAC) != string(port.HardwareAddr) {
+		s.spoofBlocked(port, packet.Ethernet.SrcMAC, sourceAddr(packet))
+		return
+	}
+
+	// Tagged frames could hop to other segments
+	if packet.Has(layers.LayerTypeDot1Q) {
+		return
+	}
+
+	// Blocked queries are answered locally
+	if s.inspectDNSQuery(port, packet) {
+		return
+	}
+
+	// Queries answered by the embedded DNS proxy never reach the backend
+	if s.dns != nil && s.proxyDNS(port, packet) {
+		return
+	}
+
+	// Queries over TCP would bypass the blocklist
+	if s.rejectDNSOverTCP(packet) {
+		return
+	}
 
-	if !s.allowedFromVM(&packet) {
+	if !s.allowedFromVM(port, packet, rawBytes) {
 		log.Debug().Msg("frame not allowed from VM")
+		if addr := sourceAddr(packet); s.spoofedAddr(port, addr) {
+			s.spoofBlocked(port, packet.Ethernet.SrcMAC, addr)
+		}
+		return
+	}
+
+	s.expectDNSReply(port, packet)
+
+	s.sw.learn(packet.Ethernet.SrcMAC, port)
+	s.switchFrame(out, port, packet.Ethernet.DstMAC, rawBytes)
+
+	// The fragments which arrived before their first fragment follow it
+	for _, held := range s.heldFragments(port, packet) {
+		s.switchFrame(out, port, net.HardwareAddr(held[0:6]), held)
+	}
+}
+
+// Batch the VM's frame to the peer VM it's sent to, or uplink it to the backend.
+// Multicast frames are flooded to the peer VMs and uplinked as well.
+func (s *Stack) switchFrame(out outbox, src *vmPort, dst net.HardwareAddr, rawBytes []byte) {
+	if peer, ok := s.sw.lookup(dst); ok {
+		if peer != src && peer.Segment == src.Segment {
+			out[peer] = append(out[peer], rawBytes)
+		}
 		return
 	}
 
-	if _, err := s.vmnet.Write(rawBytes); err != nil {
-		log.Error().Err(err).Msg("writing to vmnet")
+	if isMulticastMAC(dst) {
+		for _, peer := range s.sw.ports {
+			if peer != src && peer.Segment == src.Segment && !peer.closed.Load() {
+				out[peer] = append(out[peer], rawBytes)
+			}
+		}
+	}
+
+	if _, err := s.backend.Write(rawBytes); err != nil {
+		log.Error().Err(err).Msg("writing to backend")
+	}
+}
+
+// Returns the source address of an ipv4 or ARP frame
+func sourceAddr(packet *frame.Parser) netaddr.IP {
+	switch {
+	case packet.Has(layers.LayerTypeIPv4):
+		return netaddr.IPFrom4([4]byte(packet.IPv4.SrcIP))
+	case packet.Has(layers.LayerTypeARP) && len(packet.ARP.SourceProtAddress) == 4:
+		return netaddr.IPFrom4([4]byte(packet.ARP.SourceProtAddress))
+	default:
+		return netaddr.IP{}
+	}
+}
+
+// Determine if the VM sent the frame from an address which isn't its own.
+// Before the lease only the unspecified address is the VM's.
+func (s *Stack) spoofedAddr(port *vmPort, addr netaddr.IP) bool {
+	if addr.IsZero() || addr.IsUnspecified() {
+		return false
 	}
+	return !port.dm.validIPAddress(addr)
 }
 
-func (s *Stack) allowedFromVM(packet *gopacket.Packet) bool {
-	var layer gopacket.Layer
-	layer = (*packet).Layer(layers.LayerTypeIPv4)
-	if ip, ok := layer.(*layers.IPv4); ok {
-		if s.allowIPv4(packet, ip) {
+func (s *Stack) allowedFromVM(port *vmPort, packet *frame.Parser, rawBytes []byte) bool {
+	if packet.Has(layers.LayerTypeIPv4) && isFragment(&packet.IPv4) {
+		return s.allowFragment(port, packet, rawBytes)
+	}
+
+	if packet.Has(layers.LayerTypeIPv4) {
+		if s.allowIPv4(port, packet) {
 			return true
 		}
 		// continue check
 	}
 
-	layer = (*packet).Layer(layers.LayerTypeARP)
-	if arp, ok := layer.(*layers.ARP); ok {
-		return s.allowARP(arp)
+	if packet.Has(layers.LayerTypeARP) {
+		return s.allowARP(port, &packet.ARP)
 	}
 
 	return false
 }
 
-func (s *Stack) allowARP(arp *layers.ARP) bool {
+func (s *Stack) allowARP(port *vmPort, arp *layers.ARP) bool {
 	addr := netaddr.IPFrom4([4]byte(arp.SourceProtAddress))
-	if s.dm.hasLeases() {
-		if s.dm.validIPAddress(addr) {
+	if port.dm.hasLeases() {
+		if port.dm.validIPAddress(addr) {
 			return true
 		}
 	} else if addr.IsUnspecified() {
@@ -94,37 +228,38 @@ func (s *Stack) allowARP(arp *layers.ARP) bool {
 	return false
 }
 
-func (s *Stack) allowIPv4(packet *gopacket.Packet, ipPkt *layers.IPv4) bool {
+func (s *Stack) allowIPv4(port *vmPort, packet *frame.Parser) bool {
+	destinationAddr := netaddr.IPFrom4([4]byte(packet.IPv4.DstIP))
+
 	// We already know the VM IP
-	if s.dm.hasLeases() {
-		addr := netaddr.IPFrom4([4]byte(ipPkt.SrcIP))
-		if s.dm.validIPAddress(addr) && ipPkt.DstIP.IsGlobalUnicast() {
-			return true
+	if port.dm.hasLeases() {
+		addr := netaddr.IPFrom4([4]byte(packet.IPv4.SrcIP))
+		if port.dm.validIPAddress(addr) {
+			// The peer VMs aren't beyond the gateway, but only the ones of the same segment are reachable
+			if peer, ok := s.sw.owner(destinationAddr); ok {
+				return peer.Segment == port.Segment
+			}
+
+			if s.allowDestination(destinationAddr) {
+				return true
+			}
 		}
 	}
 
-	if ipPkt.DstIP.String() == s.gateway.String() {
+	if destinationAddr == s.gatewayAddr() {
 		return true
 	}
 
-	if ipPkt.Protocol != layers.IPProtocolUDP {
-		return false
-	}
-
-	layer := (*packet).Layer(layers.LayerTypeUDP)
-	if layer == nil {
+	if !packet.HasUDP() {
 		return false
 	}
 
-	if pkt, ok := layer.(*layers.UDP); ok {
-		return s.allowUDP(pkt, ipPkt)
-	}
-	return false
+	return s.allowUDP(port, &packet.UDP, &packet.IPv4)
 }
 
-func (s *Stack) allowUDP(pkt *layers.UDP, ipPkt *layers.IPv4) bool {
+func (s *Stack) allowUDP(port *vmPort, pkt *layers.UDP, ipPkt *layers.IPv4) bool {
 	destinationAddr := netaddr.IPFrom4([4]byte(ipPkt.DstIP))
-	if validDNSRequest(pkt) && s.dm.validDNSTarget(destinationAddr) {
+	if validDNSRequest(pkt) && port.dm.validDNSTarget(destinationAddr) && s.reachable(destinationAddr) {
 		return true
 	}
 
@@ -132,5 +267,24 @@ func (s *Stack) allowUDP(pkt *layers.UDP, ipPkt *layers.IPv4) bool {
 		return true
 	}
 
+	// Lease renewals are unicast to the dhcp server
+	if validDHCPRequest(pkt) && destinationAddr == port.dm.leaseServer() {
+		return true
+	}
+
 	return false
 }
+
+// Determine if the VM is allowed to send traffic to the destination beyond the gateway
+func (s *Stack) allowDestination(destination netaddr.IP) bool {
+	return destination.IsGlobalUnicast() && s.reachable(destination) && s.allowEgress(destination)
+}
+
+// Determine if the destination is reachable in the network mode.
+// In host mode only the host and the peer VMs are, there's no NAT.
+func (s *Stack) reachable(destination netaddr.IP) bool {
+	if s.Mode == ModeHost {
+		return s.subnet.Contains(destination)
+	}
+	return true
+}
@@ -0,0 +1,273 @@
+// nolint:exhaustivestruct,exhaustruct,godot
+package usernet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+)
+
+const (
+	// The dhcp server listens on this port
+	dhcpServerPort = 67
+	// The dhcp client listens on this port
+	dhcpClientPort = 68
+	// Lease time offered to the VMs, in seconds
+	dhcpLeaseTime = 3600
+	// An offered address is held for the client this long, until it's requested
+	dhcpOfferTimeout = time.Minute
+)
+
+// dhcpServer hands out addresses from the (StartAddr + 1) - (EndAddr - 1) range,
+// the same way bootpd does for vmnet. The StartAddr is the gateway,
+// which is also offered as the router and DNS server.
+type dhcpServer struct {
+	gateway    netaddr.IP
+	subnetMask netaddr.IP
+	// The next address which hasn't been assigned yet
+	next netaddr.IP
+	// The last assignable address
+	last netaddr.IP
+
+	// Assigned addresses by the clients' MAC address. A client gets the same address
+	// again, even once its lease expired, unless the range ran out and it was reassigned.
+	leases map[string]dhcpLease
+
+	m sync.Mutex
+}
+
+func newDHCPServer(startAddr, endAddr, subnetMask netaddr.IP) *dhcpServer {
+	return &dhcpServer{
+		gateway:    startAddr,
+		subnetMask: subnetMask,
+		next:       startAddr.Next(),
+		// EndAddr is the broadcast address by default
+		last:   endAddr.Prior(),
+		leases: make(map[string]dhcpLease),
+	}
+}
+
+type dhcpLease struct {
+	addr       netaddr.IP
+	validUntil time.Time
+}
+
+// Handles the frame if it's a dhcp request. The second return value reports
+// whether the frame was a dhcp request, the reply frame might be nil even then.
+func (d *dhcpServer) handle(packet gopacket.Packet) ([]byte, bool) {
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || udp.DstPort != dhcpServerPort {
+		return nil, false
+	}
+
+	request, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if !ok || request.Operation != layers.DHCPOpRequest {
+		return nil, true
+	}
+
+	// A VM could exhaust the range, or take over the lease of another one, with made up chaddrs
+	eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok || !bytes.Equal(eth.SrcMAC, request.ClientHWAddr) {
+		log.Debug().Msgf("usernet: dhcp: request for %s sent from another MAC address", request.ClientHWAddr)
+		return nil, true
+	}
+
+	now := time.Now()
+	var reply *layers.DHCPv4
+	switch dhcpMessageType(request) {
+	case layers.DHCPMsgTypeDiscover:
+		addr, ok := d.assign(request.ClientHWAddr, now)
+		if !ok {
+			log.Error().Msgf("usernet: dhcp: no address left for %s", request.ClientHWAddr)
+			return nil, true
+		}
+		reply = d.reply(request, layers.DHCPMsgTypeOffer, addr)
+	case layers.DHCPMsgTypeRequest:
+		addr := requestedAddr(request)
+		if !d.renew(request.ClientHWAddr, addr, now) {
+			reply = d.reply(request, layers.DHCPMsgTypeNak, netaddr.IP{})
+			break
+		}
+		reply = d.reply(request, layers.DHCPMsgTypeAck, addr)
+	case layers.DHCPMsgTypeRelease:
+		d.release(request.ClientHWAddr, now)
+		return nil, true
+	default:
+		// decline and inform don't need a reply, the assignment is kept
+		return nil, true
+	}
+
+	frame, err := d.frame(request, reply)
+	if err != nil {
+		log.Error().Err(err).Msg("usernet: dhcp: building reply")
+		return nil, true
+	}
+	return frame, true
+}
+
+// Returns the address assigned to the client, or assigns the next free one.
+// Once the range ran out, the address of an expired lease is reassigned.
+// The offered address is held for dhcpOfferTimeout at least.
+func (d *dhcpServer) assign(mac net.HardwareAddr, now time.Time) (netaddr.IP, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	held := now.Add(dhcpOfferTimeout)
+	if lease, ok := d.leases[string(mac)]; ok {
+		if lease.validUntil.Before(held) {
+			d.leases[string(mac)] = dhcpLease{addr: lease.addr, validUntil: held}
+		}
+		return lease.addr, true
+	}
+
+	addr, ok := d.free(now)
+	if !ok {
+		return netaddr.IP{}, false
+	}
+	d.leases[string(mac)] = dhcpLease{addr: addr, validUntil: held}
+	return addr, true
+}
+
+// Returns the next address which hasn't been assigned yet, or takes the address of an expired lease
+func (d *dhcpServer) free(now time.Time) (netaddr.IP, bool) {
+	if !d.last.Less(d.next) {
+		addr := d.next
+		d.next = d.next.Next()
+		return addr, true
+	}
+
+	for mac, lease := range d.leases {
+		if lease.validUntil.Before(now) {
+			delete(d.leases, mac)
+			return lease.addr, true
+		}
+	}
+	return netaddr.IP{}, false
+}
+
+// Extends the client's lease by dhcpLeaseTime, if addr is assigned to it.
+// An expired lease is renewed as well, as long as its address wasn't reassigned.
+func (d *dhcpServer) renew(mac net.HardwareAddr, addr netaddr.IP, now time.Time) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	lease, ok := d.leases[string(mac)]
+	if !ok || lease.addr != addr {
+		return false
+	}
+	d.leases[string(mac)] = dhcpLease{addr: addr, validUntil: now.Add(dhcpLeaseTime * time.Second)}
+	return true
+}
+
+// Expires the client's lease, its address can be reassigned once the range ran out
+func (d *dhcpServer) release(mac net.HardwareAddr, now time.Time) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if lease, ok := d.leases[string(mac)]; ok {
+		d.leases[string(mac)] = dhcpLease{addr: lease.addr, validUntil: now}
+	}
+}
+
+func (d *dhcpServer) reply(request *layers.DHCPv4, msgType layers.DHCPMsgType, addr netaddr.IP) *layers.DHCPv4 {
+	leaseTime := make([]byte, 4)
+	binary.BigEndian.PutUint32(leaseTime, dhcpLeaseTime)
+
+	options := layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}),
+		layers.NewDHCPOption(layers.DHCPOptServerID, d.gateway.IPAddr().IP.To4()),
+	}
+	if msgType != layers.DHCPMsgTypeNak {
+		options = append(options,
+			layers.NewDHCPOption(layers.DHCPOptLeaseTime, leaseTime),
+			layers.NewDHCPOption(layers.DHCPOptSubnetMask, d.subnetMask.IPAddr().IP.To4()),
+			layers.NewDHCPOption(layers.DHCPOptRouter, d.gateway.IPAddr().IP.To4()),
+			layers.NewDHCPOption(layers.DHCPOptDNS, d.gateway.IPAddr().IP.To4()),
+		)
+	}
+
+	yourIP := net.IPv4zero.To4()
+	if !addr.IsZero() {
+		yourIP = addr.IPAddr().IP.To4()
+	}
+
+	return &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          request.Xid,
+		Flags:        request.Flags,
+		ClientIP:     net.IPv4zero.To4(),
+		YourClientIP: yourIP,
+		NextServerIP: net.IPv4zero.To4(),
+		RelayAgentIP: request.RelayAgentIP,
+		ClientHWAddr: request.ClientHWAddr,
+		Options:      options,
+	}
+}
+
+// Wraps the dhcp reply into an ethernet frame, sent from the gateway to the client
+func (d *dhcpServer) frame(request *layers.DHCPv4, reply *layers.DHCPv4) ([]byte, error) {
+	dstIP := reply.YourClientIP
+	if dstIP.IsUnspecified() {
+		dstIP = net.IPv4bcast.To4()
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       gatewayMAC,
+		DstMAC:       request.ClientHWAddr,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    d.gateway.IPAddr().IP.To4(),
+		DstIP:    dstIP,
+	}
+	udp := &layers.UDP{
+		SrcPort: dhcpServerPort,
+		DstPort: dhcpClientPort,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, reply); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func dhcpMessageType(msg *layers.DHCPv4) layers.DHCPMsgType {
+	for _, opt := range msg.Options {
+		if opt.Type == layers.DHCPOptMessageType && len(opt.Data) == 1 {
+			return layers.DHCPMsgType(opt.Data[0])
+		}
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+// The address the client asks for. It's passed as an option while selecting
+// the offer, and in the ciaddr field while renewing the lease.
+func requestedAddr(msg *layers.DHCPv4) netaddr.IP {
+	for _, opt := range msg.Options {
+		if opt.Type == layers.DHCPOptRequestIP && len(opt.Data) == 4 {
+			return netaddr.IPv4(opt.Data[0], opt.Data[1], opt.Data[2], opt.Data[3])
+		}
+	}
+
+	if addr, ok := netaddr.FromStdIP(msg.ClientIP); ok {
+		return addr
+	}
+	return netaddr.IP{}
+}
@@ -0,0 +1,125 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package usernet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"inet.af/netaddr"
+)
+
+// A dhcp request of chaddr, sent from srcMAC
+func dhcpPacket(t *testing.T, srcMAC, chaddr net.HardwareAddr, msgType layers.DHCPMsgType, requested net.IP) gopacket.Packet {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4zero, DstIP: net.IPv4bcast}
+	udp := &layers.UDP{SrcPort: dhcpClientPort, DstPort: dhcpServerPort}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          1,
+		ClientHWAddr: chaddr,
+		Options:      layers.DHCPOptions{layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)})},
+	}
+	if requested != nil {
+		dhcp.Options = append(dhcp.Options, layers.NewDHCPOption(layers.DHCPOptRequestIP, requested.To4()))
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, dhcp); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestDHCPSourceMAC(t *testing.T) {
+	d := newDHCPServer(netaddr.MustParseIP("192.168.64.1"), netaddr.MustParseIP("192.168.64.255"), netaddr.MustParseIP("255.255.255.0"))
+	other := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x43}
+
+	tests := []struct {
+		name   string
+		srcMAC net.HardwareAddr
+		offer  bool
+	}{
+		{name: "own MAC", srcMAC: testVMMAC, offer: true},
+		{name: "another MAC", srcMAC: other},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, ok := d.handle(dhcpPacket(t, tt.srcMAC, testVMMAC, layers.DHCPMsgTypeDiscover, nil))
+			if !ok {
+				t.Fatal("dhcp request not consumed")
+			}
+			if got := reply != nil; got != tt.offer {
+				t.Errorf("got offer %v, want %v", got, tt.offer)
+			}
+		})
+	}
+
+	if _, ok := d.assign(other, time.Now()); !ok || len(d.leases) != 2 {
+		t.Errorf("got %d leases, want the one of the own MAC and other", len(d.leases))
+	}
+}
+
+func TestDHCPLeaseExpiry(t *testing.T) {
+	// Only 192.168.64.2 is assignable
+	d := newDHCPServer(netaddr.MustParseIP("192.168.64.1"), netaddr.MustParseIP("192.168.64.3"), netaddr.MustParseIP("255.255.255.0"))
+	first := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	second := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	addr := netaddr.MustParseIP("192.168.64.2")
+	now := time.Now()
+
+	if got, ok := d.assign(first, now); !ok || got != addr {
+		t.Fatalf("got %s, want %s", got, addr)
+	}
+	if !d.renew(first, addr, now) {
+		t.Fatal("lease not acknowledged")
+	}
+
+	leased := now.Add(dhcpLeaseTime * time.Second)
+	if _, ok := d.assign(second, leased.Add(-time.Second)); ok {
+		t.Fatal("leased address reassigned")
+	}
+	// Renewed before the expiry
+	if !d.renew(first, addr, leased.Add(-time.Second)) {
+		t.Fatal("lease not renewed")
+	}
+	if _, ok := d.assign(second, leased.Add(time.Second)); ok {
+		t.Fatal("renewed address reassigned")
+	}
+
+	expired := leased.Add(dhcpLeaseTime * time.Second)
+	if got, ok := d.assign(second, expired); !ok || got != addr {
+		t.Fatalf("got %s, want the expired address", got)
+	}
+	if d.renew(first, addr, expired) {
+		t.Error("reassigned address renewed by its previous client")
+	}
+	if _, ok := d.assign(first, expired); ok {
+		t.Error("address offered while the range is held")
+	}
+}
+
+func TestDHCPRelease(t *testing.T) {
+	d := newDHCPServer(netaddr.MustParseIP("192.168.64.1"), netaddr.MustParseIP("192.168.64.3"), netaddr.MustParseIP("255.255.255.0"))
+	second := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	now := time.Now()
+
+	addr, _ := d.assign(testVMMAC, now)
+	d.renew(testVMMAC, addr, now)
+	if reply, _ := d.handle(dhcpPacket(t, testVMMAC, testVMMAC, layers.DHCPMsgTypeRelease, nil)); reply != nil {
+		t.Fatal("release answered")
+	}
+
+	if got, ok := d.assign(second, time.Now().Add(time.Second)); !ok || got != addr {
+		t.Errorf("got %s, want the released address", got)
+	}
+}
@@ -0,0 +1,267 @@
+// nolint:godot
+package usernet
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"inet.af/netaddr"
+)
+
+// UDP flows without traffic in either direction are closed after this period
+var udpIdleTimeout = 90 * time.Second
+
+const (
+	// Time to wait for the host to establish a TCP connection
+	dialTimeout = 10 * time.Second
+	// Well known DNS port
+	dnsPort = 53
+	// Used when the host's resolver configuration can't be read
+	fallbackNameserver = "127.0.0.1"
+)
+
+// Accepts the TCP connection of the VM, if the host is able to connect to the target
+func (u *UserNet) forwardTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	target, ok := u.hostTarget(id.LocalAddress, id.LocalPort)
+	if !ok {
+		r.Complete(true)
+		return
+	}
+
+	host, err := net.DialTimeout("tcp", target, dialTimeout)
+	if err != nil {
+		log.Debug().Err(err).Msgf("usernet: dialing tcp %s", target)
+		// reset the VM's connection, just like the target would have done
+		r.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tErr := r.CreateEndpoint(&wq)
+	r.Complete(false)
+	if tErr != nil {
+		log.Error().Msgf("usernet: creating tcp endpoint: %s", tErr)
+		host.Close()
+		return
+	}
+
+	relayTCP(gonet.NewTCPConn(&wq, ep), host.(*net.TCPConn))
+}
+
+// Copies data in both directions, half-closing each side once the other one is done sending
+func relayTCP(vm *gonet.TCPConn, host *net.TCPConn) {
+	defer vm.Close()
+	defer host.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(host, vm)
+		_ = host.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(vm, host)
+		_ = vm.CloseWrite()
+	}()
+	wg.Wait()
+}
+
+// Relays the VM's UDP flow to the host. The flows beyond maxUDPFlows are dropped,
+// the datagrams of the VM are sent again once a flow expired.
+func (u *UserNet) forwardUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	target, ok := u.hostTarget(id.LocalAddress, id.LocalPort)
+	if !ok {
+		return
+	}
+
+	select {
+	case u.udpFlows <- struct{}{}:
+	default:
+		log.Debug().Msgf("usernet: too many udp flows, dropped the flow to %s", target)
+		return
+	}
+	if u.ctx.Err() != nil {
+		<-u.udpFlows
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tErr := r.CreateEndpoint(&wq)
+	if tErr != nil {
+		log.Error().Msgf("usernet: creating udp endpoint: %s", tErr)
+		<-u.udpFlows
+		return
+	}
+	vm := gonet.NewUDPConn(&wq, ep)
+
+	host, err := net.Dial("udp", target)
+	if err != nil {
+		log.Debug().Err(err).Msgf("usernet: dialing udp %s", target)
+		vm.Close()
+		<-u.udpFlows
+		return
+	}
+
+	// Stop waits for the flows, which are closed once the backend is stopped
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		defer func() { <-u.udpFlows }()
+		relayUDP(u.ctx, vm, host)
+	}()
+}
+
+// Copies datagrams in both directions, until the flow is idle for udpIdleTimeout,
+// or ctx is done. The traffic in one direction keeps the flow alive.
+func relayUDP(ctx context.Context, vm net.Conn, host net.Conn) {
+	var active atomic.Int64
+	active.Store(time.Now().UnixNano())
+
+	done := make(chan struct{}, 2)
+	relay := func(dst net.Conn, src net.Conn) {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, 65535)
+		for {
+			idleUntil := time.Unix(0, active.Load()).Add(udpIdleTimeout)
+			_ = src.SetReadDeadline(idleUntil)
+			n, err := src.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Unix(0, active.Load()).Add(udpIdleTimeout).After(idleUntil) {
+				// The other direction was active meanwhile
+				continue
+			}
+			if err != nil {
+				return
+			}
+			active.Store(time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+
+	go relay(host, vm)
+	go relay(vm, host)
+
+	// Once either direction stops, closing the conns stops the other one too
+	stopped := 0
+	select {
+	case <-done:
+		stopped++
+	case <-ctx.Done():
+	}
+	vm.Close()
+	host.Close()
+	for ; stopped < 2; stopped++ {
+		<-done
+	}
+}
+
+// Returns the host address the VM's connection is forwarded to.
+// The gateway stands for the host itself, DNS queries sent to the gateway
+// are forwarded to the host's resolver, and only the HostPorts are reachable
+// on the host's loopback interface. In host only mode, only the host is
+// reachable, the second return value reports whether the target is allowed.
+func (u *UserNet) hostTarget(addr tcpip.Address, port uint16) (string, bool) {
+	ip := net.IP(addr.AsSlice())
+	if !ip.Equal(u.StartAddr.IPAddr().IP) {
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), !u.HostOnly
+	}
+
+	if port == dnsPort {
+		return net.JoinHostPort(hostNameserver(), strconv.Itoa(dnsPort)), !u.HostOnly
+	}
+
+	// The services listening on loopback don't expect to be reached from the VM
+	if !slices.Contains(u.HostPorts, port) {
+		log.Debug().Msgf("usernet: port %d of the host isn't forwarded", port)
+		return "", false
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), true
+}
+
+var errNoNameserver = errors.New("no nameserver found")
+
+// Returns the first IPv4 nameserver of the host
+func hostNameserver() string {
+	addr, err := readNameserver("/etc/resolv.conf")
+	if err != nil {
+		log.Debug().Err(err).Msg("usernet: reading host resolver configuration")
+		return fallbackNameserver
+	}
+	return addr
+}
+
+func readNameserver(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil && ip.To4() != nil {
+			return ip.String(), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errNoNameserver
+}
+
+var errUnsupportedNetwork = errors.New("usernet: unsupported network")
+
+// DialVM opens a connection to the VM from the gateway. The VM's address isn't
+// routable from the host, so the connection has to originate from the userspace stack.
+func (u *UserNet) DialVM(ctx context.Context, network string, addr netaddr.IPPort) (net.Conn, error) {
+	target := tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFrom4(addr.IP().As4()),
+		Port: addr.Port(),
+	}
+
+	switch network {
+	case "tcp":
+		conn, err := gonet.DialContextTCP(ctx, u.stack, target, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	case "udp":
+		conn, err := gonet.DialUDP(u.stack, nil, &target, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedNetwork, network)
+	}
+}
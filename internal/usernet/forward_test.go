@@ -0,0 +1,278 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package usernet
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestHostTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostOnly bool
+		addr     tcpip.Address
+		port     uint16
+		target   string
+		allowed  bool
+	}{
+		{name: "internet", addr: tcpip.AddrFrom4([4]byte{192, 0, 2, 1}), port: 443, target: "192.0.2.1:443", allowed: true},
+		{name: "internet in host only mode", hostOnly: true, addr: tcpip.AddrFrom4([4]byte{192, 0, 2, 1}), port: 443},
+		{name: "host port", addr: testGateway, port: 8080, target: "127.0.0.1:8080", allowed: true},
+		{name: "host port in host only mode", hostOnly: true, addr: testGateway, port: 8080, target: "127.0.0.1:8080", allowed: true},
+		{name: "loopback port not forwarded", addr: testGateway, port: 22},
+		{name: "loopback port not forwarded in host only mode", hostOnly: true, addr: testGateway, port: 22},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testParams()
+			p.HostOnly = tt.hostOnly
+			p.HostPorts = []uint16{8080}
+			u, err := New(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target, ok := u.hostTarget(tt.addr, tt.port)
+			if ok != tt.allowed {
+				t.Fatalf("got allowed %v, want %v", ok, tt.allowed)
+			}
+			if ok && target != tt.target {
+				t.Errorf("got %s, want %s", target, tt.target)
+			}
+		})
+	}
+}
+
+func TestReadNameserver(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		want    string
+		invalid bool
+	}{
+		{name: "first ipv4", conf: "search lan\nnameserver ::1\nnameserver 10.0.0.53\nnameserver 10.0.0.54\n", want: "10.0.0.53"},
+		{name: "no ipv4", conf: "nameserver ::1\n", invalid: true},
+		{name: "empty", conf: "", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "resolv.conf")
+			if err := os.WriteFile(path, []byte(tt.conf), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readNameserver(path)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("got %s, expected an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// Connections to the gateway only reach the host ports of the host's loopback interface
+func TestForwardTCPToHostPorts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		name    string
+		ports   []uint16
+		allowed bool
+	}{
+		{name: "host port", ports: []uint16{port}, allowed: true},
+		{name: "not forwarded", ports: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testParams()
+			p.HostPorts = tt.ports
+			_, vm := runTestVM(t, p)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := gonet.DialContextTCP(ctx, vm, tcpip.FullAddress{NIC: 1, Addr: testGateway, Port: port}, ipv4.ProtocolNumber)
+			if !tt.allowed {
+				if err == nil {
+					conn.Close()
+					t.Fatal("connected to a port which isn't forwarded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("got %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+// UDP datagrams are relayed to the host and back
+func TestForwardUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+
+	p := testParams()
+	p.HostPorts = []uint16{port}
+	_, vm := runTestVM(t, p)
+
+	conn, err := gonet.DialUDP(vm, nil, &tcpip.FullAddress{NIC: 1, Addr: testGateway, Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+}
+
+// Traffic in one direction keeps the flow alive, the flow is closed once both are idle
+func TestRelayUDPIdle(t *testing.T) {
+	prev := udpIdleTimeout
+	udpIdleTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { udpIdleTimeout = prev })
+
+	vm, vmRelay := net.Pipe()
+	host, hostRelay := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relayUDP(context.Background(), vmRelay, hostRelay)
+	}()
+
+	go func() { _, _ = io.Copy(io.Discard, host) }()
+	for i := 0; i < 10; i++ {
+		_ = vm.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := vm.Write([]byte("log")); err != nil {
+			t.Fatalf("datagram %d: %v, want the flow alive", i, err)
+		}
+		time.Sleep(udpIdleTimeout / 4)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * udpIdleTimeout):
+		t.Fatal("idle flow not closed")
+	}
+}
+
+func TestRelayUDPStopped(t *testing.T) {
+	vm, vmRelay := net.Pipe()
+	defer vm.Close()
+	host, hostRelay := net.Pipe()
+	defer host.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relayUDP(ctx, vmRelay, hostRelay)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed once stopped")
+	}
+}
+
+// The flows beyond maxUDPFlows are dropped
+func TestForwardUDPBounded(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+
+	p := testParams()
+	p.HostPorts = []uint16{port}
+	u, vm := runTestVM(t, p)
+
+	for i := 0; i < maxUDPFlows; i++ {
+		u.udpFlows <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for i := 0; i < maxUDPFlows; i++ {
+			<-u.udpFlows
+		}
+	})
+
+	conn, err := gonet.DialUDP(vm, nil, &tcpip.FullAddress{NIC: 1, Addr: testGateway, Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(make([]byte, 10)); err == nil {
+		t.Error("flow relayed beyond the limit")
+	}
+}
@@ -0,0 +1,192 @@
+// nolint:exhaustivestruct,exhaustruct,godot
+package usernet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Time to wait for an echo reply from the host
+	echoTimeout = 5 * time.Second
+	// How often the wait for the reply checks if the backend is stopped
+	echoPollInterval = 250 * time.Millisecond
+)
+
+// echoRequest holds the fields of the VM's echo request needed to build the reply.
+// It's copied out of the frame, so that it outlives the caller's buffer.
+type echoRequest struct {
+	vmMAC    net.HardwareAddr
+	vmIP     net.IP
+	targetIP net.IP
+	id       uint16
+	seq      uint16
+	payload  []byte
+}
+
+// Sends the VM's echo requests from an unprivileged ICMP socket of the host.
+// Echo requests sent to the gateway are answered by the userspace stack itself.
+// Returns true if the frame was consumed.
+func (u *UserNet) forwardEcho(packet gopacket.Packet) bool {
+	ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || ip.Protocol != layers.IPProtocolICMPv4 || ip.DstIP.Equal(u.StartAddr.IPAddr().IP) {
+		return false
+	}
+
+	// Let the userspace stack drop it
+	if u.HostOnly {
+		return false
+	}
+
+	icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ok || icmp.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+		return false
+	}
+
+	eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		return false
+	}
+
+	req := echoRequest{
+		vmMAC:    append(net.HardwareAddr(nil), eth.SrcMAC...),
+		vmIP:     append(net.IP(nil), ip.SrcIP...),
+		targetIP: append(net.IP(nil), ip.DstIP...),
+		id:       icmp.Id,
+		seq:      icmp.Seq,
+		payload:  append([]byte(nil), icmp.Payload...),
+	}
+
+	// The VM retries the dropped request
+	select {
+	case u.echoes <- struct{}{}:
+	default:
+		log.Debug().Msgf("usernet: too many echo requests in flight, dropped echo %s", req.targetIP)
+		return true
+	}
+
+	if u.ctx.Err() != nil {
+		<-u.echoes
+		return true
+	}
+
+	// Stop waits for the reply, so that it isn't pushed once the Event queue is closed
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		defer func() { <-u.echoes }()
+
+		payload, err := echo(u.ctx, req)
+		if err != nil {
+			log.Debug().Err(err).Msgf("usernet: echo %s", req.targetIP)
+			return
+		}
+
+		frame, err := req.replyFrame(payload)
+		if err != nil {
+			log.Error().Err(err).Msg("usernet: building echo reply")
+			return
+		}
+		u.push(frame)
+	}()
+
+	return true
+}
+
+// Sends the echo request from the host, and returns the payload of the reply,
+// unless ctx is done first. Datagram ICMP sockets don't need root on macOS,
+// on Linux the user's group has to be in the net.ipv4.ping_group_range sysctl.
+func echo(ctx context.Context, req echoRequest) ([]byte, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_ICMP)
+	if err != nil {
+		return nil, fmt.Errorf("opening icmp socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	timeout := unix.NsecToTimeval(echoPollInterval.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return nil, fmt.Errorf("setting receive timeout: %w", err)
+	}
+
+	request := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		Id:       req.id,
+		Seq:      req.seq,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, request, gopacket.Payload(req.payload)); err != nil {
+		return nil, fmt.Errorf("serializing echo request: %w", err)
+	}
+
+	target := &unix.SockaddrInet4{Addr: [4]byte(req.targetIP.To4())}
+	if err := unix.Sendto(fd, buf.Bytes(), 0, target); err != nil {
+		return nil, fmt.Errorf("sending echo request: %w", err)
+	}
+
+	deadline := time.Now().Add(echoTimeout)
+	reply := make([]byte, 65535)
+	for {
+		n, _, err := unix.Recvfrom(fd, reply, 0)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			if ctx.Err() != nil || time.Now().After(deadline) {
+				return nil, fmt.Errorf("receiving echo reply: %w", unix.ETIMEDOUT)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("receiving echo reply: %w", err)
+		}
+
+		data := reply[:n]
+		// macOS passes the IP header as well
+		if len(data) > 0 && data[0]>>4 == 4 {
+			data = data[int(data[0]&0x0f)*4:]
+		}
+
+		msg := &layers.ICMPv4{}
+		if err := msg.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			continue
+		}
+		// Linux rewrites the identifier, only the sequence number can be matched
+		if msg.TypeCode.Type() == layers.ICMPv4TypeEchoReply && msg.Seq == req.seq {
+			return msg.Payload, nil
+		}
+	}
+}
+
+// Builds the echo reply frame sent by the target to the VM
+func (r echoRequest) replyFrame(payload []byte) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       gatewayMAC,
+		DstMAC:       r.vmMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    r.targetIP,
+		DstIP:    r.vmIP,
+	}
+	icmp := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+		Id:       r.id,
+		Seq:      r.seq,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, icmp, gopacket.Payload(payload)); err != nil {
+		return nil, fmt.Errorf("serializing echo reply: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,104 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package usernet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+func echoRequestPacket(t *testing.T, dst net.IP, seq uint16) gopacket.Packet {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: testVMMAC, DstMAC: gatewayMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: net.IP(testVMAddr.AsSlice()), DstIP: dst}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: seq}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, icmp, gopacket.Payload("ping")); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// The requests beyond maxInFlightEchoes are dropped without starting a goroutine
+func TestForwardEchoBounded(t *testing.T) {
+	u, _ := runTestVM(t, testParams())
+
+	for i := 0; i < maxInFlightEchoes; i++ {
+		u.echoes <- struct{}{}
+	}
+	if !u.forwardEcho(echoRequestPacket(t, net.IPv4(127, 0, 0, 1), 1)) {
+		t.Fatal("echo request not consumed")
+	}
+	if len(u.echoes) != maxInFlightEchoes {
+		t.Fatalf("got %d echoes in flight, want %d", len(u.echoes), maxInFlightEchoes)
+	}
+	for i := 0; i < maxInFlightEchoes; i++ {
+		<-u.echoes
+	}
+}
+
+func TestForwardEcho(t *testing.T) {
+	// Datagram ICMP sockets might not be allowed by net.ipv4.ping_group_range
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_ICMP)
+	if err != nil {
+		t.Skipf("opening icmp socket: %s", err)
+	}
+	unix.Close(fd)
+
+	u, err := New(testParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	if !u.forwardEcho(echoRequestPacket(t, net.IPv4(127, 0, 0, 1), 7)) {
+		t.Fatal("echo request not consumed")
+	}
+
+	select {
+	case frame := <-u.Frames():
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if !ok || icmp.TypeCode.Type() != layers.ICMPv4TypeEchoReply || icmp.Seq != 7 || string(icmp.Payload) != "ping" {
+			t.Fatalf("got %v, want an echo reply", packet)
+		}
+	case <-time.After(echoTimeout):
+		t.Fatal("no echo reply")
+	}
+}
+
+// Echo requests to the gateway and in host only mode are left to the userspace stack
+func TestForwardEchoSkipped(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostOnly bool
+		dst      net.IP
+	}{
+		{name: "gateway", dst: net.IP(testGateway.AsSlice())},
+		{name: "host only mode", hostOnly: true, dst: net.IPv4(127, 0, 0, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testParams()
+			p.HostOnly = tt.hostOnly
+			u, err := New(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.forwardEcho(echoRequestPacket(t, tt.dst, 1)) {
+				t.Fatal("echo request consumed")
+			}
+		})
+	}
+}
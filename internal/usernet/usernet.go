@@ -0,0 +1,291 @@
+// nolint:exhaustivestruct,exhaustruct,godot
+package usernet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"github.com/nagypeterjob/sock-vmnet/internal/netif"
+	"github.com/rs/zerolog/log"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"inet.af/netaddr"
+)
+
+var (
+	errNetstack  = errors.New("usernet: netstack")
+	errNoRestart = errors.New("usernet: the userspace stack can't be restarted")
+)
+
+const (
+	// The only NIC of the userspace stack, facing the VM
+	nicID tcpip.NICID = 1
+	// MTU of the VM's interface, if not configured otherwise
+	defaultMTU = 1500
+	// Number of outbound frames queued by the link endpoint
+	linkQueueSize = 1024
+	// Maximum number of TCP connections being dialed on the host at the same time
+	maxInFlightConnections = 1024
+	// Maximum number of echo requests awaiting a reply from the host at the same time
+	maxInFlightEchoes = 64
+	// Maximum number of UDP flows relayed to the host at the same time
+	maxUDPFlows = 512
+)
+
+// Locally administered MAC address of the gateway
+var gatewayMAC = net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xee}
+
+type Params struct {
+	StartAddr  netaddr.IP
+	EndAddr    netaddr.IP
+	SubnetMask netaddr.IP
+	// Default MTU is 1500
+	MTU int
+	// Only forward the VM's connections to the host itself
+	HostOnly bool
+	// Ports of the host's loopback interface the VM's connections to the gateway are forwarded to.
+	// Connections to the other ports of the gateway are refused. Default HostPorts is none.
+	HostPorts []uint16
+	// Policy and depth of the queue of the frames sent to the VM
+	Queue backpressure.Params
+	Debug bool
+}
+
+// UserNet terminates the VM's TCP, UDP and ICMP echo traffic in a userspace
+// TCP/IP stack, and re-originates the connections from host sockets.
+//
+// Unlike vmnet, it doesn't need root privileges or the vmnet entitlement,
+// and runs on every platform, since it's pure Go.
+//
+// The gateway (StartAddr) is served by the userspace stack itself, connections
+// to the HostPorts of the gateway are forwarded to the host's loopback interface.
+// In host only mode nothing else is reachable.
+type UserNet struct {
+	// usernet params
+	Params
+
+	// The maximum size of the frames which can be written to the backend.
+	MaxPacketSize int
+	// Frames to be sent to the VM. The queue is closed by Stop.
+	Event *backpressure.Queue
+
+	// Serves the VM's dhcp requests in place of bootpd
+	dhcp *dhcpServer
+
+	// Slots of the echo requests awaiting a reply
+	echoes chan struct{}
+	// Slots of the UDP flows being relayed
+	udpFlows chan struct{}
+
+	stack *stack.Stack
+	link  *channel.Endpoint
+
+	cancel context.CancelFunc
+	ctx    context.Context
+	wg     sync.WaitGroup
+}
+
+func New(p Params) (*UserNet, error) {
+	if p.MTU == 0 {
+		p.MTU = defaultMTU
+	}
+
+	// Same default depth as vmnet's
+	event, err := backpressure.New(p.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserNet{
+		Params:        p,
+		MaxPacketSize: p.MTU + header.EthernetMinimumSize,
+		Event:         event,
+		dhcp:          newDHCPServer(p.StartAddr, p.EndAddr, p.SubnetMask),
+		echoes:        make(chan struct{}, maxInFlightEchoes),
+		udpFlows:      make(chan struct{}, maxUDPFlows),
+	}, nil
+}
+
+func (u *UserNet) Start() error {
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+
+	u.link = channel.New(linkQueueSize, uint32(u.MaxPacketSize), tcpip.LinkAddress(gatewayMAC))
+	u.stack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+	})
+
+	if err := u.stack.CreateNIC(nicID, ethernet.New(u.link)); err != nil {
+		return fmt.Errorf("%w: creating NIC: %s", errNetstack, err)
+	}
+
+	// Accept packets sent to any address, and reply on behalf of any address,
+	// so that the stack can terminate connections headed to the internet.
+	if err := u.stack.SetPromiscuousMode(nicID, true); err != nil {
+		return fmt.Errorf("%w: setting promiscuous mode: %s", errNetstack, err)
+	}
+	if err := u.stack.SetSpoofing(nicID, true); err != nil {
+		return fmt.Errorf("%w: setting spoofing: %s", errNetstack, err)
+	}
+
+	prefixLen, _ := net.IPMask(u.SubnetMask.IPAddr().IP.To4()).Size()
+	gateway := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFrom4(u.StartAddr.As4()),
+			PrefixLen: prefixLen,
+		},
+	}
+	if err := u.stack.AddProtocolAddress(nicID, gateway, stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("%w: adding gateway address: %s", errNetstack, err)
+	}
+	u.stack.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	tcpForwarder := tcp.NewForwarder(u.stack, 0, maxInFlightConnections, u.forwardTCP)
+	u.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(u.stack, u.forwardUDP)
+	u.stack.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	u.wg.Add(1)
+	go u.readLink()
+
+	if u.Debug {
+		log.Debug().Msgf("usernet: gateway %s/%d, MTU %d", u.StartAddr, prefixLen, u.MTU)
+	}
+
+	return nil
+}
+
+func (u *UserNet) Stop() error {
+	u.cancel()
+	u.stack.Close()
+	u.link.Close()
+	u.wg.Wait()
+	u.Event.Close()
+
+	return nil
+}
+
+// Frames returns the frames to be sent to the VM
+func (u *UserNet) Frames() <-chan []byte {
+	return u.Event.Frames()
+}
+
+// Failures returns nil, the userspace stack doesn't fail while it's running
+func (u *UserNet) Failures() <-chan error {
+	return nil
+}
+
+// Transient returns false, there's nothing to recover from
+func (u *UserNet) Transient(err error) bool {
+	return false
+}
+
+// Restart isn't supported, the backend never reports failures
+func (u *UserNet) Restart() error {
+	return errNoRestart
+}
+
+// QueueStats returns the counters of the Event queue
+func (u *UserNet) QueueStats() backpressure.Stats {
+	return u.Event.Stats()
+}
+
+// Release is a no-op, the frames are copied out of the userspace stack's packet buffers,
+// and left to the garbage collector
+func (u *UserNet) Release(frame []byte) {}
+
+// Interface returns the parameters of the userspace stack's interface, which are the configured ones
+func (u *UserNet) Interface() netif.Interface {
+	return netif.Interface{
+		StartAddr:     u.StartAddr,
+		EndAddr:       u.EndAddr,
+		SubnetMask:    u.SubnetMask,
+		MTU:           u.MTU,
+		MaxPacketSize: u.MaxPacketSize,
+	}
+}
+
+// FrameSize returns the maximum frame size of the backend
+func (u *UserNet) FrameSize() int {
+	return u.MaxPacketSize
+}
+
+// Write passes a frame sent by the VM to the userspace stack
+func (u *UserNet) Write(p []byte) (int, error) {
+	packet := gopacket.NewPacket(p, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	// bootpd isn't running, the dhcp requests are served by the backend
+	if reply, ok := u.dhcp.handle(packet); ok {
+		if reply != nil {
+			u.push(reply)
+		}
+		return len(p), nil
+	}
+
+	// The userspace stack can't forward ICMP, echo requests are sent from host sockets
+	if u.forwardEcho(packet) {
+		return len(p), nil
+	}
+
+	// The peer VMs answer for themselves
+	if u.peerARP(packet) {
+		return len(p), nil
+	}
+
+	// The packet buffer copies the frame, p can be reused by the caller
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(p)})
+	u.link.InjectInbound(0, pkt)
+	pkt.DecRef()
+
+	return len(p), nil
+}
+
+// Determine if the frame is an ARP request for an address other than the gateway.
+// In promiscuous mode, the userspace stack would answer on behalf of any address.
+func (u *UserNet) peerARP(packet gopacket.Packet) bool {
+	arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || arp.Operation != layers.ARPRequest {
+		return false
+	}
+	return !net.IP(arp.DstProtAddress).Equal(u.StartAddr.IPAddr().IP)
+}
+
+// Read the frames written by the userspace stack, and pass them to Event
+func (u *UserNet) readLink() {
+	defer u.wg.Done()
+	for {
+		pkt := u.link.ReadContext(u.ctx)
+		if pkt == nil {
+			return
+		}
+
+		view := pkt.ToView()
+		frame := view.ToSlice()
+		view.Release()
+		pkt.DecRef()
+
+		u.push(frame)
+	}
+}
+
+// Queue the frame to be sent to the VM. The dropped frames are left to the garbage collector.
+func (u *UserNet) push(frame []byte) {
+	u.Event.Push(frame)
+}
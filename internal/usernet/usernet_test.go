@@ -0,0 +1,97 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package usernet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"inet.af/netaddr"
+)
+
+var (
+	testVMMAC   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x42}
+	testVMAddr  = tcpip.AddrFrom4([4]byte{192, 168, 64, 2})
+	testGateway = tcpip.AddrFrom4([4]byte{192, 168, 64, 1})
+)
+
+func testParams() Params {
+	return Params{
+		StartAddr:  netaddr.MustParseIP("192.168.64.1"),
+		EndAddr:    netaddr.MustParseIP("192.168.64.255"),
+		SubnetMask: netaddr.MustParseIP("255.255.255.0"),
+		Queue:      backpressure.Params{Policy: backpressure.DropTail},
+	}
+}
+
+// Starts the backend, and a userspace stack of the VM attached to it.
+// Both are stopped once the test ends.
+func runTestVM(t *testing.T, p Params) (*UserNet, *stack.Stack) {
+	t.Helper()
+
+	u, err := New(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	link := channel.New(256, uint32(u.MaxPacketSize), tcpip.LinkAddress(testVMMAC))
+	vm := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if err := vm.CreateNIC(1, ethernet.New(link)); err != nil {
+		t.Fatal(err)
+	}
+	addr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: testVMAddr, PrefixLen: 24},
+	}
+	if err := vm.AddProtocolAddress(1, addr, stack.AddressProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	vm.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, Gateway: testGateway, NIC: 1}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for frame := range u.Frames() {
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(frame)})
+			link.InjectInbound(0, pkt)
+			pkt.DecRef()
+		}
+	}()
+	go func() {
+		for {
+			pkt := link.ReadContext(u.ctx)
+			if pkt == nil {
+				return
+			}
+			view := pkt.ToView()
+			_, _ = u.Write(view.AsSlice())
+			view.Release()
+			pkt.DecRef()
+		}
+	}()
+
+	t.Cleanup(func() {
+		_ = u.Stop()
+		<-done
+		vm.Close()
+		link.Close()
+	})
+
+	return u, vm
+}
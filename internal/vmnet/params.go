@@ -0,0 +1,195 @@
+// nolint:exhaustivestruct,exhaustruct,godot
+package vmnet
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"inet.af/netaddr"
+)
+
+var (
+	errInvalidMode        = errors.New("vmnet: invalid operation mode")
+	errNoBridgeInterface  = errors.New("vmnet: bridged mode requires a bridge interface")
+	errInvalidAddresses   = errors.New("vmnet: invalid address range")
+	errInvalidSubnetMask  = errors.New("vmnet: invalid subnet mask")
+	errInvalidMTU         = errors.New("vmnet: invalid MTU")
+	errInvalidNetworkID   = errors.New("vmnet: invalid network identifier")
+	errNetworkIDNotInHost = errors.New("vmnet: network identifier is only supported in host mode")
+	errInvalidNAT66Prefix = errors.New("vmnet: invalid NAT66 prefix")
+	errNAT66NotInShared   = errors.New("vmnet: NAT66 prefix is only supported in shared mode")
+)
+
+const (
+	// IPv6 minimum MTU
+	minMTU = 1280
+	// Jumbo frames
+	maxMTU = 9000
+)
+
+type OperationMode uint32
+
+// https://developer.apple.com/documentation/vmnet/operating_modes_t
+const (
+	// Host only, the VMs can reach the host and each other, but not the internet
+	Host OperationMode = 1000
+	// Shared good old NAT
+	Shared OperationMode = 1001
+	// Bridged the VMs join the LAN of a host interface, their addresses come from the LAN's dhcp server
+	Bridged OperationMode = 1002
+)
+
+type IsolationMode uint8
+
+// If enabled, no VM <-> VM communication allowed
+// https://developer.apple.com/documentation/vmnet/vmnet_enable_isolation_key
+const (
+	Enabled  IsolationMode = 1
+	Disabled IsolationMode = 2
+)
+
+type Params struct {
+	StartAddr  netaddr.IP
+	EndAddr    netaddr.IP
+	SubnetMask netaddr.IP
+	// Default Mode is Shared
+	Mode OperationMode
+	// Host interface the VMs are bridged to, e.g. en0. Only used in Bridged mode,
+	// the addresses are ignored then.
+	BridgeInterface string
+	// Default Isolation is Enabled
+	Isolation IsolationMode
+	// MTU of the VM's interface. Default MTU is chosen by vmnet, 1500.
+	MTU int
+	// UUID of the network, interfaces started with the same identifier
+	// share a network, even across processes. Only supported in Host mode.
+	// There's no dhcp service on these networks, the addresses are ignored then.
+	NetworkID string
+	// ULA /64 prefix of the VMs' IPv6 addresses, e.g. fd9b:5a14:ba57:e3d3::/64.
+	// Only supported in Shared mode.
+	NAT66Prefix string
+	// Policy and depth of the queue of the packets read from the interface
+	Queue backpressure.Params
+	Debug bool
+}
+
+// interfaceDesc is the validated form of Params, passed to vmnet_start_interface.
+// Empty strings and zero values are left out of the interface description.
+type interfaceDesc struct {
+	mode            OperationMode
+	startAddr       string
+	endAddr         string
+	subnetMask      string
+	sharedInterface string
+	isolation       bool
+	mtu             uint64
+	// nil if not set
+	networkID []byte
+	// The prefix address, vmnet expects it without the length
+	nat66Prefix string
+}
+
+// Validate the params and convert them to the keys of the vmnet interface description
+func (p Params) interfaceDesc() (interfaceDesc, error) {
+	desc := interfaceDesc{
+		mode:      p.Mode,
+		isolation: p.Isolation != Disabled,
+	}
+
+	switch p.Mode {
+	case Host, Shared:
+	case Bridged:
+		if p.BridgeInterface == "" {
+			return interfaceDesc{}, errNoBridgeInterface
+		}
+		desc.sharedInterface = p.BridgeInterface
+	default:
+		return interfaceDesc{}, fmt.Errorf("%w: %d", errInvalidMode, p.Mode)
+	}
+
+	if p.NetworkID != "" {
+		if p.Mode != Host {
+			return interfaceDesc{}, errNetworkIDNotInHost
+		}
+
+		id, err := parseUUID(p.NetworkID)
+		if err != nil {
+			return interfaceDesc{}, err
+		}
+		desc.networkID = id
+	}
+
+	// The addresses are handed out by vmnet's dhcp server
+	if p.Mode != Bridged && desc.networkID == nil {
+		if err := validRange(p.StartAddr, p.EndAddr, p.SubnetMask); err != nil {
+			return interfaceDesc{}, err
+		}
+		desc.startAddr = p.StartAddr.String()
+		desc.endAddr = p.EndAddr.String()
+		desc.subnetMask = p.SubnetMask.String()
+	}
+
+	if p.MTU != 0 {
+		if p.MTU < minMTU || p.MTU > maxMTU {
+			return interfaceDesc{}, fmt.Errorf("%w: %d is out of the %d-%d range", errInvalidMTU, p.MTU, minMTU, maxMTU)
+		}
+		desc.mtu = uint64(p.MTU)
+	}
+
+	if p.NAT66Prefix != "" {
+		if p.Mode != Shared {
+			return interfaceDesc{}, errNAT66NotInShared
+		}
+
+		prefix, err := netaddr.ParseIPPrefix(p.NAT66Prefix)
+		if err != nil || !prefix.IP().Is6() || prefix.Bits() != 64 || prefix.IP().As16()[0] != 0xfd {
+			return interfaceDesc{}, fmt.Errorf("%w: %s, expected an fd00::/8 /64 prefix", errInvalidNAT66Prefix, p.NAT66Prefix)
+		}
+		desc.nat66Prefix = prefix.Masked().IP().String()
+	}
+
+	return desc, nil
+}
+
+// The range has to be within a single ipv4 subnet, the StartAddr being the gateway
+func validRange(startAddr, endAddr, subnetMask netaddr.IP) error {
+	if !startAddr.Is4() || !endAddr.Is4() || !startAddr.Less(endAddr) {
+		return fmt.Errorf("%w: %s-%s", errInvalidAddresses, startAddr, endAddr)
+	}
+
+	// Size reports 0 bits for non-canonical masks
+	ones, bits := net.IPMask(subnetMask.IPAddr().IP.To4()).Size()
+	if !subnetMask.Is4() || bits == 0 || ones == 0 {
+		return fmt.Errorf("%w: %s", errInvalidSubnetMask, subnetMask)
+	}
+
+	subnet, err := startAddr.Prefix(uint8(ones))
+	if err != nil || !subnet.Contains(endAddr) {
+		return fmt.Errorf("%w: %s-%s is not within a /%d subnet", errInvalidAddresses, startAddr, endAddr, ones)
+	}
+
+	return nil
+}
+
+// Format an UUID in the canonical 8-4-4-4-12 form, the inverse of parseUUID
+func formatUUID(id []byte) string {
+	s := hex.EncodeToString(id)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+// Parse the canonical 8-4-4-4-12 form of an UUID
+func parseUUID(s string) ([]byte, error) {
+	if len(s) != 36 || strings.Count(s, "-") != 4 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return nil, fmt.Errorf("%w: %s", errInvalidNetworkID, s)
+	}
+
+	id, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidNetworkID, s)
+	}
+	return id, nil
+}
@@ -0,0 +1,192 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package vmnet
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+const testNetworkID = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+func TestInterfaceDesc(t *testing.T) {
+	addrs := Params{
+		StartAddr:  netaddr.MustParseIP("192.168.64.1"),
+		EndAddr:    netaddr.MustParseIP("192.168.64.255"),
+		SubnetMask: netaddr.MustParseIP("255.255.255.0"),
+	}
+	with := func(f func(p *Params)) Params {
+		p := addrs
+		f(&p)
+		return p
+	}
+
+	tests := []struct {
+		name   string
+		params Params
+		want   interfaceDesc
+		err    error
+	}{
+		{
+			name:   "shared",
+			params: with(func(p *Params) { p.Mode = Shared }),
+			want:   interfaceDesc{mode: Shared, startAddr: "192.168.64.1", endAddr: "192.168.64.255", subnetMask: "255.255.255.0", isolation: true},
+		},
+		{
+			name:   "isolation disabled",
+			params: with(func(p *Params) { p.Mode = Host; p.Isolation = Disabled }),
+			want:   interfaceDesc{mode: Host, startAddr: "192.168.64.1", endAddr: "192.168.64.255", subnetMask: "255.255.255.0"},
+		},
+		{
+			name:   "bridged ignores the addresses",
+			params: Params{Mode: Bridged, BridgeInterface: "en0"},
+			want:   interfaceDesc{mode: Bridged, sharedInterface: "en0", isolation: true},
+		},
+		{
+			name:   "bridged without interface",
+			params: Params{Mode: Bridged},
+			err:    errNoBridgeInterface,
+		},
+		{
+			name:   "unknown mode",
+			params: with(func(p *Params) { p.Mode = 7 }),
+			err:    errInvalidMode,
+		},
+		{
+			name:   "mtu",
+			params: with(func(p *Params) { p.Mode = Shared; p.MTU = 9000 }),
+			want:   interfaceDesc{mode: Shared, startAddr: "192.168.64.1", endAddr: "192.168.64.255", subnetMask: "255.255.255.0", isolation: true, mtu: 9000},
+		},
+		{
+			name:   "mtu too small",
+			params: with(func(p *Params) { p.Mode = Shared; p.MTU = 576 }),
+			err:    errInvalidMTU,
+		},
+		{
+			name:   "mtu too large",
+			params: with(func(p *Params) { p.Mode = Shared; p.MTU = 9001 }),
+			err:    errInvalidMTU,
+		},
+		{
+			name:   "network id ignores the addresses",
+			params: Params{Mode: Host, NetworkID: testNetworkID},
+			want: interfaceDesc{mode: Host, isolation: true, networkID: []byte{
+				0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8,
+			}},
+		},
+		{
+			name:   "network id in shared mode",
+			params: with(func(p *Params) { p.Mode = Shared; p.NetworkID = testNetworkID }),
+			err:    errNetworkIDNotInHost,
+		},
+		{
+			name:   "invalid network id",
+			params: Params{Mode: Host, NetworkID: "6ba7b810-9dad-11d1-80b4"},
+			err:    errInvalidNetworkID,
+		},
+		{
+			name:   "nat66 prefix",
+			params: with(func(p *Params) { p.Mode = Shared; p.NAT66Prefix = "fd9b:5a14:ba57:e3d3::1/64" }),
+			want:   interfaceDesc{mode: Shared, startAddr: "192.168.64.1", endAddr: "192.168.64.255", subnetMask: "255.255.255.0", isolation: true, nat66Prefix: "fd9b:5a14:ba57:e3d3::"},
+		},
+		{
+			name:   "nat66 prefix in host mode",
+			params: with(func(p *Params) { p.Mode = Host; p.NAT66Prefix = "fd9b:5a14:ba57:e3d3::/64" }),
+			err:    errNAT66NotInShared,
+		},
+		{
+			name:   "nat66 prefix not ula",
+			params: with(func(p *Params) { p.Mode = Shared; p.NAT66Prefix = "2001:db8::/64" }),
+			err:    errInvalidNAT66Prefix,
+		},
+		{
+			name:   "nat66 prefix not /64",
+			params: with(func(p *Params) { p.Mode = Shared; p.NAT66Prefix = "fd9b:5a14::/48" }),
+			err:    errInvalidNAT66Prefix,
+		},
+		{
+			name:   "invalid range",
+			params: with(func(p *Params) { p.Mode = Shared; p.EndAddr = netaddr.MustParseIP("192.168.65.1") }),
+			err:    errInvalidAddresses,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.params.interfaceDesc()
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		mask  string
+		err   error
+	}{
+		{name: "/24", start: "192.168.64.1", end: "192.168.64.255", mask: "255.255.255.0"},
+		{name: "/16", start: "10.0.0.1", end: "10.0.255.254", mask: "255.255.0.0"},
+		{name: "end before start", start: "192.168.64.10", end: "192.168.64.1", mask: "255.255.255.0", err: errInvalidAddresses},
+		{name: "beyond the subnet", start: "192.168.64.1", end: "192.168.65.1", mask: "255.255.255.0", err: errInvalidAddresses},
+		{name: "ipv6", start: "fd00::1", end: "fd00::ff", mask: "255.255.255.0", err: errInvalidAddresses},
+		{name: "non-canonical mask", start: "192.168.64.1", end: "192.168.64.255", mask: "255.0.255.0", err: errInvalidSubnetMask},
+		{name: "zero mask", start: "192.168.64.1", end: "192.168.64.255", mask: "0.0.0.0", err: errInvalidSubnetMask},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validRange(netaddr.MustParseIP(tt.start), netaddr.MustParseIP(tt.end), netaddr.MustParseIP(tt.mask))
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseUUID(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    string
+		valid bool
+	}{
+		{name: "canonical", id: testNetworkID, valid: true},
+		{name: "without dashes", id: "6ba7b8109dad11d180b400c04fd430c8"},
+		{name: "misplaced dashes", id: "6ba7b810-9dad1-1d1-80b4-00c04fd430c8"},
+		{name: "not hex", id: "6ba7b810-9dad-11d1-80b4-00c04fd430cg"},
+		{name: "empty", id: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := parseUUID(tt.id)
+			if !tt.valid {
+				if !errors.Is(err, errInvalidNetworkID) {
+					t.Fatalf("got %v, want %v", err, errInvalidNetworkID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatUUID(id); got != tt.id {
+				t.Errorf("got %s after formatting, want %s", got, tt.id)
+			}
+		})
+	}
+}
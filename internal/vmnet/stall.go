@@ -0,0 +1,33 @@
+// nolint:godot
+package vmnet
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The interface is stalled, once it refused every packet written to it for this long
+const stallTimeout = time.Minute
+
+// stallDetector tracks the writes refused by the interface. The interface is stalled
+// when it refused the packets for stallTimeout, without taking any in between.
+// A quiet interface, or one only written to, isn't stalled.
+type stallDetector struct {
+	// Unix time of the first write refused since the last successful one, 0 if the last write succeeded, in nanoseconds
+	refusedSince atomic.Int64
+}
+
+// A packet was written to the interface
+func (d *stallDetector) written() {
+	d.refusedSince.Store(0)
+}
+
+// The interface refused a packet at now
+func (d *stallDetector) refused(now time.Time) {
+	d.refusedSince.CompareAndSwap(0, now.UnixNano())
+}
+
+func (d *stallDetector) stalled(now time.Time) bool {
+	since := d.refusedSince.Load()
+	return since != 0 && now.Sub(time.Unix(0, since)) >= stallTimeout
+}
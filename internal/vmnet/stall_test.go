@@ -0,0 +1,69 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package vmnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStallDetector(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	// A write at start plus at, refused by the interface or not
+	type write struct {
+		at      time.Duration
+		refused bool
+	}
+
+	tests := []struct {
+		name    string
+		writes  []write
+		at      time.Duration
+		stalled bool
+	}{
+		{name: "nothing written", at: 2 * stallTimeout},
+		{
+			// Packets written to the interface, none read from it
+			name:   "one-way traffic",
+			writes: []write{{at: 0}, {at: stallTimeout}, {at: 2 * stallTimeout}},
+			at:     3 * stallTimeout,
+		},
+		{
+			name:    "refused",
+			writes:  []write{{at: 0, refused: true}, {at: time.Second, refused: true}},
+			at:      stallTimeout,
+			stalled: true,
+		},
+		{
+			name:   "refused, not for long",
+			writes: []write{{at: 0, refused: true}},
+			at:     stallTimeout - time.Second,
+		},
+		{
+			name:   "written after refused",
+			writes: []write{{at: 0, refused: true}, {at: time.Second}},
+			at:     2 * stallTimeout,
+		},
+		{
+			name:   "refused again, since the last write",
+			writes: []write{{at: 0, refused: true}, {at: time.Second}, {at: 2 * time.Second, refused: true}},
+			at:     stallTimeout + time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d stallDetector
+			for _, w := range tt.writes {
+				if w.refused {
+					d.refused(start.Add(w.at))
+				} else {
+					d.written()
+				}
+			}
+			if got := d.stalled(start.Add(tt.at)); got != tt.stalled {
+				t.Errorf("got stalled %t, want %t", got, tt.stalled)
+			}
+		})
+	}
+}
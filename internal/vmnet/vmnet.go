@@ -1,3 +1,5 @@
+//go:build darwin
+
 // nolint:gocritic,exhaustivestruct,exhaustruct,nosnakecase
 package vmnet
 
@@ -6,9 +8,16 @@ package vmnet
 import "C"
 
 import (
+	"bytes"
 	"errors"
+	"net"
+	"sync"
+	"time"
 	"unsafe"
 
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"github.com/nagypeterjob/sock-vmnet/internal/netif"
+	"github.com/nagypeterjob/sock-vmnet/internal/pool"
 	"github.com/rs/zerolog/log"
 	"inet.af/netaddr"
 )
@@ -26,10 +35,33 @@ var (
 	errNotAuthorized           = errors.New("vmnet: not authorized")
 	errNotWritten              = errors.New("vmnet: packet not written")
 	errSetupCallback           = errors.New("vmnet: could not setup callback")
-	errNoPackageRead           = errors.New("vmnet: no package read")
+	errStopped                 = errors.New("vmnet: interface is stopped")
+	errStalled                 = errors.New("vmnet: interface stalled, packets refused")
 )
 
-const successCode = 1000
+// The interface might work again after a restart, once these errors are gone
+var transientErrs = []error{
+	errUnspecifiedFailure,
+	errOutOfMemory,
+	errSetupIncomplete,
+	errKernelBufferExhausted,
+	errTooManyPackets,
+	errSharingServiceBusy,
+	errStopped,
+	errStalled,
+}
+
+const (
+	successCode = 1000
+
+	// Maximum number of packets read by a single vmnet_read call
+	readBatchSize = 64
+	// Number of packet buffers kept for reuse, enough for a full Event chan and a read batch
+	bufferPoolSize = 256
+
+	// How often the interface is checked for a stall
+	stallCheckInterval = 10 * time.Second
+)
 
 var errCodesMap = map[int]error{
 	1001: errUnspecifiedFailure,
@@ -44,7 +76,6 @@ var errCodesMap = map[int]error{
 	1010: errNotAuthorized,
 	2001: errNotWritten,
 	3000: errSetupCallback,
-	4000: errNoPackageRead,
 }
 
 func maptoErr(code int) error {
@@ -55,27 +86,10 @@ func maptoErr(code int) error {
 	return err
 }
 
-type OperationMode C.uint32_t
-
-// https://developer.apple.com/documentation/vmnet/operating_modes_t
-const (
-	// Host: not implemented
-	Host OperationMode = 1000
-	// Shared good old NAT
-	Shared OperationMode = 1001
-	// Bridged: not implemented
-	Bridged OperationMode = 1002
-)
-
-type IsolationMode bool
-
-// If enabled, no VM <-> VM communication allowed
-// https://developer.apple.com/documentation/vmnet/vmnet_enable_isolation_key
-const (
-	// NOTE: might want to let the user define it via flags
-	Enabled  IsolationMode = true
-	Disabled IsolationMode = false
-)
+// The interface didn't take the packet, for a reason of its own rather than the packet's
+func refused(err error) bool {
+	return errors.Is(err, errNotWritten) || errors.Is(err, errTooManyPackets)
+}
 
 // Wee need to pass this global variable through the C realm of vmnet,
 // so that we can access fields & functions of the VMNet struct from packetsAvailable func.
@@ -84,13 +98,6 @@ const (
 // We could use something like this instead: https://github.com/mattn/go-pointer
 var vmnetPtr *VMNet
 
-type Params struct {
-	StartAddr  netaddr.IP
-	EndAddr    netaddr.IP
-	SubnetMask netaddr.IP
-	Debug      bool
-}
-
 type VMNet struct {
 	// vmnet params
 	Params
@@ -102,76 +109,324 @@ type VMNet struct {
 	// The MTU to be configured on the virtual interface in the guest operating system.
 	MTU int
 	// By listening on VMNET_INTERFACE_PACKETS_AVAILABLE events, the registered callback
-	// notifes us that the interface is readable. The read packes are being passed to the Even chan.
+	// notifes us that the interface is readable. The read packes are being passed to the Event queue.
+	// The queue never blocks vmnet's dispatch queue for longer than its policy allows.
 	// See packetsAvailable for more.
-	Event chan []byte
+	Event *backpressure.Queue
 
 	// CGO representation of the VMNet interface
 	iface C.interface_ref
-	// CGO representation of max packet size
-	mps C.ulonglong
-	// CGO representation of mtu
-	mtu C.ulonglong
+	// The parameters of the interface reported by vmnet, see Interface
+	info netif.Interface
+	// Packet buffers of vmnet_read, in C memory
+	batch *C.struct_vmnet_batch
+	// Buffers of the packets passed to Event, returned by Release
+	pool *pool.Pool
+
+	// Failures of the interface, see Failures
+	failures chan error
+	// Tracks the writes refused by the interface
+	stall stallDetector
+	// Closed when the interface is stopped, ends its watchdog
+	watchdog chan struct{}
+
+	// Set while the interface is stopped. The callbacks still in flight don't touch
+	// batch and Event, and the writes fail with errStopped.
+	stopped bool
+	// Set when the interface failed to restart, the writes report errStopped as a failure
+	startFailed bool
+	m           sync.RWMutex
 }
 
-func New(p Params) *VMNet {
-	return &VMNet{
-		Params: p,
-		// I found the 100 buffer size to be optimal performance wise
-		Event: make(chan []byte, 100),
+func New(p Params) (*VMNet, error) {
+	if p.Mode == 0 {
+		p.Mode = Shared
+	}
+	if p.Isolation == 0 {
+		p.Isolation = Enabled
+	}
+
+	// I found the 100 buffer size to be optimal performance wise, it's the default depth
+	event, err := backpressure.New(p.Queue)
+	if err != nil {
+		return nil, err
 	}
+
+	return &VMNet{
+		Params:   p,
+		Event:    event,
+		failures: make(chan error, 1),
+		stopped:  true,
+	}, nil
 }
 
 func (v *VMNet) Start() error {
-	startAddr := C.CString(v.StartAddr.String())
-	endAddr := C.CString(v.EndAddr.String())
-	subnetMask := C.CString(v.SubnetMask.String())
+	desc, err := v.interfaceDesc()
+	if err != nil {
+		return err
+	}
+
+	params := C.struct_vmnet_params{
+		operation_mode:   C.uint32_t(desc.mode),
+		start_addr:       cString(desc.startAddr),
+		end_addr:         cString(desc.endAddr),
+		subnet_mask:      cString(desc.subnetMask),
+		shared_interface: cString(desc.sharedInterface),
+		isolation:        C.bool(desc.isolation),
+		mtu:              C.uint64_t(desc.mtu),
+		nat66_prefix:     cString(desc.nat66Prefix),
+	}
+	if desc.networkID != nil {
+		params.network_identifier = (*C.uchar)(C.CBytes(desc.networkID))
+	}
 
-	defer C.free(unsafe.Pointer(startAddr))
-	defer C.free(unsafe.Pointer(endAddr))
-	defer C.free(unsafe.Pointer(subnetMask))
+	defer C.free(unsafe.Pointer(params.start_addr))
+	defer C.free(unsafe.Pointer(params.end_addr))
+	defer C.free(unsafe.Pointer(params.subnet_mask))
+	defer C.free(unsafe.Pointer(params.shared_interface))
+	defer C.free(unsafe.Pointer(params.nat66_prefix))
+	defer C.free(unsafe.Pointer(params.network_identifier))
 
 	// Create the interface. From this point, ifconfig will show both bridge100 and vmenet<n> interfaces.
-	errCode := C._vmnet_start(&v.iface, &v.mps, &v.mtu,
-		startAddr, endAddr, subnetMask, C.uint32_t(Shared), C.bool(Enabled), C.bool(v.Debug))
+	var reported C.struct_vmnet_interface_params
+	errCode := C._vmnet_start(&v.iface, &reported, &params)
 	if errCode != successCode || v.iface == nil {
 		return maptoErr(int(errCode))
 	}
 
 	// Read and save actual max packet size and mtu values from the interface config
-	v.MaxPacketSize = int(v.mps)
-	v.MTU = int(v.mtu)
+	info := interfaceInfo(&reported)
+	v.MaxPacketSize = info.MaxPacketSize
+	v.MTU = info.MTU
+
+	v.batch = C._vmnet_batch_new(C.int(readBatchSize), reported.max_packet_size)
+	if v.batch == nil {
+		C._vmnet_stop(v.iface)
+		return errOutOfMemory
+	}
+	// The frames of the previous interface are released to the pool after a restart
+	if v.pool == nil {
+		v.pool = pool.New(bufferPoolSize, v.MaxPacketSize)
+	}
 
 	// set the global pointer to the current state of self
+	v.m.Lock()
 	vmnetPtr = v
+	v.info = info
+	v.stopped = false
+	// The failures of the previous interface are resolved by the restart
+	select {
+	case <-v.failures:
+	default:
+	}
+	v.m.Unlock()
+
+	// The writes refused by the previous interface don't count
+	v.stall.written()
+	v.watchdog = make(chan struct{})
+	go v.watch(v.watchdog)
 
 	return nil
 }
 
+// Convert the values of vmnet's start-completion dictionary, the ones
+// vmnet didn't report, or failed to parse, are left zero
+func interfaceInfo(p *C.struct_vmnet_interface_params) netif.Interface {
+	info := netif.Interface{
+		MTU:           int(p.mtu),
+		MaxPacketSize: int(p.max_packet_size),
+	}
+
+	info.HardwareAddr, _ = net.ParseMAC(C.GoString(&p.mac_address[0]))
+	info.StartAddr, _ = netaddr.ParseIP(C.GoString(&p.start_addr[0]))
+	info.EndAddr, _ = netaddr.ParseIP(C.GoString(&p.end_addr[0]))
+	info.SubnetMask, _ = netaddr.ParseIP(C.GoString(&p.subnet_mask[0]))
+
+	// vmnet reports the prefix address without the length, which is always /64
+	if prefix, err := netaddr.ParseIP(C.GoString(&p.nat66_prefix[0])); err == nil {
+		info.NAT66Prefix = netaddr.IPPrefixFrom(prefix, 64)
+	}
+
+	id := C.GoBytes(unsafe.Pointer(&p.interface_id[0]), C.int(len(p.interface_id)))
+	if !bytes.Equal(id, make([]byte, len(id))) {
+		info.ID = formatUUID(id)
+	}
+
+	return info
+}
+
+// Returns a C copy of the string, or NULL if it's empty. Freeing NULL is a no-op.
+func cString(s string) *C.char {
+	if s == "" {
+		return nil
+	}
+	return C.CString(s)
+}
+
 func (v *VMNet) Stop() error {
-	defer close(v.Event)
+	defer v.Event.Close()
+	return v.stop()
+}
+
+// Restart the interface with the same parameters. Event stays open,
+// the packets already queued are still delivered.
+// It mustn't be called concurrently with Start or Stop.
+func (v *VMNet) Restart() error {
+	// The interface might be gone already, start a new one regardless
+	if err := v.stop(); err != nil {
+		log.Error().Err(err).Msg("stopping vmnet")
+	}
+
+	err := v.Start()
+	v.m.Lock()
+	v.startFailed = err != nil
+	v.m.Unlock()
+	return err
+}
+
+func (v *VMNet) stop() error {
+	// Wait for the running callback and writes, the next ones return right away
+	v.m.Lock()
+	if v.stopped {
+		v.m.Unlock()
+		return nil
+	}
+	v.stopped = true
+	v.m.Unlock()
+	close(v.watchdog)
+
 	if errCode := C._vmnet_stop(v.iface); errCode != successCode {
 		return maptoErr(int(errCode))
 	}
+
+	// No more packets are read from the stopped interface
+	C._vmnet_batch_free(v.batch)
+	v.batch = nil
+
 	return nil
 }
 
-func (v *VMNet) read() ([]byte, error) {
-	var cBytes unsafe.Pointer
-	var cBytesLen C.ulong
+// Failures reports the failed reads and writes of the interface, and its stalls.
+// Only the first one is kept until it's received, the interface is restarted anyway.
+func (v *VMNet) Failures() <-chan error {
+	return v.failures
+}
 
-	// The C code performs the memory deallocation of cBytes, no need to call C.free here.
-	if errCode := C._vmnet_read(v.iface, v.mps, &cBytes, &cBytesLen); errCode != successCode {
-		return nil, maptoErr(int(errCode))
+// Report a failure, unless one is already waiting to be received
+func (v *VMNet) fail(err error) {
+	select {
+	case v.failures <- err:
+	default:
 	}
-	return C.GoBytes(cBytes, C.int(cBytesLen)), nil
 }
 
-func (v *VMNet) Write(p []byte) (int, error) {
-	// The C code performs the memory deallocation of cBytes, no need to call C.free here.
-	if errCode := C._vmnet_write(v.iface, C.CBytes(p), C.ulong(len(p))); errCode != successCode {
+// Report a stall, once the interface refused every packet written to it for stallTimeout.
+// Runs until the interface is stopped.
+func (v *VMNet) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(stallCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if v.stall.stalled(now) {
+				log.Error().Err(errStalled).Msg("watching vmnet")
+				v.fail(errStalled)
+			}
+		}
+	}
+}
+
+// Transient determines if restarting the interface might recover from the error
+func (v *VMNet) Transient(err error) bool {
+	for _, transient := range transientErrs {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// Frames returns the packets read from the interface
+func (v *VMNet) Frames() <-chan []byte {
+	return v.Event.Frames()
+}
+
+// QueueStats returns the counters of the Event queue
+func (v *VMNet) QueueStats() backpressure.Stats {
+	return v.Event.Stats()
+}
+
+// Interface returns the parameters of the interface reported by vmnet, once it's started
+func (v *VMNet) Interface() netif.Interface {
+	v.m.RLock()
+	defer v.m.RUnlock()
+	return v.info
+}
+
+// FrameSize returns the maximum packet size of the interface
+func (v *VMNet) FrameSize() int {
+	return v.MaxPacketSize
+}
+
+// Release returns a frame read from Frames to the buffer pool, once it's no longer used
+func (v *VMNet) Release(frame []byte) {
+	v.pool.Put(frame)
+}
+
+// Reads up to limit packets with a single vmnet_read call, and passes them to Event.
+// Returns the number of packets read.
+func (v *VMNet) readBatch(limit int) (int, error) {
+	count := C.int(limit)
+	if errCode := C._vmnet_read_batch(v.iface, v.batch, &count); errCode != successCode {
 		return 0, maptoErr(int(errCode))
 	}
+
+	for i := 0; i < int(count); i++ {
+		var size C.size_t
+		bytes := C._vmnet_batch_packet(v.batch, C.int(i), &size)
+
+		// The C buffers are reused by the next read
+		buf := v.pool.Get()
+		n := copy(buf, unsafe.Slice((*byte)(bytes), int(size)))
+		if dropped := v.Event.Push(buf[:n]); dropped != nil {
+			v.pool.Put(dropped)
+		}
+	}
+
+	return int(count), nil
+}
+
+func (v *VMNet) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	v.m.RLock()
+	defer v.m.RUnlock()
+	if v.stopped {
+		// The interface stays down until it's restarted again
+		if v.startFailed {
+			v.fail(errStopped)
+		}
+		return 0, errStopped
+	}
+
+	// vmnet_write copies the packet. p doesn't contain Go pointers, it can be passed to C as is.
+	if errCode := C._vmnet_write(v.iface, unsafe.Pointer(&p[0]), C.ulong(len(p))); errCode != successCode {
+		err := maptoErr(int(errCode))
+		// The other errors are about the packet, not the interface
+		if errors.Is(err, errKernelBufferExhausted) {
+			v.fail(err)
+		}
+		if refused(err) {
+			v.stall.refused(time.Now())
+		}
+		return 0, err
+	}
+	v.stall.written()
 	return len(p), nil
 }
 
@@ -185,13 +440,26 @@ const (
 func packetsAvailable(eventType uint32, pckAvailable uint64) {
 	// VMNet tells us how many packages we can expect to be able to read from the interface.
 	if EventType(eventType) == packetAvailableEvent {
-		for i := 0; i < int(pckAvailable); i++ {
-			bytes, err := vmnetPtr.read()
+		v := vmnetPtr
+		v.m.RLock()
+		defer v.m.RUnlock()
+		if v.stopped {
+			return
+		}
+
+		for remaining := int(pckAvailable); remaining > 0; {
+			n, err := v.readBatch(min(remaining, readBatchSize))
 			if err != nil {
 				log.Error().Err(err).Msg("reading vmnet")
-				// go about our bussiness
+				v.fail(err)
+				return
+			}
+
+			// The number of available packets is an estimate
+			if n == 0 {
+				return
 			}
-			vmnetPtr.Event <- bytes
+			remaining -= n
 		}
 	}
 }
@@ -1,14 +1,51 @@
 #ifndef vmnet_h
 #define vmnet_h
 
+#include <arpa/inet.h>
 #include <sys/uio.h>
 #include <vmnet/vmnet.h>
 
-int _vmnet_start(interface_ref *interface, uint64_t *max_packet_size, uint64_t *mtu_size,
-    char* start_addr, char* end_addr, char* subnet_mask, uint32_t operation_mode, bool isolation, bool debug);
+// Keys of the interface description, NULL and zero values are left out
+struct vmnet_params {
+  uint32_t operation_mode;
+  char* start_addr;
+  char* end_addr;
+  char* subnet_mask;
+  char* shared_interface;
+  bool isolation;
+  uint64_t mtu;
+  unsigned char* network_identifier;
+  char* nat66_prefix;
+};
+
+// Values of vmnet's start-completion dictionary, empty strings if not reported
+struct vmnet_interface_params {
+  uint64_t max_packet_size;
+  uint64_t mtu;
+  char mac_address[18];
+  char start_addr[INET_ADDRSTRLEN];
+  char end_addr[INET_ADDRSTRLEN];
+  char subnet_mask[INET_ADDRSTRLEN];
+  char nat66_prefix[INET6_ADDRSTRLEN];
+  unsigned char interface_id[16];
+};
+
+// Packet buffers of vmnet_read, allocated once and reused by every read
+struct vmnet_batch {
+  struct vmpktdesc *packets;
+  struct iovec *iovecs;
+  int capacity;
+  uint64_t max_packet_size;
+};
+
+int _vmnet_start(interface_ref *interface, struct vmnet_interface_params *iface_params,
+    struct vmnet_params *params);
 int _vmnet_stop(interface_ref interface);
 int _vmnet_write(interface_ref interface, void *bytes, size_t bytes_size);
-int _vmnet_read(interface_ref interface, uint64_t max_packet_size, void **bytes, size_t *bytes_size);
+struct vmnet_batch *_vmnet_batch_new(int capacity, uint64_t max_packet_size);
+void _vmnet_batch_free(struct vmnet_batch *batch);
+int _vmnet_read_batch(interface_ref interface, struct vmnet_batch *batch, int *count);
+void *_vmnet_batch_packet(struct vmnet_batch *batch, int index, size_t *bytes_size);
 extern void packetsAvailable(uint32_t eventType, uint64_t packetCount);
 
 #endif
@@ -0,0 +1,302 @@
+#import "vmnet.h"
+#include <assert.h>
+#include <string.h>
+
+const int errNotWritten = 2001;
+const int errCallback = 3000;
+
+// Copies src to the dst buffer of size bytes, dst is left empty if src is NULL
+static void copy_string(char *dst, size_t size, const char *src) {
+  if (src != NULL) {
+    strlcpy(dst, src, size);
+  }
+}
+
+int _vmnet_start(interface_ref *interface, struct vmnet_interface_params *iface_params,
+  struct vmnet_params *params) {
+  xpc_object_t interface_desc = xpc_dictionary_create(NULL, NULL, 0);
+
+  // The addresses are handed out by the dhcp server of the bridged LAN,
+  // there's no dhcp service on identified networks at all
+  if (params->start_addr != NULL) {
+    xpc_dictionary_set_string(
+      interface_desc,
+      vmnet_start_address_key,
+      params->start_addr
+    );
+
+    xpc_dictionary_set_string(
+      interface_desc,
+      vmnet_end_address_key,
+      params->end_addr
+    );
+
+    xpc_dictionary_set_string(
+      interface_desc,
+      vmnet_subnet_mask_key,
+      params->subnet_mask
+    );
+  }
+
+  if (params->shared_interface != NULL) {
+    xpc_dictionary_set_string(
+      interface_desc,
+      vmnet_shared_interface_name_key,
+      params->shared_interface
+    );
+  }
+
+  if (params->network_identifier != NULL) {
+    xpc_dictionary_set_uuid(
+      interface_desc,
+      vmnet_network_identifier_key,
+      params->network_identifier
+    );
+  }
+
+  if (params->nat66_prefix != NULL) {
+    xpc_dictionary_set_string(
+      interface_desc,
+      vmnet_nat66_prefix_key,
+      params->nat66_prefix
+    );
+  }
+
+  if (params->mtu > 0) {
+    xpc_dictionary_set_uint64(
+      interface_desc,
+      vmnet_mtu_key,
+      params->mtu
+    );
+  }
+
+  xpc_dictionary_set_uint64(
+    interface_desc,
+    vmnet_operation_mode_key,
+    params->operation_mode
+  );
+
+  xpc_dictionary_set_bool(
+    interface_desc,
+    vmnet_enable_isolation_key,
+    params->isolation
+  );
+
+  // NOTE: explore further
+  xpc_dictionary_set_bool(
+    interface_desc,
+    vmnet_enable_tso_key,
+    false
+  );
+
+  // NOTE: explore further
+  xpc_dictionary_set_bool(
+    interface_desc,
+    vmnet_enable_checksum_offload_key,
+    false
+  );
+
+  dispatch_queue_t interface_start_queue =
+    dispatch_queue_create("io.vmnet.start", DISPATCH_QUEUE_SERIAL);
+
+  dispatch_semaphore_t interface_start_semaphore =
+    dispatch_semaphore_create(0);
+
+  __block interface_ref _interface;
+  __block vmnet_return_t interface_status;
+  __block struct vmnet_interface_params vmnet_params = {0};
+
+  _interface = vmnet_start_interface(
+    interface_desc,
+    interface_start_queue,
+    ^(vmnet_return_t status, xpc_object_t interface_param) {
+      interface_status = status;
+
+      if (status != VMNET_SUCCESS || !interface_param) {
+        dispatch_semaphore_signal(interface_start_semaphore);
+        return;
+      }
+
+      vmnet_params.max_packet_size = xpc_dictionary_get_uint64(
+        interface_param,
+        vmnet_max_packet_size_key
+      );
+
+      vmnet_params.mtu = xpc_dictionary_get_uint64(
+        interface_param,
+        vmnet_mtu_key
+      );
+
+      // The strings are owned by the dictionary, which is released once the handler returns
+      copy_string(vmnet_params.mac_address, sizeof(vmnet_params.mac_address),
+        xpc_dictionary_get_string(interface_param, vmnet_mac_address_key));
+
+      // There's no dhcp range in bridged mode, nor on identified networks
+      copy_string(vmnet_params.start_addr, sizeof(vmnet_params.start_addr),
+        xpc_dictionary_get_string(interface_param, vmnet_start_address_key));
+      copy_string(vmnet_params.end_addr, sizeof(vmnet_params.end_addr),
+        xpc_dictionary_get_string(interface_param, vmnet_end_address_key));
+      copy_string(vmnet_params.subnet_mask, sizeof(vmnet_params.subnet_mask),
+        xpc_dictionary_get_string(interface_param, vmnet_subnet_mask_key));
+      copy_string(vmnet_params.nat66_prefix, sizeof(vmnet_params.nat66_prefix),
+        xpc_dictionary_get_string(interface_param, vmnet_nat66_prefix_key));
+
+      const uint8_t *interface_id = xpc_dictionary_get_uuid(
+        interface_param,
+        vmnet_interface_id_key
+      );
+      if (interface_id != NULL) {
+        memcpy(vmnet_params.interface_id, interface_id, sizeof(vmnet_params.interface_id));
+      }
+
+      dispatch_semaphore_signal(interface_start_semaphore);
+  });
+
+  dispatch_semaphore_wait(interface_start_semaphore, DISPATCH_TIME_FOREVER);
+
+  if (interface_status != VMNET_SUCCESS || _interface == NULL) {
+		return interface_status;
+  }
+
+  dispatch_release(interface_start_queue);
+  xpc_release(interface_desc);
+
+  *interface = _interface;
+  *iface_params = vmnet_params;
+
+  dispatch_queue_t if_q = dispatch_queue_create("io.vmnet.packet.avilable", 0);
+
+  // Setup callback, so we have an event driven way of reading packets instead of burning CPU cycles.
+  vmnet_return_t event_callback_start = vmnet_interface_set_event_callback(
+    _interface,
+    VMNET_INTERFACE_PACKETS_AVAILABLE,
+    if_q,
+    ^(interface_event_t event_mask, xpc_object_t _Nonnull event) {
+      if (event_mask != VMNET_INTERFACE_PACKETS_AVAILABLE) {
+        printf("Unknown vmnet interface event 0x%08x\n", event_mask);
+        return;
+      }
+
+      uint64_t packets_available = xpc_dictionary_get_uint64(
+        event,
+        vmnet_estimated_packets_available_key
+      );
+      packetsAvailable(event_mask, packets_available);
+  });
+
+  if (event_callback_start != VMNET_SUCCESS) {
+    return errCallback;
+  }
+
+  return VMNET_SUCCESS;
+}
+
+int _vmnet_stop(interface_ref interface) {
+  vmnet_interface_set_event_callback(interface, VMNET_INTERFACE_PACKETS_AVAILABLE, NULL, NULL);
+
+  dispatch_queue_t stop_queue =
+    dispatch_queue_create("io.vmnet.stop", DISPATCH_QUEUE_SERIAL);
+  dispatch_semaphore_t stop_semaphore = dispatch_semaphore_create(0);
+
+  vmnet_return_t status = vmnet_stop_interface(
+    interface, 
+    stop_queue,
+    ^(vmnet_return_t status) {
+      dispatch_semaphore_signal(stop_semaphore);
+  });
+
+  if (status == VMNET_SUCCESS) {
+      dispatch_semaphore_wait(stop_semaphore, DISPATCH_TIME_FOREVER);
+  }
+
+  dispatch_release(stop_queue);
+  return status;
+}
+
+int _vmnet_write(interface_ref interface, void *bytes, size_t bytes_size) {
+  struct iovec packets_iovec = {
+    .iov_base = bytes,
+    .iov_len = bytes_size,
+  };
+
+  struct vmpktdesc packets = {
+    .vm_pkt_size = bytes_size,
+    .vm_pkt_iov = &packets_iovec,
+    .vm_pkt_iovcnt = 1,
+    .vm_flags = 0,
+  };
+
+  // vmnet_write copies the packet, the bytes are owned by the caller
+  int packets_count = packets.vm_pkt_iovcnt;
+  vmnet_return_t status = vmnet_write(interface, &packets, &packets_count);
+  // The interface didn't take the packet, e.g. its queue is full
+  if (status == VMNET_SUCCESS && packets_count == 0) {
+    return errNotWritten;
+  }
+  return status;
+}
+
+struct vmnet_batch *_vmnet_batch_new(int capacity, uint64_t max_packet_size) {
+  struct vmnet_batch *batch = calloc(1, sizeof(struct vmnet_batch));
+  if (batch == NULL) {
+    return NULL;
+  }
+
+  batch->capacity = capacity;
+  batch->max_packet_size = max_packet_size;
+  batch->packets = calloc(capacity, sizeof(struct vmpktdesc));
+  batch->iovecs = calloc(capacity, sizeof(struct iovec));
+  if (batch->packets == NULL || batch->iovecs == NULL) {
+    _vmnet_batch_free(batch);
+    return NULL;
+  }
+
+  for (int i = 0; i < capacity; i++) {
+    batch->iovecs[i].iov_base = malloc(max_packet_size);
+    if (batch->iovecs[i].iov_base == NULL) {
+      _vmnet_batch_free(batch);
+      return NULL;
+    }
+  }
+
+  return batch;
+}
+
+void _vmnet_batch_free(struct vmnet_batch *batch) {
+  if (batch == NULL) {
+    return;
+  }
+
+  if (batch->iovecs != NULL) {
+    for (int i = 0; i < batch->capacity; i++) {
+      free(batch->iovecs[i].iov_base);
+    }
+  }
+
+  free(batch->iovecs);
+  free(batch->packets);
+  free(batch);
+}
+
+// Reads up to count packets with a single vmnet_read call, count is set to the number of packets read
+int _vmnet_read_batch(interface_ref interface, struct vmnet_batch *batch, int *count) {
+  if (*count > batch->capacity) {
+    *count = batch->capacity;
+  }
+
+  // vmnet_read overwrites the sizes with the sizes of the packets read
+  for (int i = 0; i < *count; i++) {
+    batch->iovecs[i].iov_len = batch->max_packet_size;
+    batch->packets[i].vm_pkt_size = batch->max_packet_size;
+    batch->packets[i].vm_pkt_iov = &batch->iovecs[i];
+    batch->packets[i].vm_pkt_iovcnt = 1;
+    batch->packets[i].vm_flags = 0;
+  }
+
+  return vmnet_read(interface, batch->packets, count);
+}
+
+void *_vmnet_batch_packet(struct vmnet_batch *batch, int index, size_t *bytes_size) {
+  *bytes_size = batch->packets[index].vm_pkt_size;
+  return batch->iovecs[index].iov_base;
+}
@@ -0,0 +1,280 @@
+// nolint:godot
+
+package sockvmnet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/stack"
+	"inet.af/netaddr"
+)
+
+var (
+	errInvalidRange  = errors.New("the address range must be ipv4, with the start before the end")
+	errInvalidQueues = errors.New("the number of queues must be positive")
+	errNoBackend     = errors.New("the custom backend is nil")
+	errNoObserver    = errors.New("the observer is nil")
+)
+
+// Option configures the network of New
+type Option func(p *stack.NetworkParams) error
+
+// The defaults of the command line flags
+func defaultParams() stack.NetworkParams {
+	return stack.NetworkParams{
+		StartAddr:  netaddr.MustParseIP("192.168.64.1"),
+		EndAddr:    netaddr.MustParseIP("192.168.64.255"),
+		SubnetMask: netaddr.MustParseIP("255.255.255.0"),
+		Queues:     1,
+	}
+}
+
+// WithBackend selects a built-in backend. Default backend is BackendVMNet.
+func WithBackend(kind BackendKind) Option {
+	return func(p *stack.NetworkParams) error {
+		p.Backend = kind
+		return nil
+	}
+}
+
+// WithCustomBackend plugs in a backend of your own, instead of a built-in one
+func WithCustomBackend(backend Backend) Option {
+	return func(p *stack.NetworkParams) error {
+		if backend == nil {
+			return errNoBackend
+		}
+		p.CustomBackend = backend
+		return nil
+	}
+}
+
+// WithMode sets what the VM is allowed to reach. Default mode is ModeShared.
+// bridgeInterface is the host interface of ModeBridged, e.g. en0, ignored by the other modes.
+func WithMode(mode NetworkMode, bridgeInterface string) Option {
+	return func(p *stack.NetworkParams) error {
+		p.Mode = mode
+		p.BridgeInterface = bridgeInterface
+		return nil
+	}
+}
+
+// WithDHCPServer only trusts the dhcp server to hand out the VM's leases. Default server is
+// the gateway, in ModeBridged it's the LAN's dhcp server which acknowledges the first lease.
+func WithDHCPServer(server netaddr.IP) Option {
+	return func(p *stack.NetworkParams) error {
+		p.DHCPServer = server
+		return nil
+	}
+}
+
+// WithAddressRange sets the subnet the VMs are leased addresses from. The first
+// address is the gateway's. Default range is 192.168.64.1 - 192.168.64.255/24.
+func WithAddressRange(start, end, subnetMask netaddr.IP) Option {
+	return func(p *stack.NetworkParams) error {
+		if !start.Is4() || !end.Is4() || !subnetMask.Is4() || !start.Less(end) {
+			return fmt.Errorf("%w: %s - %s", errInvalidRange, start, end)
+		}
+		p.StartAddr = start
+		p.EndAddr = end
+		p.SubnetMask = subnetMask
+		return nil
+	}
+}
+
+// WithMTU sets the MTU of the VM's interface. Default MTU is 1500.
+func WithMTU(mtu int) Option {
+	return func(p *stack.NetworkParams) error {
+		p.MTU = mtu
+		return nil
+	}
+}
+
+// WithoutIsolation lets the VM reach the VMs of other vmnet interfaces
+func WithoutIsolation() Option {
+	return func(p *stack.NetworkParams) error {
+		p.DisableIsolation = true
+		return nil
+	}
+}
+
+// WithNetworkID joins the VM to the vmnet network of the UUID, shared by the processes
+// started with the same identifier. Only used by the vmnet backend in ModeHost.
+func WithNetworkID(id string) Option {
+	return func(p *stack.NetworkParams) error {
+		p.NetworkID = id
+		return nil
+	}
+}
+
+// WithNAT66Prefix sets the ULA /64 prefix of the VM's IPv6 address, e.g. fd9b:5a14:ba57:e3d3::/64.
+// Only used by the vmnet backend in ModeShared.
+func WithNAT66Prefix(prefix string) Option {
+	return func(p *stack.NetworkParams) error {
+		p.NAT66Prefix = prefix
+		return nil
+	}
+}
+
+// WithHostPorts lets the VM reach the ports of the host's loopback interface through the gateway.
+// Only used by the userspace backend.
+func WithHostPorts(ports ...uint16) Option {
+	return func(p *stack.NetworkParams) error {
+		p.HostPorts = append(p.HostPorts, ports...)
+		return nil
+	}
+}
+
+// WithDNSProxy answers the VM's DNS queries by the embedded proxy,
+// which forwards them to the upstreams (host[:port]) in order
+func WithDNSProxy(upstreams ...string) Option {
+	return func(p *stack.NetworkParams) error {
+		p.DNSUpstreams = append(p.DNSUpstreams, upstreams...)
+		return nil
+	}
+}
+
+// WithAllowedDomains only lets the VM reach the addresses resolved from the domains, e.g. *.github.com
+func WithAllowedDomains(domains ...string) Option {
+	return func(p *stack.NetworkParams) error {
+		p.AllowedDomains = append(p.AllowedDomains, domains...)
+		return nil
+	}
+}
+
+// WithDNSBlocklist answers the VM's queries for the names of the file with NXDOMAIN
+func WithDNSBlocklist(path string) Option {
+	return func(p *stack.NetworkParams) error {
+		p.DNSBlocklist = path
+		return nil
+	}
+}
+
+// WithDNSLogging logs the names the VM queries, and the response codes of the replies,
+// at info level, even if the level of zerolog's log.Logger is higher
+func WithDNSLogging() Option {
+	return func(p *stack.NetworkParams) error {
+		p.LogDNS = true
+		return nil
+	}
+}
+
+// WithVMName makes the VM's address resolvable as <name>.<domain> by the VMs of the process.
+// Default domain is vm.local, if domain is empty. The host resolves it through WithHostDNS.
+func WithVMName(name, domain string) Option {
+	return func(p *stack.NetworkParams) error {
+		p.VMName = name
+		p.LocalDomain = domain
+		return nil
+	}
+}
+
+// WithHostDNS answers the host's DNS queries for the VM names on the UDP address,
+// e.g. 127.0.0.1:5354. The names of every segment are answered, the others are refused.
+func WithHostDNS(addr string) Option {
+	return func(p *stack.NetworkParams) error {
+		p.HostDNSAddr = addr
+		return nil
+	}
+}
+
+// WithDNSHost answers the VM's queries for the name with the addresses
+func WithDNSHost(name string, addrs ...netaddr.IP) Option {
+	return func(p *stack.NetworkParams) error {
+		if p.DNSHosts == nil {
+			p.DNSHosts = make(map[string][]netaddr.IP)
+		}
+		p.DNSHosts[name] = append(p.DNSHosts[name], addrs...)
+		return nil
+	}
+}
+
+// WithPortForwards exposes the ports of the VM on the host
+func WithPortForwards(forwards ...PortForward) Option {
+	return func(p *stack.NetworkParams) error {
+		p.PortForwards = append(p.PortForwards, forwards...)
+		return nil
+	}
+}
+
+// WithSegment puts the VM in a segment, like an 802.1Q VLAN ID
+func WithSegment(segment uint16) Option {
+	return func(p *stack.NetworkParams) error {
+		p.Segment = segment
+		return nil
+	}
+}
+
+// WithPeerVMs attaches additional VMs to the network. The sockets of the VMs
+// are owned by the network, like the socket of New.
+func WithPeerVMs(vms ...VM) Option {
+	return func(p *stack.NetworkParams) error {
+		p.PeerVMs = append(p.PeerVMs, vms...)
+		return nil
+	}
+}
+
+// WithQueues sets the number of workers per direction. Default is 1.
+func WithQueues(n int) Option {
+	return func(p *stack.NetworkParams) error {
+		if n < 1 {
+			return fmt.Errorf("%w: %d", errInvalidQueues, n)
+		}
+		p.Queues = n
+		return nil
+	}
+}
+
+// WithQueuePolicy sets what happens to the frames read from the backend when its queue
+// of depth frames is full. timeout is only used by Block. The zero values select the defaults:
+// DropTail, 100 frames and 10ms.
+func WithQueuePolicy(policy QueuePolicy, depth int, timeout time.Duration) Option {
+	return func(p *stack.NetworkParams) error {
+		p.QueuePolicy = policy
+		p.QueueDepth = depth
+		p.QueueTimeout = timeout
+		return nil
+	}
+}
+
+// WithDrainTimeout sets how long the frames already read are delivered, once
+// the context of Run is done. Default timeout is 1s.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(p *stack.NetworkParams) error {
+		p.DrainTimeout = timeout
+		return nil
+	}
+}
+
+// WithObserver notifies the observer about the events of the network
+func WithObserver(observer Observer) Option {
+	return func(p *stack.NetworkParams) error {
+		if observer == nil {
+			return errNoObserver
+		}
+		p.Observer = observer
+		return nil
+	}
+}
+
+// WithReadiness writes the Readiness of the VM to w as JSON, once its first lease is
+// acknowledged, then closes w. Run closes w without a report, if the network fails to start.
+// w can be nil, if only the timeout is needed. If timeout isn't 0,
+// Run returns ErrNoLease when the VM isn't acknowledged a lease in time.
+func WithReadiness(w io.WriteCloser, timeout time.Duration) Option {
+	return func(p *stack.NetworkParams) error {
+		p.Ready = w
+		p.ReadyTimeout = timeout
+		return nil
+	}
+}
+
+// WithDebug enables debug logging
+func WithDebug() Option {
+	return func(p *stack.NetworkParams) error {
+		p.Debug = true
+		return nil
+	}
+}
@@ -0,0 +1,82 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package sockvmnet
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+var testMAC = net.HardwareAddr{0x5e, 0x8b, 0x78, 0x73, 0x78, 0x14}
+
+func TestOptions(t *testing.T) {
+	ip := netaddr.MustParseIP
+	mask := ip("255.255.255.0")
+
+	tests := []struct {
+		name string
+		opts []Option
+		// Any error, if the stack rejects the options
+		fails bool
+		err   error
+	}{
+		{name: "defaults"},
+		{name: "address range", opts: []Option{WithAddressRange(ip("10.0.0.1"), ip("10.0.0.254"), mask)}},
+		{name: "start after end", opts: []Option{WithAddressRange(ip("10.0.0.254"), ip("10.0.0.1"), mask)}, err: errInvalidRange},
+		{name: "single address", opts: []Option{WithAddressRange(ip("10.0.0.1"), ip("10.0.0.1"), mask)}, err: errInvalidRange},
+		{name: "ipv6 range", opts: []Option{WithAddressRange(ip("fd00::1"), ip("fd00::ff"), mask)}, err: errInvalidRange},
+		{name: "ipv6 subnet mask", opts: []Option{WithAddressRange(ip("10.0.0.1"), ip("10.0.0.254"), ip("ffff::"))}, err: errInvalidRange},
+		{name: "missing range", opts: []Option{WithAddressRange(netaddr.IP{}, ip("10.0.0.254"), mask)}, err: errInvalidRange},
+		{name: "queues", opts: []Option{WithQueues(4)}},
+		{name: "no queues", opts: []Option{WithQueues(0)}, err: errInvalidQueues},
+		{name: "negative queues", opts: []Option{WithQueues(-1)}, err: errInvalidQueues},
+		{name: "nil backend", opts: []Option{WithCustomBackend(nil)}, err: errNoBackend},
+		{name: "nil observer", opts: []Option{WithObserver(nil)}, err: errNoObserver},
+		{name: "host mode", opts: []Option{WithMode(ModeHost, "")}},
+		{name: "bridged mode", opts: []Option{WithMode(ModeBridged, "en0")}},
+		{name: "invalid mode", opts: []Option{WithMode("nat", "")}, fails: true},
+		{name: "bridged mode without interface", opts: []Option{WithMode(ModeBridged, "")}, fails: true},
+		{name: "DNS proxy in host mode", opts: []Option{WithMode(ModeHost, ""), WithDNSProxy("1.1.1.1")}, fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The socket isn't opened until Run
+			opts := append([]Option{WithCustomBackend(&testBackend{})}, tt.opts...)
+			n, err := New(-1, testMAC, opts...)
+			switch {
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Errorf("got %v, want %v", err, tt.err)
+				}
+			case tt.fails:
+				if err == nil {
+					t.Error("got the options accepted")
+				}
+			case err != nil:
+				t.Error(err)
+			case n == nil:
+				t.Error("got no network")
+			}
+		})
+	}
+}
+
+// The options are applied on top of the defaults
+func TestOptionsApplied(t *testing.T) {
+	start, end, mask := netaddr.MustParseIP("10.0.0.1"), netaddr.MustParseIP("10.0.0.254"), netaddr.MustParseIP("255.255.0.0")
+	n, err := New(-1, testMAC, WithCustomBackend(&testBackend{}), WithAddressRange(start, end, mask), WithQueues(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := n.st.NetworkParams
+	if p.StartAddr != start || p.EndAddr != end || p.SubnetMask != mask {
+		t.Errorf("got range %s-%s/%s", p.StartAddr, p.EndAddr, p.SubnetMask)
+	}
+	if p.Queues != 2 || p.Mode != ModeShared || p.Fd != -1 || p.HardwareAddr.String() != testMAC.String() {
+		t.Errorf("got %d queues, mode %s, fd %d, mac %s", p.Queues, p.Mode, p.Fd, p.HardwareAddr)
+	}
+}
@@ -0,0 +1,158 @@
+// nolint:godot
+
+// Package sockvmnet embeds the sock-vmnet network stack in a Go process, e.g. in a hypervisor.
+//
+// The VM's end of a SOCK_DGRAM socketpair is attached to the stack, which hands out
+// the VM's address through dhcp, enforces the anti-spoofing rules, and passes
+// the VM's traffic to the backend:
+//
+//	network, err := sockvmnet.New(fd, mac,
+//		sockvmnet.WithBackend(sockvmnet.BackendUserspace),
+//		sockvmnet.WithObserver(sockvmnet.ObserverFunc(func(e sockvmnet.Event) {
+//			if e.Kind == sockvmnet.EventLeaseAcquired {
+//				log.Printf("%s leased %s", e.HardwareAddr, e.Lease.Addr)
+//			}
+//		})),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	return network.Run(ctx)
+package sockvmnet
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"github.com/nagypeterjob/sock-vmnet/internal/netif"
+	"github.com/nagypeterjob/sock-vmnet/internal/stack"
+)
+
+type (
+	// Backend is the host side of the network. Implement it to plug in
+	// a backend of your own, see WithCustomBackend.
+	Backend = stack.Backend
+	// BackendKind selects one of the built-in backends
+	BackendKind = stack.BackendKind
+	// NetworkMode defines what the VM is allowed to reach
+	NetworkMode = stack.NetworkMode
+	// VM is an additional VM attached to the network, see WithPeerVMs
+	VM = stack.VM
+	// PortForward exposes a port of the VM on the host, see ParsePortForward
+	PortForward = stack.PortForward
+	// QueuePolicy decides what happens to the frames of a full backend queue
+	QueuePolicy = backpressure.Policy
+	// QueueStats counts the outcomes of the frames queued by the backend
+	QueueStats = backpressure.Stats
+	// Stats counts the frames dropped between the backend and the VMs
+	Stats = stack.Stats
+	// Event is emitted to the Observer
+	Event = stack.Event
+	// EventKind tells what happened to a VM
+	EventKind = stack.EventKind
+	// Lease is the dhcp lease acknowledged to a VM
+	Lease = stack.Lease
+	// Observer is notified about the events of the network
+	Observer = stack.Observer
+	// ObserverFunc adapts a function to an Observer
+	ObserverFunc = stack.ObserverFunc
+	// JSONObserver writes the events as JSON lines, see NewJSONObserver
+	JSONObserver = stack.JSONObserver
+	// Readiness is the report of the VM, written once its first lease is acknowledged
+	Readiness = stack.Readiness
+	// Interface describes the network the backend created on the host
+	Interface = netif.Interface
+)
+
+const (
+	BackendVMNet     = stack.BackendVMNet
+	BackendUserspace = stack.BackendUserspace
+
+	ModeShared  = stack.ModeShared
+	ModeHost    = stack.ModeHost
+	ModeBridged = stack.ModeBridged
+
+	DropTail = backpressure.DropTail
+	DropHead = backpressure.DropHead
+	Block    = backpressure.Block
+	Priority = backpressure.Priority
+
+	EventLeaseAcquired = stack.EventLeaseAcquired
+	EventLeaseRenewed  = stack.EventLeaseRenewed
+	EventLeaseExpired  = stack.EventLeaseExpired
+	EventAddrChanged   = stack.EventAddrChanged
+	EventSpoofBlocked  = stack.EventSpoofBlocked
+	EventDrop          = stack.EventDrop
+	EventBackendError  = stack.EventBackendError
+	EventSocketClosed  = stack.EventSocketClosed
+)
+
+var (
+	// ErrVMClosed is returned by Run, when the VM closed its socket
+	ErrVMClosed = stack.ErrVMClosed
+	// ErrBackendFailed is returned by Run, when the backend failed, and restarting it can't help
+	ErrBackendFailed = stack.ErrBackendFailed
+	// ErrNoLease is returned by Run, when the VM wasn't acknowledged a lease in time, see WithReadiness
+	ErrNoLease = stack.ErrNoLease
+)
+
+// NewJSONObserver returns an observer writing the events to w, one JSON object per line.
+// The events are written by its own goroutine, the ones it can't keep up with are dropped.
+// Close it once Run returned, to write the events left.
+func NewJSONObserver(w io.Writer) *JSONObserver {
+	return stack.NewJSONObserver(w)
+}
+
+// ParsePortForward parses a port forward in [tcp/|udp/][host_ip:]host_port:vm_port format
+func ParsePortForward(spec string) (PortForward, error) {
+	return stack.ParsePortForward(spec)
+}
+
+// Network is the network of a VM, and its peer VMs
+type Network struct {
+	st *stack.Stack
+}
+
+// New configures the network of the VM. fd is the stack's end of the VM's
+// SOCK_DGRAM socketpair, it's owned by the network from now on,
+// and closed when Run returns. mac is the VM's MAC address.
+func New(fd int, mac net.HardwareAddr, opts ...Option) (*Network, error) {
+	p := defaultParams()
+	p.Fd = fd
+	p.HardwareAddr = mac
+
+	for _, opt := range opts {
+		if err := opt(&p); err != nil {
+			return nil, err
+		}
+	}
+
+	st, err := stack.NewNetwork(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Network{st: st}, nil
+}
+
+// Run the network until ctx is done, the VM closes its socket (ErrVMClosed),
+// the backend fails for good (ErrBackendFailed), or the VM isn't leased an address
+// in time (ErrNoLease). The frames already read are delivered before Run returns.
+// Run fails right away, if the backend created a different network than configured.
+// A network can only be run once.
+func (n *Network) Run(ctx context.Context) error {
+	return n.st.Run(ctx)
+}
+
+// Interface returns the network the backend created, e.g. the address range
+// vmnet chose, or its NAT66 prefix. Only known once Run started the backend.
+func (n *Network) Interface() Interface {
+	return n.st.Interface()
+}
+
+// Stats returns the counters of the dropped frames
+func (n *Network) Stats() Stats {
+	return n.st.Stats()
+}
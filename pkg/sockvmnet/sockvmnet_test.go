@@ -0,0 +1,247 @@
+// nolint:exhaustivestruct,exhaustruct,gomnd
+package sockvmnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nagypeterjob/sock-vmnet/internal/backpressure"
+	"github.com/nagypeterjob/sock-vmnet/internal/netif"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	testGateway = net.IPv4(192, 168, 64, 1).To4()
+	testVMAddr  = net.IPv4(192, 168, 64, 2).To4()
+	testHostMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0xfe}
+)
+
+// testBackend is the dhcp server of the gateway, which leases testVMAddr. It discards
+// the other frames, and records whether it's running.
+type testBackend struct {
+	frames  chan []byte
+	started atomic.Bool
+	stopped atomic.Bool
+	once    sync.Once
+}
+
+func (b *testBackend) Start() error {
+	b.frames = make(chan []byte, 16)
+	b.started.Store(true)
+	return nil
+}
+
+func (b *testBackend) Stop() error {
+	b.stopped.Store(true)
+	b.once.Do(func() { close(b.frames) })
+	return nil
+}
+
+func (b *testBackend) Write(p []byte) (int, error) {
+	packet := gopacket.NewPacket(p, layers.LayerTypeEthernet, gopacket.Default)
+	if dhcp, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4); ok {
+		switch dhcpMessageType(dhcp) {
+		case layers.DHCPMsgTypeDiscover:
+			b.frames <- dhcpReply(dhcp, layers.DHCPMsgTypeOffer)
+		case layers.DHCPMsgTypeRequest:
+			b.frames <- dhcpReply(dhcp, layers.DHCPMsgTypeAck)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *testBackend) Frames() <-chan []byte  { return b.frames }
+func (b *testBackend) Release([]byte)         {}
+func (b *testBackend) FrameSize() int         { return 1514 }
+func (b *testBackend) Interface() Interface   { return netif.Interface{MTU: 1500} }
+func (b *testBackend) QueueStats() QueueStats { return backpressure.Stats{} }
+func (b *testBackend) Failures() <-chan error { return nil }
+func (b *testBackend) Transient(error) bool   { return false }
+func (b *testBackend) Restart() error         { return nil }
+
+func dhcpMessageType(dhcp *layers.DHCPv4) layers.DHCPMsgType {
+	for _, opt := range dhcp.Options {
+		if opt.Type == layers.DHCPOptMessageType && len(opt.Data) == 1 {
+			return layers.DHCPMsgType(opt.Data[0])
+		}
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+// The gateway's reply to the VM's request, leasing testVMAddr for an hour
+func dhcpReply(req *layers.DHCPv4, msgType layers.DHCPMsgType) []byte {
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          req.Xid,
+		YourClientIP: testVMAddr,
+		ClientHWAddr: req.ClientHWAddr,
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}),
+			layers.NewDHCPOption(layers.DHCPOptServerID, testGateway),
+			layers.NewDHCPOption(layers.DHCPOptLeaseTime, []byte{0, 0, 0x0e, 0x10}),
+			layers.NewDHCPOption(layers.DHCPOptSubnetMask, []byte{255, 255, 255, 0}),
+			layers.NewDHCPOption(layers.DHCPOptRouter, testGateway),
+		},
+	}
+	eth := &layers.Ethernet{SrcMAC: testHostMAC, DstMAC: req.ClientHWAddr, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: testGateway, DstIP: testVMAddr}
+	udp := &layers.UDP{SrcPort: 67, DstPort: 68}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	_ = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, dhcp)
+	return buf.Bytes()
+}
+
+// The stack's end of a new socketpair, and the VM's end
+func testSocket(t *testing.T) (int, net.Conn) {
+	t.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// FileConn dups the descriptor
+	f := os.NewFile(uintptr(fds[1]), "vm")
+	vm, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { vm.Close() })
+	return fds[0], vm
+}
+
+func dhcpFrame(t *testing.T, msgType layers.DHCPMsgType, requested net.IP) []byte {
+	t.Helper()
+
+	opts := layers.DHCPOptions{layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)})}
+	if requested != nil {
+		opts = append(opts, layers.NewDHCPOption(layers.DHCPOptRequestIP, requested.To4()))
+	}
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          7,
+		ClientHWAddr: testMAC,
+		Options:      opts,
+	}
+	eth := &layers.Ethernet{SrcMAC: testMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4zero.To4(), DstIP: net.IPv4bcast.To4()}
+	udp := &layers.UDP{SrcPort: 68, DstPort: 67}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, dhcp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Reads the frames sent to the VM until a dhcp reply
+func readDHCP(t *testing.T, vm net.Conn) *layers.DHCPv4 {
+	t.Helper()
+
+	buf := make([]byte, 65536)
+	for {
+		_ = vm.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := vm.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := gopacket.NewPacket(buf[:n], layers.LayerTypeEthernet, gopacket.Default)
+		if dhcp, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4); ok {
+			return dhcp
+		}
+	}
+}
+
+// Runs the network of the VM until it's stopped, the report is written to ready
+func startTestNetwork(t *testing.T, fd int, b Backend, ready io.WriteCloser, timeout time.Duration) func() error {
+	t.Helper()
+
+	n, err := New(fd, testMAC, WithCustomBackend(b), WithReadiness(ready, timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- n.Run(ctx) }()
+
+	stop := sync.OnceValue(func() error {
+		cancel()
+		return <-done
+	})
+	t.Cleanup(func() { _ = stop() })
+	return stop
+}
+
+// Run reports the VM ready once it's leased an address, and stops the backend once ctx is done
+func TestRun(t *testing.T) {
+	fd, vm := testSocket(t)
+	b := &testBackend{}
+	r, w := io.Pipe()
+	stop := startTestNetwork(t, fd, b, w, 5*time.Second)
+
+	_, _ = vm.Write(dhcpFrame(t, layers.DHCPMsgTypeDiscover, nil))
+	offer := readDHCP(t, vm)
+	_, _ = vm.Write(dhcpFrame(t, layers.DHCPMsgTypeRequest, offer.YourClientIP))
+	ack := readDHCP(t, vm)
+
+	var report Readiness
+	if err := json.NewDecoder(r).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if !ack.YourClientIP.Equal(testVMAddr) {
+		t.Fatalf("got %s acknowledged, want %s", ack.YourClientIP, testVMAddr)
+	}
+	if report.HardwareAddr != testMAC.String() || report.Addr.String() != testVMAddr.String() ||
+		report.Gateway.String() != testGateway.String() || report.MTU != 1500 {
+		t.Errorf("got %+v, want %s leased %s", report, testMAC, testVMAddr)
+	}
+	// Closed after the report
+	if rest, err := io.ReadAll(r); err != nil || len(bytes.TrimSpace(rest)) != 0 {
+		t.Errorf("got %q, %v after the report", rest, err)
+	}
+
+	if err := stop(); err != nil {
+		t.Fatalf("got %v, want the network running until it's stopped", err)
+	}
+	if !b.started.Load() || !b.stopped.Load() {
+		t.Errorf("got the backend started %t, stopped %t", b.started.Load(), b.stopped.Load())
+	}
+}
+
+// Run stops on its own, when the VM isn't leased an address in time
+func TestRunNoLease(t *testing.T) {
+	fd, _ := testSocket(t)
+	b := &testBackend{}
+	r, w := io.Pipe()
+	stop := startTestNetwork(t, fd, b, w, 50*time.Millisecond)
+
+	// Closed without a report
+	if report, err := io.ReadAll(r); err != nil || len(report) != 0 {
+		t.Errorf("got %q, %v, want no report", report, err)
+	}
+	if err := stop(); !errors.Is(err, ErrNoLease) {
+		t.Fatalf("got %v, want %v", err, ErrNoLease)
+	}
+	if !b.stopped.Load() {
+		t.Error("backend not stopped")
+	}
+}